@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// anthropicURL is the Anthropic Messages API endpoint.
+const anthropicURL = "https://api.anthropic.com/v1/messages"
+
+// anthropicVersion is sent in the required anthropic-version header.
+const anthropicVersion = "2023-06-01"
+
+// defaultAnthropicModel is used when ANTHROPIC_MODEL is not set.
+const defaultAnthropicModel = "claude-3-5-haiku-latest"
+
+// anthropicMaxTokens caps the reply length; the Messages API requires max_tokens.
+const anthropicMaxTokens = 4096
+
+// anthropicModels are the Claude models a client may select at runtime.
+var anthropicModels = []string{
+	"claude-3-5-haiku-latest",
+	"claude-3-5-sonnet-latest",
+	"claude-3-opus-latest",
+}
+
+// AnthropicRequest represents a request to the Anthropic Messages API.
+// Unlike OpenAI, the system prompt is a top-level field rather than a message.
+type AnthropicRequest struct {
+	Model       string    `json:"model"`
+	System      string    `json:"system,omitempty"`
+	Messages    []Message `json:"messages"`
+	MaxTokens   int       `json:"max_tokens"`
+	Stream      bool      `json:"stream"`
+	Temperature *float64  `json:"temperature,omitempty"`
+	TopP        *float64  `json:"top_p,omitempty"`
+	// StopSequences is Anthropic's name for OpenAI's stop.
+	StopSequences []string `json:"stop_sequences,omitempty"`
+}
+
+// AnthropicEvent represents a streamed event from the Anthropic Messages API.
+// Text arrives in "content_block_delta" events whose delta type is "text_delta",
+// and extended thinking in those whose delta type is "thinking_delta".
+// Token usage is split: input tokens come in "message_start", output tokens in "message_delta".
+// The "message_delta" event also says why the reply stopped.
+type AnthropicEvent struct {
+	Type  string `json:"type"`
+	Delta struct {
+		Type       string `json:"type"`
+		Text       string `json:"text"`
+		Thinking   string `json:"thinking"`
+		StopReason string `json:"stop_reason"`
+	} `json:"delta"`
+	Message struct {
+		Usage AnthropicUsage `json:"usage"`
+	} `json:"message"`
+	Usage *AnthropicUsage `json:"usage"`
+	// Error is set on "error" events.
+	Error struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// anthropicFinishReasons maps Anthropic's stop reasons to OpenAI's finish reasons.
+var anthropicFinishReasons = map[string]string{
+	"end_turn":      "stop",
+	"stop_sequence": "stop",
+	"max_tokens":    "length",
+	"tool_use":      "tool_calls",
+	"refusal":       "content_filter",
+}
+
+// AnthropicUsage reports how many tokens a request consumed.
+type AnthropicUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+// AnthropicProvider streams completions from Anthropic's Claude models.
+type AnthropicProvider struct {
+	APIKey string
+	URL    string
+	Client *http.Client
+}
+
+// CheckConfig implements ConfigChecker.
+func (p *AnthropicProvider) CheckConfig() error {
+	if p.APIKey == "" {
+		return fmt.Errorf("%w: ANTHROPIC_API_KEY is not set", ErrNotConfigured)
+	}
+	return nil
+}
+
+// StreamCompletion implements Provider.
+func (p *AnthropicProvider) StreamCompletion(ctx context.Context, req CompletionRequest) (<-chan StreamEvent, error) {
+	if err := p.CheckConfig(); err != nil {
+		return nil, err
+	}
+	// Move system messages into the top-level system field.
+	var system []string
+	messages := make([]Message, 0, len(req.Messages))
+	for _, m := range req.Messages {
+		if m.Role == "system" {
+			system = append(system, m.Content)
+			continue
+		}
+		messages = append(messages, m)
+	}
+	maxTokens := anthropicMaxTokens
+	if req.Params.MaxTokens != nil {
+		maxTokens = *req.Params.MaxTokens
+	}
+	reqBody, err := json.Marshal(AnthropicRequest{
+		Model:         req.Model,
+		System:        strings.Join(system, "\n\n"),
+		Messages:      messages,
+		MaxTokens:     maxTokens,
+		Stream:        true,
+		Temperature:   req.Params.Temperature,
+		TopP:          req.Params.TopP,
+		StopSequences: req.Params.Stop,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrMarshal, err)
+	}
+
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	header.Set("x-api-key", p.APIKey)
+	header.Set("anthropic-version", anthropicVersion)
+	resp, err := doWithRetry(ctx, p.Client, "POST", p.URL, reqBody, header, maxRetries)
+	if err != nil {
+		return nil, fmt.Errorf("error calling Anthropic API: %w", err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		return nil, readUpstreamError("Anthropic", resp)
+	}
+
+	events := make(chan StreamEvent)
+	go func() {
+		defer close(events)
+		defer resp.Body.Close()
+		readAnthropicStream(ctx, resp.Body, events)
+	}()
+	return events, nil
+}
+
+// readAnthropicStream reads Anthropic's server-sent events and sends each text delta to events.
+// Events come as "event: <name>" / "data: {json}" line pairs; only the data lines matter
+// because the JSON repeats the event type.
+func readAnthropicStream(ctx context.Context, body io.Reader, events chan<- StreamEvent) {
+	defer closeOnCancel(ctx, body)()
+	reader := bufio.NewReader(body)
+	var inputTokens int
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			if err != io.EOF {
+				sendStreamError(ctx, events, "anthropic", fmt.Errorf("error reading Anthropic stream: %w", err))
+			}
+			return
+		}
+
+		line = strings.TrimSpace(line)
+		debugResponseLine(ctx, "anthropic", line)
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+		var event AnthropicEvent
+		if err := json.Unmarshal([]byte(strings.TrimSpace(strings.TrimPrefix(line, "data:"))), &event); err != nil {
+			loggerFrom(ctx).Warn("skipping malformed stream event", "provider", "anthropic", "err", err)
+			continue
+		}
+		switch event.Type {
+		case "message_stop":
+			return
+		case "error":
+			// Overloads and other failures after the stream started arrive as an event.
+			sendStreamError(ctx, events, "anthropic", fmt.Errorf("%w: Anthropic: %s", ErrUpstream, redact(event.Error.Message)))
+			return
+		case "message_start":
+			inputTokens = event.Message.Usage.InputTokens
+		case "message_delta":
+			if event.Usage != nil {
+				usage := &Usage{PromptTokens: inputTokens, CompletionTokens: event.Usage.OutputTokens}
+				if !sendEvent(ctx, events, StreamEvent{Usage: usage}) {
+					return
+				}
+			}
+			if reason := anthropicFinishReasons[event.Delta.StopReason]; reason != "" {
+				if !sendEvent(ctx, events, StreamEvent{FinishReason: reason}) {
+					return
+				}
+			}
+		case "content_block_delta":
+			if event.Delta.Type == "thinking_delta" && event.Delta.Thinking != "" {
+				if !sendEvent(ctx, events, StreamEvent{Reasoning: event.Delta.Thinking}) {
+					return
+				}
+				continue
+			}
+			if event.Delta.Type != "text_delta" || event.Delta.Text == "" {
+				continue
+			}
+			if !sendEvent(ctx, events, StreamEvent{Content: event.Delta.Text}) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Limits of POST /api/chat and POST /api/stream, which can be overridden with
+// API_MAX_BODY_BYTES, API_MAX_MESSAGES, API_MAX_CHARS and API_TIMEOUT. A
+// limit of 0 disables it.
+const (
+	defaultAPIMaxBodyBytes = 1 << 20
+	defaultAPIMaxMessages  = 100
+	defaultAPIMaxChars     = 200_000
+	defaultAPITimeout      = 2 * time.Minute
+)
+
+var (
+	apiMaxBodyBytes = defaultAPIMaxBodyBytes
+	apiMaxMessages  = defaultAPIMaxMessages
+	apiMaxChars     = defaultAPIMaxChars
+	apiTimeout      = defaultAPITimeout
+)
+
+// ChatAPIRequest is the body of POST /api/chat.
+// The embedded GenerationParams accept temperature, top_p and max_tokens.
+type ChatAPIRequest struct {
+	Messages []Message `json:"messages"`
+	Model    string    `json:"model"`
+	GenerationParams
+}
+
+// ChatAPIResponse is the body returned by POST /api/chat.
+type ChatAPIResponse struct {
+	Model   string  `json:"model"`
+	Message Message `json:"message"`
+}
+
+// apiError sends a JSON error body with the given status code.
+func apiError(c *fiber.Ctx, status int, message string) error {
+	return c.Status(status).JSON(fiber.Map{"error": message})
+}
+
+// idempotencyCache holds the responses to requests sent with an Idempotency-Key.
+var idempotencyCache = NewIdempotencyCache(defaultIdempotencyCacheSize, defaultIdempotencyTTL)
+
+// handleChatAPI answers a whole conversation in one request/response, for
+// clients such as CLI tools that don't want a WebSocket.
+// Requests with an Idempotency-Key header that the same sender used recently
+// for the same body get the earlier response replayed instead of a new
+// completion; a different body with the key is refused with 422. A request
+// arriving while the first one with its key is still running waits for that one.
+func handleChatAPI(c *fiber.Ctx) error {
+	key := c.Get("Idempotency-Key")
+	if key == "" {
+		return chatAPI(c)
+	}
+	resp, owner, err := idempotencyCache.Begin(idempotencyKey(c, key), sha256.Sum256(c.Body()))
+	if err != nil {
+		return apiError(c, fiber.StatusUnprocessableEntity, err.Error())
+	}
+	if !owner {
+		<-resp.done
+		c.Set("Idempotent-Replayed", "true")
+		c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+		return c.Status(resp.status).Send(resp.body)
+	}
+	err = chatAPI(c)
+	idempotencyCache.Finish(resp, c.Response().StatusCode(), append([]byte(nil), c.Response().Body()...))
+	return err
+}
+
+// chatAPI implements handleChatAPI.
+func chatAPI(c *fiber.Ctx) error {
+	var req ChatAPIRequest
+	if err := parseChatAPIRequest(c, &req); err != nil {
+		return apiError(c, err.Code, err.Message)
+	}
+	completionReq, err := req.toCompletionRequest()
+	if err != nil {
+		return apiError(c, fiber.StatusBadRequest, err.Error())
+	}
+	completionReq.User = endUserID(c)
+
+	// The whole request, moderation included, must finish within API_TIMEOUT.
+	logger := requestLogger(c)
+	requestID, _ := c.Locals(requestIDKey).(string)
+	ctx := withRequestID(withLogger(context.Background(), logger), requestID)
+	if apiTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, apiTimeout)
+		defer cancel()
+	}
+	if err := moderate(ctx, lastUserMessage(completionReq.Messages)); err != nil {
+		countModerationError(err)
+		return apiError(c, httpStatusForError(err), err.Error())
+	}
+	content, err := complete(ctx, llm, completionReq)
+	if err != nil {
+		logger.Error("completion failed", "path", c.Path(), "model", completionReq.Model, "err", err)
+		return apiError(c, httpStatusForError(err), err.Error())
+	}
+	auditLog.Record(ctx, AuditEntry{
+		Source:           "api",
+		Model:            completionReq.Model,
+		Prompt:           lastUserMessage(completionReq.Messages),
+		Response:         content,
+		PromptTokens:     estimateMessageTokens(completionReq.Messages),
+		CompletionTokens: estimateTokens(content),
+		UsageEstimated:   true,
+	})
+	return c.JSON(ChatAPIResponse{
+		Model:   completionReq.Model,
+		Message: Message{Role: "assistant", Content: content},
+	})
+}
+
+// bodyLimit is the largest request body the server reads, which must fit
+// both API requests and uploads.
+func bodyLimit() int {
+	limit := maxUploadBytes + 64<<10
+	if apiMaxBodyBytes > limit {
+		limit = apiMaxBodyBytes
+	}
+	// Fiber's default applies when there is no API limit either.
+	if apiMaxBodyBytes <= 0 && limit < fiber.DefaultBodyLimit {
+		limit = fiber.DefaultBodyLimit
+	}
+	return limit
+}
+
+// parseChatAPIRequest decodes the JSON body of an API request into req. Bodies
+// over API_MAX_BODY_BYTES are refused with 413, and bodies that aren't JSON
+// with 400 and a message that says what is wrong.
+func parseChatAPIRequest(c *fiber.Ctx, req *ChatAPIRequest) *fiber.Error {
+	if apiMaxBodyBytes > 0 && len(c.Body()) > apiMaxBodyBytes {
+		return fiber.NewError(fiber.StatusRequestEntityTooLarge,
+			fmt.Sprintf("request body is too large (%d bytes, the limit is %d)", len(c.Body()), apiMaxBodyBytes))
+	}
+	if !c.Is("json") {
+		return fiber.NewError(fiber.StatusBadRequest, "the body must be JSON, sent with Content-Type: application/json")
+	}
+	if err := json.Unmarshal(c.Body(), req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid JSON body"+describeJSONError(err))
+	}
+	return nil
+}
+
+// describeJSONError says what is wrong with JSON that couldn't be decoded,
+// as the rest of a message starting "invalid JSON ...": where a syntax error
+// is, or which field has the wrong type.
+func describeJSONError(err error) string {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		return fmt.Sprintf(" at byte %d: %v", syntaxErr.Offset, err)
+	case errors.As(err, &typeErr) && typeErr.Field != "":
+		return fmt.Sprintf(": %s must be a %s, not a %s", typeErr.Field, typeErr.Type, typeErr.Value)
+	}
+	return ": " + err.Error()
+}
+
+// toCompletionRequest validates an API request and fills in the default model.
+func (req ChatAPIRequest) toCompletionRequest() (CompletionRequest, error) {
+	if len(req.Messages) == 0 {
+		return CompletionRequest{}, fmt.Errorf("messages must not be empty")
+	}
+	if apiMaxMessages > 0 && len(req.Messages) > apiMaxMessages {
+		return CompletionRequest{}, fmt.Errorf("too many messages (%d, the limit is %d)", len(req.Messages), apiMaxMessages)
+	}
+	chars := 0
+	for i, m := range req.Messages {
+		if m.Role != "system" && m.Role != "user" && m.Role != "assistant" {
+			return CompletionRequest{}, fmt.Errorf("messages[%d]: unknown role %q", i, m.Role)
+		}
+		chars += utf8.RuneCountInString(m.Content)
+	}
+	if apiMaxChars > 0 && chars > apiMaxChars {
+		return CompletionRequest{}, fmt.Errorf("messages are too long (%d characters, the limit is %d)", chars, apiMaxChars)
+	}
+	if req.Model == "" {
+		req.Model = defaultModel
+	}
+	if !allowedModels[req.Model] {
+		return CompletionRequest{}, fmt.Errorf("model %q is not allowed", req.Model)
+	}
+	if hasImages(req.Messages) && !visionModels[req.Model] {
+		return CompletionRequest{}, fmt.Errorf("model %q does not accept images", req.Model)
+	}
+	if err := req.GenerationParams.Validate(); err != nil {
+		return CompletionRequest{}, err
+	}
+	// Parameters the model rejects are dropped; see modelParams.
+	req.GenerationParams, _ = applyModelParams(req.Model, req.GenerationParams)
+	if err := checkResponseFormat(req.Model, req.GenerationParams.ResponseFormat); err != nil {
+		return CompletionRequest{}, err
+	}
+	// The replies would be interleaved in one body, and there is nowhere to put logprobs.
+	if req.GenerationParams.Choices() > 1 {
+		return CompletionRequest{}, fmt.Errorf("n greater than 1 is only supported over the WebSocket")
+	}
+	if req.GenerationParams.Logprobs != nil || req.GenerationParams.TopLogprobs != nil {
+		return CompletionRequest{}, fmt.Errorf("logprobs are only supported over the WebSocket")
+	}
+	return CompletionRequest{
+		Model:    req.Model,
+		Messages: req.Messages,
+		Params:   req.GenerationParams,
+	}, nil
+}
+
+// httpStatusForError picks the HTTP status to return for a failed completion.
+// Rate limits and bad requests are passed through; anything else is the
+// upstream's fault, so it is reported as a bad gateway (or a gateway timeout).
+func httpStatusForError(err error) int {
+	if errors.Is(err, ErrNotConfigured) || errors.Is(err, ErrUpstreamBusy) || errors.Is(err, ErrUpstreamUnavailable) ||
+		errors.Is(err, ErrModerationUnavailable) {
+		return fiber.StatusServiceUnavailable
+	}
+	var moderationErr *ModerationError
+	if errors.As(err, &moderationErr) {
+		return fiber.StatusBadRequest
+	}
+	// The request never left the server.
+	if errors.Is(err, ErrMarshal) {
+		return fiber.StatusInternalServerError
+	}
+	var upstreamErr *UpstreamError
+	if errors.As(err, &upstreamErr) {
+		switch {
+		case upstreamErr.StatusCode == http.StatusTooManyRequests:
+			return fiber.StatusTooManyRequests
+		case upstreamErr.StatusCode == http.StatusBadRequest:
+			return fiber.StatusBadRequest
+		}
+		return fiber.StatusBadGateway
+	}
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return fiber.StatusGatewayTimeout
+	}
+	return fiber.StatusBadGateway
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// auditLog records every exchange when AUDIT_LOG is set; nil disables it.
+var auditLog *AuditLogger
+
+// AuditEntry is one line of the audit log: a prompt, the reply it got and
+// what it cost. Prompt is the last user message; the rest of the context is
+// in the conversation.
+type AuditEntry struct {
+	Time             time.Time `json:"time"`
+	RequestID        string    `json:"request_id,omitempty"`
+	ConversationID   string    `json:"conversation_id,omitempty"`
+	Source           string    `json:"source"`
+	Model            string    `json:"model"`
+	Prompt           string    `json:"prompt"`
+	Response         string    `json:"response"`
+	PromptTokens     int       `json:"prompt_tokens"`
+	CompletionTokens int       `json:"completion_tokens"`
+	UsageEstimated   bool      `json:"usage_estimated,omitempty"`
+}
+
+// AuditLogger appends AuditEntry records to a file as JSON lines. Each line
+// is written with a single write and synced to disk before Record returns.
+// With hashContent set, prompts and replies are replaced by their SHA-256
+// hashes, so the log proves what was said without keeping it.
+type AuditLogger struct {
+	mu          sync.Mutex
+	out         *os.File
+	hashContent bool
+}
+
+// OpenAuditLog opens the audit log at path, creating it if needed; "-" logs
+// to stdout. An empty path returns nil, which disables auditing.
+func OpenAuditLog(path string, hashContent bool) (*AuditLogger, error) {
+	switch path {
+	case "":
+		return nil, nil
+	case "-":
+		return &AuditLogger{out: os.Stdout, hashContent: hashContent}, nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("error opening audit log: %w", err)
+	}
+	return &AuditLogger{out: f, hashContent: hashContent}, nil
+}
+
+// Record appends e to the log, filling in the time and the request ID from
+// ctx. Failures are logged; the exchange itself has already happened.
+func (a *AuditLogger) Record(ctx context.Context, e AuditEntry) {
+	if a == nil {
+		return
+	}
+	e.Time = time.Now().UTC()
+	e.RequestID = requestIDFrom(ctx)
+	if a.hashContent {
+		e.Prompt = hashContent(e.Prompt)
+		e.Response = hashContent(e.Response)
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		loggerFrom(ctx).Error("error encoding audit entry", "err", err)
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.out.Write(append(line, '\n')); err != nil {
+		loggerFrom(ctx).Error("error writing audit log", "err", err)
+		return
+	}
+	if a.out != os.Stdout {
+		if err := a.out.Sync(); err != nil {
+			loggerFrom(ctx).Error("error syncing audit log", "err", err)
+		}
+	}
+}
+
+// Close closes the log file.
+func (a *AuditLogger) Close() error {
+	if a == nil || a.out == os.Stdout {
+		return nil
+	}
+	return a.out.Close()
+}
+
+// hashContent returns the SHA-256 of s, prefixed with the algorithm.
+func hashContent(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// lastUserMessage returns the text of the last user message in messages.
+func lastUserMessage(messages []Message) string {
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].Role == "user" {
+			return messages[i].Content
+		}
+	}
+	return ""
+}
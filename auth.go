@@ -0,0 +1,44 @@
+package main
+
+import (
+	"crypto/subtle"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// authTokens are the secrets accepted by requireAuth, from AUTH_TOKEN
+// (comma-separated, so several keys can be handed out and revoked separately).
+// When it is empty, authentication is disabled.
+var authTokens []string
+
+// requireAuth rejects requests without a valid token with 401.
+// The token is sent as "Authorization: Bearer <token>"; browsers can't set
+// headers on a WebSocket upgrade, so /ws also accepts a ?token= query parameter.
+func requireAuth(c *fiber.Ctx) error {
+	if len(authTokens) == 0 {
+		return c.Next()
+	}
+	token, ok := strings.CutPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ")
+	if !ok && strings.HasPrefix(c.Path(), "/ws") {
+		token = c.Query("token")
+	}
+	if token != "" && validToken(token) {
+		c.Locals(authTokenKey, token)
+		return c.Next()
+	}
+	c.Set(fiber.HeaderWWWAuthenticate, "Bearer")
+	return apiError(c, fiber.StatusUnauthorized, "missing or invalid token")
+}
+
+// validToken reports whether token is one of authTokens.
+// The comparison takes constant time so the tokens can't be guessed by timing.
+func validToken(token string) bool {
+	valid := false
+	for _, t := range authTokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+			valid = true
+		}
+	}
+	return valid
+}
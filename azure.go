@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// defaultAzureAPIVersion is the Azure OpenAI API version used when
+// AZURE_API_VERSION is not set.
+const defaultAzureAPIVersion = "2024-10-21"
+
+// AzureProvider streams completions from an Azure OpenAI deployment.
+// Azure serves the OpenAI API under per-deployment URLs and takes the key in
+// an api-key header; requests and streams are otherwise the same, so the
+// work is done by an OpenAIProvider pointed at the deployment.
+type AzureProvider struct {
+	APIKey string
+	// Endpoint is the resource's base URL, e.g. https://NAME.openai.azure.com.
+	Endpoint   string
+	Deployment string
+	APIVersion string
+	openai     *OpenAIProvider
+}
+
+// newAzureProvider returns an AzureProvider for the deployment.
+func newAzureProvider(apiKey, endpoint, deployment, apiVersion string) *AzureProvider {
+	endpoint = strings.TrimRight(endpoint, "/")
+	query := "?api-version=" + url.QueryEscape(apiVersion)
+	return &AzureProvider{
+		APIKey:     apiKey,
+		Endpoint:   endpoint,
+		Deployment: deployment,
+		APIVersion: apiVersion,
+		openai: &OpenAIProvider{
+			APIKey:     apiKey,
+			URL:        endpoint + "/openai/deployments/" + url.PathEscape(deployment) + "/chat/completions" + query,
+			ModelsURL:  endpoint + "/openai/models" + query,
+			AuthHeader: "api-key",
+			Client:     httpClient,
+		},
+	}
+}
+
+// azureStreamUsageVersion is the first Azure OpenAI API version that takes
+// stream_options; older ones reject the whole request.
+const azureStreamUsageVersion = "2024-09-01"
+
+// azureSupportsStreamUsage reports whether apiVersion (a date, possibly with
+// a "-preview" suffix) takes stream_options.
+func azureSupportsStreamUsage(apiVersion string) bool {
+	return len(apiVersion) >= len(azureStreamUsageVersion) && apiVersion[:len(azureStreamUsageVersion)] >= azureStreamUsageVersion
+}
+
+// CheckConfig implements ConfigChecker.
+func (p *AzureProvider) CheckConfig() error {
+	if p.APIKey == "" {
+		return fmt.Errorf("%w: AZURE_API_KEY is not set", ErrNotConfigured)
+	}
+	return nil
+}
+
+// StreamCompletion implements Provider.
+func (p *AzureProvider) StreamCompletion(ctx context.Context, req CompletionRequest) (<-chan StreamEvent, error) {
+	if err := p.CheckConfig(); err != nil {
+		return nil, err
+	}
+	return p.openai.StreamCompletion(ctx, req)
+}
+
+// Complete implements Completer.
+func (p *AzureProvider) Complete(ctx context.Context, req CompletionRequest) (string, error) {
+	if err := p.CheckConfig(); err != nil {
+		return "", err
+	}
+	return p.openai.Complete(ctx, req)
+}
+
+// Ping implements Pinger. The models endpoint checks the endpoint and key
+// without using the deployment's quota.
+func (p *AzureProvider) Ping(ctx context.Context) error {
+	return p.openai.Ping(ctx)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Defaults for the circuit breaker in front of the provider. They can be
+// overridden with BREAKER_FAILURES (0 disables the breaker) and BREAKER_COOLDOWN.
+const (
+	defaultBreakerFailures = 5
+	defaultBreakerCooldown = 30 * time.Second
+)
+
+// ErrUpstreamUnavailable is returned without calling the provider while the
+// circuit breaker is open.
+var ErrUpstreamUnavailable = errors.New("service temporarily unavailable, please try again shortly")
+
+// Circuit breaker states, also the values of the chat_upstream_breaker_state gauge.
+const (
+	breakerClosed   = 0
+	breakerHalfOpen = 1
+	breakerOpen     = 2
+)
+
+// breaker stops calling a provider that keeps failing. After failures
+// consecutive failed requests it opens and new requests fail at once with
+// ErrUpstreamUnavailable. Once cooldown has passed it half-opens: a single
+// request is let through to probe the provider, and its outcome either
+// closes the breaker again or keeps it open for another cooldown.
+type breaker struct {
+	failures int
+	cooldown time.Duration
+
+	mu       sync.Mutex
+	state    int
+	failed   int
+	openedAt time.Time
+	probing  bool
+}
+
+// upstreamBreaker guards every upstream request; see streamCompletion.
+var upstreamBreaker = newBreaker(defaultBreakerFailures, defaultBreakerCooldown)
+
+// newBreaker returns a closed breaker. With failures 0 it never opens.
+func newBreaker(failures int, cooldown time.Duration) *breaker {
+	metricBreakerState.Set(breakerClosed)
+	return &breaker{failures: failures, cooldown: cooldown}
+}
+
+// Allow reports whether a request may go upstream. The returned done func
+// must be called exactly once with the request's outcome.
+func (b *breaker) Allow() (done func(ctx context.Context, err error), err error) {
+	if b.failures <= 0 {
+		return func(context.Context, error) {}, nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	probe := false
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return nil, ErrUpstreamUnavailable
+		}
+		b.setState(breakerHalfOpen)
+		fallthrough
+	case breakerHalfOpen:
+		if b.probing {
+			return nil, ErrUpstreamUnavailable
+		}
+		b.probing = true
+		probe = true
+	}
+	return func(ctx context.Context, err error) { b.done(ctx, err, probe) }, nil
+}
+
+// done records the outcome of a request Allow let through. A request the
+// client cancelled says nothing about the provider and isn't counted; 4xx
+// answers show the provider is up and count as successes (see isUpstreamFailure).
+func (b *breaker) done(ctx context.Context, err error, probe bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if probe {
+		b.probing = false
+	}
+	if err != nil && ctx.Err() != nil {
+		return
+	}
+	if !isUpstreamFailure(err) {
+		b.failed = 0
+		if b.state != breakerClosed {
+			slog.Info("upstream recovered, circuit breaker closed")
+			b.setState(breakerClosed)
+		}
+		return
+	}
+	b.failed++
+	if probe || (b.state == breakerClosed && b.failed >= b.failures) {
+		slog.Warn("upstream keeps failing, circuit breaker opened", "failures", b.failed, "cooldown", b.cooldown, "err", err)
+		b.openedAt = time.Now()
+		b.setState(breakerOpen)
+	}
+}
+
+// setState changes the state and updates the gauge. b.mu must be held.
+func (b *breaker) setState(state int) {
+	b.state = state
+	metricBreakerState.Set(float64(state))
+}
+
+// isUpstreamFailure reports whether err means the provider is unhealthy:
+// network errors, timeouts and 5xx answers, but not 4xx answers or missing
+// configuration.
+func isUpstreamFailure(err error) bool {
+	if err == nil || errors.Is(err, ErrNotConfigured) {
+		return false
+	}
+	var upstreamErr *UpstreamError
+	if errors.As(err, &upstreamErr) {
+		return upstreamErr.StatusCode >= 500
+	}
+	return true
+}
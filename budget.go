@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// ModelPrice is what a model costs in US dollars per million prompt and
+// completion tokens.
+type ModelPrice struct {
+	Prompt     float64
+	Completion float64
+}
+
+// modelPrices is the price per model, used to work out what a conversation
+// has cost. MODEL_PRICES overrides or extends it, e.g. "gpt-4o=2.5/10".
+// Models without a price cost nothing as far as the budget is concerned.
+var modelPrices = map[string]ModelPrice{
+	"gpt-4o-mini":              {Prompt: 0.15, Completion: 0.60},
+	"gpt-4o":                   {Prompt: 2.50, Completion: 10},
+	"gpt-4-turbo":              {Prompt: 10, Completion: 30},
+	"gpt-3.5-turbo":            {Prompt: 0.50, Completion: 1.50},
+	"o1":                       {Prompt: 15, Completion: 60},
+	"o1-mini":                  {Prompt: 1.10, Completion: 4.40},
+	"o3-mini":                  {Prompt: 1.10, Completion: 4.40},
+	"claude-3-5-haiku-latest":  {Prompt: 0.80, Completion: 4},
+	"claude-3-5-sonnet-latest": {Prompt: 3, Completion: 15},
+	"claude-3-opus-latest":     {Prompt: 15, Completion: 75},
+}
+
+// Budgets per conversation: once it has used tokenBudget tokens
+// (CONVERSATION_TOKEN_BUDGET) or costBudget dollars (CONVERSATION_COST_BUDGET),
+// it gets no more replies. 0 disables a budget. A new conversation starts
+// from nothing. Replies, titles and summaries count; moderation is free.
+var (
+	tokenBudget int
+	costBudget  float64
+)
+
+// usageCost returns what usage cost with model.
+func usageCost(model string, usage Usage) float64 {
+	price := modelPrices[model]
+	return (float64(usage.PromptTokens)*price.Prompt + float64(usage.CompletionTokens)*price.Completion) / 1e6
+}
+
+// chargeConversation adds usage, and what it cost with model, to what conv
+// has spent, saves that in the store and returns conv's new total usage. It
+// is saved even if ctx was cancelled, e.g. by a stopped reply, since the
+// tokens were used all the same.
+func chargeConversation(ctx context.Context, conv *Conversation, model string, usage Usage) Usage {
+	cost := usageCost(model, usage)
+	total := conv.AddUsage(usage, cost)
+	if recorder, ok := store.(UsageRecorder); ok {
+		if err := recorder.AddUsage(context.WithoutCancel(ctx), conv.ID(), usage, cost); err != nil {
+			loggerFrom(ctx).Error("error saving usage", "conversation_id", conv.ID(), "err", err)
+		}
+	}
+	return total
+}
+
+// completionUsage estimates the usage of a completion that doesn't report it,
+// such as a title or summary from complete.
+func completionUsage(req CompletionRequest, reply string) Usage {
+	return Usage{PromptTokens: estimateMessageTokens(req.Messages), CompletionTokens: estimateTokens(reply)}
+}
+
+// BudgetFrame tells the client how much of its conversation's budget is left.
+// It follows the usage frame of every reply while a budget is set. The
+// remaining fields are only set for the budgets that are.
+type BudgetFrame struct {
+	Type           string   `json:"type"`
+	Tokens         int      `json:"tokens"`
+	Cost           float64  `json:"cost"`
+	TokensLeft     *int     `json:"tokensLeft,omitempty"`
+	CostLeft       *float64 `json:"costLeft,omitempty"`
+	ConversationID string   `json:"conversationId,omitempty"`
+}
+
+// budgetFrame returns the budget frame for conv, and false if no budget is set.
+func budgetFrame(conv *Conversation) (BudgetFrame, bool) {
+	if tokenBudget <= 0 && costBudget <= 0 {
+		return BudgetFrame{}, false
+	}
+	usage, cost := conv.Spent()
+	frame := BudgetFrame{
+		Type:           "budget",
+		Tokens:         usage.PromptTokens + usage.CompletionTokens,
+		Cost:           cost,
+		ConversationID: conv.ID(),
+	}
+	if tokenBudget > 0 {
+		left := tokenBudget - frame.Tokens
+		if left < 0 {
+			left = 0
+		}
+		frame.TokensLeft = &left
+	}
+	if costBudget > 0 {
+		left := costBudget - cost
+		if left < 0 {
+			left = 0
+		}
+		frame.CostLeft = &left
+	}
+	return frame, true
+}
+
+// checkBudget returns an error if conv has used up its budget.
+func checkBudget(conv *Conversation) error {
+	usage, cost := conv.Spent()
+	if tokens := usage.PromptTokens + usage.CompletionTokens; tokenBudget > 0 && tokens >= tokenBudget {
+		return fmt.Errorf("this conversation has used its budget of %d tokens, please start a new one", tokenBudget)
+	}
+	if costBudget > 0 && cost >= costBudget {
+		return fmt.Errorf("this conversation has used its budget of $%.2f, please start a new one", costBudget)
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Token buffering is off by default; STREAM_CHUNK_BYTES turns it on and
+// STREAM_FLUSH_INTERVAL bounds how long text may be held back.
+const (
+	defaultStreamChunkBytes    = 0
+	defaultStreamFlushInterval = 250 * time.Millisecond
+)
+
+// streamChunkBytes and streamFlushInterval configure chunkBuffer.
+var (
+	streamChunkBytes    = defaultStreamChunkBytes
+	streamFlushInterval = defaultStreamFlushInterval
+)
+
+// chunkBuffer groups streamed tokens into larger chunks that end at a word or
+// line boundary, so a frontend rendering Markdown as it arrives never sees
+// half a word or half a code fence. Larger chunks mean smoother rendering but
+// more latency. With minBytes 0 every token passes straight through.
+type chunkBuffer struct {
+	minBytes int
+	maxDelay time.Duration
+
+	buf   strings.Builder
+	since time.Time
+}
+
+// newChunkBuffer returns a chunkBuffer using the configured settings.
+func newChunkBuffer() *chunkBuffer {
+	return &chunkBuffer{minBytes: streamChunkBytes, maxDelay: streamFlushInterval}
+}
+
+// Add buffers content and returns the text that is ready to be sent, if any.
+// Text is released once at least minBytes are buffered or the oldest buffered
+// text has waited maxDelay (checked as tokens arrive), up to the last boundary.
+func (b *chunkBuffer) Add(content string) string {
+	if b.minBytes <= 0 {
+		return content
+	}
+	if b.buf.Len() == 0 {
+		b.since = time.Now()
+	}
+	b.buf.WriteString(content)
+	if b.buf.Len() < b.minBytes && time.Since(b.since) < b.maxDelay {
+		return ""
+	}
+
+	text := b.buf.String()
+	cut := strings.LastIndexFunc(text, unicode.IsSpace)
+	if cut >= 0 {
+		// Keep the boundary character with the flushed text; the rest waits for more tokens.
+		_, size := utf8.DecodeRuneInString(text[cut:])
+		cut += size
+	} else if len(text) >= 4*b.minBytes {
+		// A single very long "word" (a URL, say) is sent anyway rather than held forever.
+		cut = len(text)
+	} else {
+		return ""
+	}
+	ready, rest := text[:cut], text[cut:]
+	b.buf.Reset()
+	b.buf.WriteString(rest)
+	b.since = time.Now()
+	return ready
+}
+
+// Flush returns everything still buffered. It must be called when the stream ends.
+func (b *chunkBuffer) Flush() string {
+	text := b.buf.String()
+	b.buf.Reset()
+	return text
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+	"time"
+
+	"github.com/gofiber/websocket/v2"
+)
+
+// closeWriteTimeout bounds how long sending a close frame may take; a client
+// that doesn't read it in time is dropped anyway.
+const closeWriteTimeout = time.Second
+
+// closeUnsupportedProtocol is the application close code for clients that
+// didn't ask for a protocol version the server speaks.
+const closeUnsupportedProtocol = 4001
+
+// closeConnection sends a close frame with the given code and reason before the
+// connection is dropped, so the client can tell why it was disconnected:
+//
+//   - 1000 (normal closure): the connection was idle for IDLE_TIMEOUT
+//   - 1001 (going away): the server is shutting down
+//   - 1008 (policy violation): the client's address has too many connections open,
+//     or the client reads frames too slowly (see SEND_QUEUE_SIZE)
+//   - 1011 (internal error): the server couldn't set up the connection's conversation
+//   - 1013 (try again later): MAX_CONNECTIONS connections are open
+//   - 4001 (unsupported protocol): the client asked for no subprotocol the server speaks
+//
+// Reasons are short, human-readable English. The read loop fails once the
+// connection is closed, which deregisters the client as usual.
+func closeConnection(conn *websocket.Conn, code int, reason string) {
+	conn.WriteControl(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(code, reason),
+		time.Now().Add(closeWriteTimeout),
+	)
+	conn.Close()
+}
+
+// logReadError logs why a connection's read loop ended. Clients that close
+// normally (1000), navigate away (1001) or close without a code (1005) are
+// not logged, nor are connections the server closed itself. Clients that
+// stopped answering pings are logged at info level; any other close code,
+// a dropped connection or a protocol error is a warning.
+func logReadError(logger *slog.Logger, err error) {
+	switch {
+	case websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseNoStatusReceived):
+	case errors.Is(err, net.ErrClosed):
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		logger.Info("connection timed out: no pong received", "err", err)
+	case websocket.IsUnexpectedCloseError(err):
+		logger.Warn("connection closed unexpectedly", "err", err)
+	default:
+		logger.Warn("error reading from connection", "err", err)
+	}
+}
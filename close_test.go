@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	fastws "github.com/fasthttp/websocket"
+)
+
+// failingStore can't create conversations.
+type failingStore struct{ ConversationStore }
+
+func (failingStore) CreateConversation(ctx context.Context) (string, error) {
+	return "", errors.New("disk full")
+}
+
+func TestCloseCodes(t *testing.T) {
+	tests := []struct {
+		name string
+		// setup changes the server's settings and may open other connections first.
+		setup func(t *testing.T, url string)
+		// noProtocol connects without asking for a subprotocol.
+		noProtocol bool
+		wantCode   int
+		wantReason string
+		wantError  string
+	}{
+		{
+			name:       "unsupported protocol",
+			noProtocol: true,
+			wantCode:   closeUnsupportedProtocol,
+			wantReason: "unsupported protocol version, use " + subprotocols[0],
+		},
+		{
+			name: "too many connections from one address",
+			setup: func(t *testing.T, url string) {
+				limiter = NewRateLimiter(1, defaultMsgsPerMinute)
+				connect(t, url)
+			},
+			wantCode:   fastws.ClosePolicyViolation,
+			wantReason: "too many connections",
+			wantError:  "too many connections from your address, please close some tabs and try again",
+		},
+		{
+			name: "conversation can't be opened",
+			setup: func(t *testing.T, url string) {
+				store = failingStore{store}
+			},
+			wantCode:   fastws.CloseInternalServerErr,
+			wantReason: "could not open conversation",
+			wantError:  "could not open conversation: disk full",
+		},
+		{
+			name: "server full",
+			setup: func(t *testing.T, url string) {
+				// With a wait set, the upgrade goes through and the
+				// connection is closed once no slot came free in time.
+				registry = NewClientRegistry(1)
+				setForTest(t, &connectionWait, 50*time.Millisecond)
+				connect(t, url)
+			},
+			wantCode:   fastws.CloseTryAgainLater,
+			wantReason: "server full",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			url := startTestServer(t, &MockProvider{Text: "hi"})
+			protocols := []string{subprotocols[0]}
+			if tt.noProtocol {
+				protocols = nil
+			}
+			if tt.setup != nil {
+				tt.setup(t, url)
+			}
+			frames, code, reason := readClose(t, dialTestServer(t, url, protocols...))
+			if code != tt.wantCode || reason != tt.wantReason {
+				t.Errorf("closed with %d %q, want %d %q", code, reason, tt.wantCode, tt.wantReason)
+			}
+			var errorText string
+			for _, frame := range frames {
+				if frame.Type == "error" {
+					errorText = frame.Text
+				}
+			}
+			if errorText != tt.wantError {
+				t.Errorf("error frame %q, want %q (frames %+v)", errorText, tt.wantError, frames)
+			}
+		})
+	}
+}
+
+func TestServerFullWithoutWait(t *testing.T) {
+	url := startTestServer(t, &MockProvider{Text: "hi"})
+	registry = NewClientRegistry(1)
+	setForTest(t, &connectionWait, 0)
+	connect(t, url)
+	dialer := fastws.Dialer{Subprotocols: subprotocols, HandshakeTimeout: 2 * time.Second}
+	conn, resp, err := dialer.Dial(url, nil)
+	if err == nil {
+		conn.Close()
+		t.Fatal("upgrade succeeded on a full server")
+	}
+	if resp == nil || resp.StatusCode != 503 {
+		t.Errorf("response = %v, want 503", resp)
+	}
+}
+
+func TestLogReadError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"normal closure", &fastws.CloseError{Code: fastws.CloseNormalClosure}, ""},
+		{"going away", &fastws.CloseError{Code: fastws.CloseGoingAway}, ""},
+		{"no status", &fastws.CloseError{Code: fastws.CloseNoStatusReceived}, ""},
+		{"closed by the server", fmt.Errorf("read: %w", net.ErrClosed), ""},
+		{"pong timeout", fmt.Errorf("read: %w", os.ErrDeadlineExceeded), "level=INFO msg=\"connection timed out: no pong received\""},
+		{"abnormal closure", &fastws.CloseError{Code: fastws.CloseAbnormalClosure}, "level=WARN msg=\"connection closed unexpectedly\""},
+		{"policy violation from the client", &fastws.CloseError{Code: fastws.ClosePolicyViolation}, "level=WARN msg=\"connection closed unexpectedly\""},
+		{"protocol error", errors.New("bad frame"), "level=WARN msg=\"error reading from connection\""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			logReadError(slog.New(slog.NewTextHandler(&out, nil)), tt.err)
+			if tt.want == "" && out.Len() > 0 {
+				t.Errorf("logged %q, want nothing", out.String())
+			}
+			if tt.want != "" && !strings.Contains(out.String(), tt.want) {
+				t.Errorf("logged %q, want %s", out.String(), tt.want)
+			}
+		})
+	}
+}
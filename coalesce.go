@@ -0,0 +1,86 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// Streamed text is coalesced into frames by default: tokens arriving within
+// STREAM_COALESCE_INTERVAL of each other share a frame, up to
+// STREAM_COALESCE_BYTES of text.
+const (
+	defaultStreamCoalesceInterval = 50 * time.Millisecond
+	defaultStreamCoalesceBytes    = 4096
+)
+
+// streamCoalesceInterval and streamCoalesceBytes configure coalescingWriter.
+var (
+	streamCoalesceInterval = defaultStreamCoalesceInterval
+	streamCoalesceBytes    = defaultStreamCoalesceBytes
+)
+
+// coalescingWriter collects streamed text and hands it to send in larger
+// pieces, so a long reply costs a few frames a second instead of one frame
+// (and one JSON encoding and write) per token. Text is sent once it has waited
+// the interval or the buffer reaches maxBytes, whichever comes first, and
+// Flush sends whatever is left. With interval 0 every write is sent at once.
+//
+// The timer sends from its own goroutine; send is called with the writer's
+// lock held, so pieces always go out in order.
+type coalescingWriter struct {
+	interval time.Duration
+	maxBytes int
+	send     func(string)
+
+	mu    sync.Mutex
+	buf   strings.Builder
+	timer *time.Timer
+}
+
+// newCoalescingWriter returns a coalescingWriter using the configured settings.
+func newCoalescingWriter(send func(string)) *coalescingWriter {
+	return &coalescingWriter{interval: streamCoalesceInterval, maxBytes: streamCoalesceBytes, send: send}
+}
+
+// Write buffers text, sending the buffer if it is full.
+func (w *coalescingWriter) Write(text string) {
+	if text == "" {
+		return
+	}
+	if w.interval <= 0 {
+		w.send(text)
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf.WriteString(text)
+	if w.maxBytes > 0 && w.buf.Len() >= w.maxBytes {
+		w.flushLocked()
+		return
+	}
+	if w.timer == nil {
+		w.timer = time.AfterFunc(w.interval, w.Flush)
+	}
+}
+
+// Flush sends everything still buffered. It must be called before any frame
+// that has to follow the text, such as the end of the reply.
+func (w *coalescingWriter) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.flushLocked()
+}
+
+func (w *coalescingWriter) flushLocked() {
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+	if w.buf.Len() == 0 {
+		return
+	}
+	text := w.buf.String()
+	w.buf.Reset()
+	w.send(text)
+}
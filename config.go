@@ -0,0 +1,614 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds every setting the server reads from the environment.
+// It is loaded once at startup by LoadConfig; see the README for what each
+// environment variable does.
+type Config struct {
+	Port string
+
+	// Provider is "openai", "azure", "anthropic" or "ollama". Azure OpenAI
+	// serves one model per deployment of the resource at AzureEndpoint.
+	Provider  string
+	OpenAIKey string
+	// OpenAIKeys, if set, replaces OpenAIKey with a pool of keys used in turn.
+	OpenAIKeys []string
+	// OpenAIBaseURL points the openai provider at any OpenAI-compatible API.
+	// The key is sent in OpenAIAuthHeader, prefixed with OpenAIAuthScheme unless
+	// that is empty (OPENAI_AUTH_SCHEME=none).
+	OpenAIBaseURL    string
+	OpenAIAuthHeader string
+	OpenAIAuthScheme string
+	AnthropicKey     string
+	AnthropicModel   string
+	AzureKey         string
+	AzureEndpoint    string
+	AzureDeployment  string
+	AzureAPIVersion  string
+	OllamaHost       string
+	OllamaModel      string
+	// DefaultModel is the OpenAI model used when the client doesn't pick one.
+	DefaultModel string
+	// FallbackModel is tried once when the model is rate limited or unavailable; empty disables it.
+	FallbackModel string
+	OpenAITimeout time.Duration
+	MaxRetries    int
+	// MockLLM replaces the provider with canned MockResponse replies, streamed
+	// a word every MockDelay, for frontend development without an API key.
+	MockLLM      bool
+	MockResponse string
+	MockDelay    time.Duration
+
+	// OpenAIStreamUsage (auto, true or false) says whether streams ask for a
+	// final chunk with token usage. Some compatible backends and older Azure
+	// API versions reject the option, so auto only asks api.openai.com and
+	// Azure from API version 2024-09-01.
+	OpenAIStreamUsage string
+
+	// LLMProxy, LLMCACerts and LLMInsecureSkipVerify configure the transport of
+	// upstream requests; see newHTTPTransport.
+	LLMProxy              string
+	LLMCACerts            string
+	LLMInsecureSkipVerify bool
+
+	// Moderation checks user input with OpenAI's moderation endpoint, using
+	// OpenAIKey (or OpenAIKeys) and OpenAIBaseURL. If the check fails, messages are let through
+	// unless ModerationFailClosed is set.
+	Moderation           bool
+	ModerationModel      string
+	ModerationFailClosed bool
+
+	// Store is "sqlite" or "memory".
+	Store      string
+	SQLitePath string
+
+	ShutdownTimeout time.Duration
+	MaxConnsPerIP   int
+	MsgsPerMinute   int
+	MaxMessageBytes int
+	MaxImageBytes   int
+	MaxUploadBytes  int
+	// APIMaxBodyBytes, APIMaxMessages and APIMaxChars limit the requests of the
+	// chat APIs and APITimeout the time to answer one; 0 disables them.
+	APIMaxBodyBytes int
+	APIMaxMessages  int
+	APIMaxChars     int
+	APITimeout      time.Duration
+	// GenerationTimeout and MaxResponseTokens bound a single response; 0 disables them.
+	GenerationTimeout time.Duration
+	MaxResponseTokens int
+	MessageQueueSize  int
+	SendQueueSize     int
+	SendQueueOverflow string
+	LatestMessageWins bool
+	WSCompression     bool
+	FrameFormat       string
+	PingInterval      time.Duration
+	PongTimeout       time.Duration
+	// IdleTimeout closes connections that send no message for this long; 0 disables it.
+	IdleTimeout time.Duration
+
+	// MaxConnections caps WebSocket connections across all clients; 0 disables
+	// it. Connections beyond it wait up to MaxConnectionsWait for a free slot.
+	MaxConnections     int
+	MaxConnectionsWait time.Duration
+
+	// MaxConcurrentUpstream bounds upstream requests in flight across all clients; 0 disables it.
+	MaxConcurrentUpstream int
+	UpstreamWaitTimeout   time.Duration
+
+	// BreakerFailures consecutive failed upstream requests open the circuit
+	// breaker for BreakerCooldown; 0 disables it.
+	BreakerFailures int
+	BreakerCooldown time.Duration
+
+	// WSRequireSubprotocol rejects WebSocket clients that don't name a protocol version.
+	WSRequireSubprotocol bool
+	// ResumeWindow is how long a response outlives its connection; 0 disables resuming.
+	ResumeWindow time.Duration
+
+	LogLevel  slog.Level
+	LogFormat string
+	DebugLLM  bool
+
+	// AuditLog is the file every exchange is appended to ("-" for stdout);
+	// empty disables it. AuditHashContent stores hashes instead of the text.
+	AuditLog         string
+	AuditHashContent bool
+
+	// TokenBudget and CostBudget cap what one conversation may use, at
+	// ModelPrices (dollars per million tokens); 0 disables them.
+	TokenBudget int
+	CostBudget  float64
+	ModelPrices map[string]ModelPrice
+
+	// PrefillSticky keeps a prefill for every reply instead of only the next.
+	PrefillSticky bool
+
+	// OutputFilters name the filters replies go through, in order;
+	// ProfanityWords replaces the words the "profanity" filter redacts.
+	OutputFilters  []string
+	ProfanityWords []string
+
+	// WSAllowedOrigins replaces CORSOrigins for WebSocket upgrades and may
+	// hold wildcard subdomains.
+	WSAllowedOrigins []string
+
+	// MemoryMaxBytes caps a connection's memory; MemoryInPrompt adds it to
+	// every request.
+	MemoryMaxBytes int
+	MemoryInPrompt bool
+
+	// EndUserID says what the end-user ID sent to OpenAI is derived from:
+	// "auth", "ip" or "none". EndUserSalt is hashed along with it.
+	EndUserID   string
+	EndUserSalt string
+
+	// DebugAdmin serves GET /debug/connections; it requires AuthTokens.
+	DebugAdmin bool
+
+	DefaultSystemPrompt  string
+	WelcomeMessage       string
+	RecordWelcomeMessage bool
+	DefaultContextBudget int
+	ContextBudgets       map[string]int
+	ContextStrategy      string
+	SummarizeThreshold   int
+	SummarizeTurns       int
+	EnableTools          bool
+	GenerateTitles       bool
+	RenderMarkdown       bool
+	StreamChunkBytes     int
+	StreamFlushInterval  time.Duration
+
+	StreamCoalesceInterval time.Duration
+	StreamCoalesceBytes    int
+
+	IdempotencyCacheSize int
+	IdempotencyTTL       time.Duration
+
+	CORSOrigins []string
+	CORSMethods string
+	CORSHeaders string
+	AuthTokens  []string
+
+	// SecurityHeaders adds CSP and other hardening headers to the frontend.
+	// CSP replaces the default policy; CSPConnectSrc adds origins to its connect-src.
+	SecurityHeaders bool
+	CSP             string
+	CSPConnectSrc   []string
+
+	ReadyzCheckUpstream bool
+	// StaticDir holds the frontend. Missing files under StaticAssetsPrefix are
+	// 404s; any other unknown path gets index.html.
+	StaticDir          string
+	StaticAssetsPrefix string
+	// TemplatesDir holds the prompt templates, one NAME.tmpl file each.
+	TemplatesDir string
+	// ModelParamsFile holds parameter defaults and limits per model, as JSON.
+	ModelParamsFile string
+	// RoomMode puts every connection into one shared conversation.
+	RoomMode bool
+}
+
+// ConfigError lists every problem LoadConfig found, so they can all be fixed at once.
+type ConfigError struct {
+	Problems []string
+}
+
+func (e *ConfigError) Error() string {
+	return strings.Join(e.Problems, "; ")
+}
+
+// LoadConfig reads the configuration from the environment, applies defaults
+// and validates it. Unset variables get their defaults; invalid or missing
+// required ones are reported together in a *ConfigError.
+func LoadConfig() (Config, error) {
+	return loadConfig(&envReader{lookup: os.Getenv})
+}
+
+// loadConfig is LoadConfig reading the variables through env.
+func loadConfig(env *envReader) (Config, error) {
+	cfg := Config{
+		Port: env.String("PORT", "8080"),
+
+		Provider:         strings.ToLower(env.String("LLM_PROVIDER", "openai")),
+		OpenAIKey:        env.String("OPENAI_API_KEY", ""),
+		OpenAIKeys:       env.List("OPENAI_API_KEYS"),
+		OpenAIBaseURL:    strings.TrimRight(env.String("OPENAI_BASE_URL", defaultOpenAIBaseURL), "/"),
+		OpenAIAuthHeader: env.String("OPENAI_AUTH_HEADER", "Authorization"),
+		OpenAIAuthScheme: env.String("OPENAI_AUTH_SCHEME", "Bearer"),
+		AnthropicKey:     env.String("ANTHROPIC_API_KEY", ""),
+		AnthropicModel:   env.String("ANTHROPIC_MODEL", defaultAnthropicModel),
+		AzureKey:         env.String("AZURE_API_KEY", ""),
+		AzureEndpoint:    env.String("AZURE_ENDPOINT", ""),
+		AzureDeployment:  env.String("AZURE_DEPLOYMENT", ""),
+		AzureAPIVersion:  env.String("AZURE_API_VERSION", defaultAzureAPIVersion),
+		OllamaHost:       strings.TrimRight(env.String("OLLAMA_HOST", defaultOllamaHost), "/"),
+		OllamaModel:      env.String("OLLAMA_MODEL", defaultOllamaModel),
+		DefaultModel:     env.String("DEFAULT_MODEL", defaultModel),
+		FallbackModel:    env.String("FALLBACK_MODEL", ""),
+		OpenAITimeout:    env.Duration("OPENAI_TIMEOUT", defaultOpenAITimeout),
+		MaxRetries:       env.Int("OPENAI_MAX_RETRIES", defaultMaxRetries),
+		MockLLM:          env.Bool("MOCK_LLM", false),
+		MockResponse:     env.String("MOCK_RESPONSE", defaultMockResponse),
+		MockDelay:        env.Duration("MOCK_DELAY", defaultMockDelay),
+
+		OpenAIStreamUsage: strings.ToLower(env.String("OPENAI_STREAM_USAGE", "auto")),
+
+		LLMProxy:              env.String("LLM_PROXY", ""),
+		LLMCACerts:            env.String("LLM_CA_CERTS", ""),
+		LLMInsecureSkipVerify: env.Bool("LLM_INSECURE_SKIP_VERIFY", false),
+
+		Moderation:           env.Bool("MODERATION", false),
+		ModerationModel:      env.String("MODERATION_MODEL", defaultModerationModel),
+		ModerationFailClosed: env.Bool("MODERATION_FAIL_CLOSED", false),
+
+		Store:      strings.ToLower(env.String("STORE", "sqlite")),
+		SQLitePath: env.String("SQLITE_PATH", defaultSQLitePath),
+
+		APIMaxBodyBytes: env.Int("API_MAX_BODY_BYTES", defaultAPIMaxBodyBytes),
+		APIMaxMessages:  env.Int("API_MAX_MESSAGES", defaultAPIMaxMessages),
+		APIMaxChars:     env.Int("API_MAX_CHARS", defaultAPIMaxChars),
+		APITimeout:      env.Duration("API_TIMEOUT", defaultAPITimeout),
+
+		ShutdownTimeout:   env.Duration("SHUTDOWN_TIMEOUT", defaultShutdownTimeout),
+		MaxConnsPerIP:     env.Int("MAX_CONNS_PER_IP", defaultMaxConnsPerIP),
+		MsgsPerMinute:     env.Int("MSGS_PER_MINUTE", defaultMsgsPerMinute),
+		MaxMessageBytes:   env.Int("MAX_MESSAGE_BYTES", defaultMaxMessageBytes),
+		MaxImageBytes:     env.Int("MAX_IMAGE_BYTES", defaultMaxImageBytes),
+		MaxUploadBytes:    env.Int("MAX_UPLOAD_BYTES", defaultMaxUploadBytes),
+		GenerationTimeout: env.Duration("GENERATION_TIMEOUT", defaultGenerationTimeout),
+		MaxResponseTokens: env.Int("MAX_RESPONSE_TOKENS", 0),
+		MessageQueueSize:  env.Int("MESSAGE_QUEUE_SIZE", defaultMessageQueueSize),
+		SendQueueSize:     env.Int("SEND_QUEUE_SIZE", defaultSendQueueSize),
+		SendQueueOverflow: strings.ToLower(env.String("SEND_QUEUE_OVERFLOW", sendOverflowClose)),
+		LatestMessageWins: env.Bool("LATEST_MESSAGE_WINS", false),
+		WSCompression:     env.Bool("WS_COMPRESSION", false),
+		FrameFormat:       strings.ToLower(env.String("FRAME_FORMAT", frameFormatJSON)),
+		PingInterval:      env.Duration("PING_INTERVAL", defaultPingInterval),
+		PongTimeout:       env.Duration("PONG_TIMEOUT", defaultPongTimeout),
+		IdleTimeout:       env.Duration("IDLE_TIMEOUT", 0),
+
+		MaxConnections:     env.Int("MAX_CONNECTIONS", 0),
+		MaxConnectionsWait: env.Duration("MAX_CONNECTIONS_WAIT", 0),
+
+		MaxConcurrentUpstream: env.Int("MAX_CONCURRENT_UPSTREAM", 0),
+		UpstreamWaitTimeout:   env.Duration("UPSTREAM_WAIT_TIMEOUT", defaultUpstreamWaitTimeout),
+
+		BreakerFailures: env.Int("BREAKER_FAILURES", defaultBreakerFailures),
+		BreakerCooldown: env.Duration("BREAKER_COOLDOWN", defaultBreakerCooldown),
+
+		WSRequireSubprotocol: env.Bool("WS_REQUIRE_SUBPROTOCOL", true),
+		ResumeWindow:         env.Duration("RESUME_WINDOW", defaultResumeWindow),
+
+		LogFormat: strings.ToLower(env.String("LOG_FORMAT", "text")),
+		DebugLLM:  env.Bool("DEBUG_LLM", false),
+
+		AuditLog:         env.String("AUDIT_LOG", ""),
+		AuditHashContent: env.Bool("AUDIT_HASH_CONTENT", false),
+
+		TokenBudget: env.Int("CONVERSATION_TOKEN_BUDGET", 0),
+		CostBudget:  env.Float("CONVERSATION_COST_BUDGET", 0),
+		ModelPrices: env.Prices("MODEL_PRICES"),
+
+		PrefillSticky: env.Bool("PREFILL_STICKY", false),
+
+		OutputFilters:  env.List("OUTPUT_FILTERS"),
+		ProfanityWords: env.List("PROFANITY_WORDS"),
+
+		WSAllowedOrigins: env.List("WS_ALLOWED_ORIGINS"),
+
+		MemoryMaxBytes: env.Int("MEMORY_MAX_BYTES", defaultMemoryMaxBytes),
+		MemoryInPrompt: env.Bool("MEMORY_IN_PROMPT", true),
+
+		EndUserID:   strings.ToLower(env.String("OPENAI_USER_ID", endUserNone)),
+		EndUserSalt: env.String("OPENAI_USER_ID_SALT", ""),
+
+		DebugAdmin: env.Bool("DEBUG_ADMIN", false),
+
+		DefaultSystemPrompt:  env.String("DEFAULT_SYSTEM_PROMPT", ""),
+		WelcomeMessage:       env.String("WELCOME_MESSAGE", ""),
+		RecordWelcomeMessage: env.Bool("WELCOME_MESSAGE_RECORD", false),
+		DefaultContextBudget: env.Int("DEFAULT_CONTEXT_BUDGET", defaultContextBudget),
+		ContextBudgets:       env.Budgets("CONTEXT_BUDGETS"),
+		ContextStrategy:      strings.ToLower(env.String("CONTEXT_STRATEGY", contextStrategyDrop)),
+		SummarizeThreshold:   env.Int("SUMMARIZE_THRESHOLD", defaultSummarizeThreshold),
+		SummarizeTurns:       env.Int("SUMMARIZE_TURNS", defaultSummarizeTurns),
+		EnableTools:          env.Bool("ENABLE_TOOLS", true),
+		GenerateTitles:       env.Bool("GENERATE_TITLES", true),
+		RenderMarkdown:       env.Bool("RENDER_MARKDOWN", false),
+		StreamChunkBytes:     env.Int("STREAM_CHUNK_BYTES", defaultStreamChunkBytes),
+		StreamFlushInterval:  env.Duration("STREAM_FLUSH_INTERVAL", defaultStreamFlushInterval),
+
+		StreamCoalesceInterval: env.Duration("STREAM_COALESCE_INTERVAL", defaultStreamCoalesceInterval),
+		StreamCoalesceBytes:    env.Int("STREAM_COALESCE_BYTES", defaultStreamCoalesceBytes),
+
+		IdempotencyCacheSize: env.Int("IDEMPOTENCY_CACHE_SIZE", defaultIdempotencyCacheSize),
+		IdempotencyTTL:       env.Duration("IDEMPOTENCY_TTL", defaultIdempotencyTTL),
+
+		CORSOrigins: env.List("CORS_ORIGINS"),
+		CORSMethods: env.String("CORS_METHODS", defaultCORSMethods),
+		CORSHeaders: env.String("CORS_HEADERS", defaultCORSHeaders),
+		AuthTokens:  env.List("AUTH_TOKEN"),
+
+		SecurityHeaders: env.Bool("SECURITY_HEADERS", true),
+		CSP:             env.String("CSP", ""),
+		CSPConnectSrc:   env.List("CSP_CONNECT_SRC"),
+
+		ReadyzCheckUpstream: env.Bool("READYZ_CHECK_UPSTREAM", false),
+		StaticDir:           env.String("STATIC_DIR", defaultStaticDir),
+		StaticAssetsPrefix:  "/" + strings.Trim(env.String("STATIC_ASSETS_PREFIX", defaultStaticAssetsPrefix), "/"),
+		TemplatesDir:        env.String("PROMPT_TEMPLATES_DIR", defaultTemplatesDir),
+		ModelParamsFile:     env.String("MODEL_PARAMS_FILE", ""),
+		RoomMode:            env.Bool("ROOM_MODE", false),
+	}
+	if err := cfg.LogLevel.UnmarshalText([]byte(env.String("LOG_LEVEL", "info"))); err != nil {
+		env.Fail("LOG_LEVEL must be debug, info, warn or error")
+	}
+	if strings.EqualFold(cfg.OpenAIAuthScheme, "none") {
+		cfg.OpenAIAuthScheme = ""
+	}
+	if cfg.OpenAIStreamUsage != "auto" && cfg.OpenAIStreamUsage != "true" && cfg.OpenAIStreamUsage != "false" {
+		env.Fail(fmt.Sprintf("OPENAI_STREAM_USAGE %q must be auto, true or false", cfg.OpenAIStreamUsage))
+	}
+	for i, origin := range cfg.CORSOrigins {
+		cfg.CORSOrigins[i] = strings.TrimSuffix(origin, "/")
+	}
+	// The debug endpoints describe every connection, so they are never open to all.
+	if cfg.DebugAdmin && len(cfg.AuthTokens) == 0 {
+		env.Fail("AUTH_TOKEN is required for DEBUG_ADMIN")
+	}
+	if cfg.EndUserID != endUserNone && cfg.EndUserID != endUserAuth && cfg.EndUserID != endUserIP {
+		env.Fail(fmt.Sprintf("OPENAI_USER_ID must be auth, ip or none, not %q", cfg.EndUserID))
+	}
+	for i, origin := range cfg.WSAllowedOrigins {
+		cfg.WSAllowedOrigins[i] = strings.TrimSuffix(origin, "/")
+		if err := checkOriginPattern(origin); err != nil {
+			env.Fail("WS_ALLOWED_ORIGINS: " + err.Error())
+		}
+	}
+	for _, name := range cfg.OutputFilters {
+		if outputFilterFactories[name] == nil {
+			env.Fail(fmt.Sprintf("OUTPUT_FILTERS: unknown filter %q (use %s)", name, strings.Join(outputFilterNames(), ", ")))
+		}
+	}
+
+	// Settings that depend on each other, or are only required sometimes.
+	if cfg.Moderation && cfg.OpenAIKey == "" && len(cfg.OpenAIKeys) == 0 {
+		env.Fail("OPENAI_API_KEY is required for MODERATION")
+	}
+	// Anthropic rejects conversations that start with an assistant message.
+	if cfg.RecordWelcomeMessage && cfg.Provider == "anthropic" {
+		env.Fail("WELCOME_MESSAGE_RECORD is not supported by the anthropic provider")
+	}
+	// MOCK_LLM needs no API key.
+	switch cfg.Provider {
+	case "openai":
+		if cfg.OpenAIKey == "" && len(cfg.OpenAIKeys) == 0 && !cfg.MockLLM {
+			env.Fail("OPENAI_API_KEY or OPENAI_API_KEYS is required for the openai provider")
+		}
+		// Compatible backends have their own model names.
+		if cfg.OpenAIBaseURL == defaultOpenAIBaseURL && !allowedModels[cfg.DefaultModel] {
+			env.Fail(fmt.Sprintf("DEFAULT_MODEL %q is not one of the allowed models", cfg.DefaultModel))
+		}
+	case "azure":
+		if cfg.AzureKey == "" && !cfg.MockLLM {
+			env.Fail("AZURE_API_KEY is required for the azure provider")
+		}
+		if u, err := url.Parse(cfg.AzureEndpoint); err != nil || u.Scheme == "" || u.Host == "" {
+			env.Fail(fmt.Sprintf("AZURE_ENDPOINT %q is not a URL (e.g. https://NAME.openai.azure.com)", cfg.AzureEndpoint))
+		}
+		if cfg.AzureDeployment == "" {
+			env.Fail("AZURE_DEPLOYMENT is required for the azure provider")
+		}
+	case "anthropic":
+		if cfg.AnthropicKey == "" && !cfg.MockLLM {
+			env.Fail("ANTHROPIC_API_KEY is required for the anthropic provider")
+		}
+	case "ollama":
+	default:
+		env.Fail(fmt.Sprintf("LLM_PROVIDER %q is unknown (use openai, azure, anthropic or ollama)", cfg.Provider))
+	}
+	if cfg.Store != "sqlite" && cfg.Store != "memory" {
+		env.Fail(fmt.Sprintf("STORE %q is unknown (use sqlite or memory)", cfg.Store))
+	}
+	if cfg.FrameFormat != frameFormatJSON && cfg.FrameFormat != frameFormatHTMX {
+		env.Fail(fmt.Sprintf("FRAME_FORMAT %q is unknown (use json or htmx)", cfg.FrameFormat))
+	}
+	if cfg.SendQueueOverflow != sendOverflowClose && cfg.SendQueueOverflow != sendOverflowBlock {
+		env.Fail(fmt.Sprintf("SEND_QUEUE_OVERFLOW %q is unknown (use close or block)", cfg.SendQueueOverflow))
+	}
+	if cfg.SendQueueSize < 0 {
+		env.Fail("SEND_QUEUE_SIZE must not be negative")
+	}
+	if cfg.LogFormat != "text" && cfg.LogFormat != "json" {
+		env.Fail(fmt.Sprintf("LOG_FORMAT %q is unknown (use text or json)", cfg.LogFormat))
+	}
+	if port, err := strconv.Atoi(cfg.Port); err != nil || port < 1 || port > 65535 {
+		env.Fail(fmt.Sprintf("PORT %q is not a valid port number", cfg.Port))
+	}
+	if cfg.LLMProxy != "" {
+		if u, err := url.Parse(cfg.LLMProxy); err != nil || u.Scheme == "" || u.Host == "" {
+			env.Fail(fmt.Sprintf("LLM_PROXY %q is not a URL (e.g. http://proxy:3128)", cfg.LLMProxy))
+		}
+	}
+	// The files the server reads at startup are checked here too, so their
+	// problems are listed with the others.
+	if cfg.LLMCACerts != "" {
+		if _, err := loadCACerts(cfg.LLMCACerts); err != nil {
+			env.Fail(err.Error())
+		}
+	}
+	if _, err := readModelParams(cfg.ModelParamsFile); err != nil {
+		env.Fail(err.Error())
+	}
+	if _, err := loadTemplates(cfg.TemplatesDir); err != nil {
+		env.Fail(err.Error())
+	}
+	if cfg.MaxConnections < 0 {
+		env.Fail("MAX_CONNECTIONS must not be negative")
+	}
+	if cfg.APIMaxBodyBytes < 0 || cfg.APIMaxMessages < 0 || cfg.APIMaxChars < 0 {
+		env.Fail("API_MAX_BODY_BYTES, API_MAX_MESSAGES and API_MAX_CHARS must not be negative")
+	}
+	if cfg.MaxMessageBytes == 0 {
+		env.Fail("MAX_MESSAGE_BYTES must be greater than 0")
+	}
+	if cfg.PingInterval > 0 && cfg.PongTimeout <= cfg.PingInterval {
+		env.Fail("PONG_TIMEOUT must be longer than PING_INTERVAL")
+	}
+	if cfg.ContextStrategy != contextStrategyDrop && cfg.ContextStrategy != contextStrategySummarize {
+		env.Fail(fmt.Sprintf("CONTEXT_STRATEGY %q is unknown (use drop or summarize)", cfg.ContextStrategy))
+	}
+	if cfg.SummarizeThreshold < 1 || cfg.SummarizeThreshold > 100 {
+		env.Fail("SUMMARIZE_THRESHOLD must be a percentage between 1 and 100")
+	}
+	if cfg.SummarizeTurns < 1 {
+		env.Fail("SUMMARIZE_TURNS must be at least 1")
+	}
+	// A cache of no keys would forget every response before its retry came.
+	if cfg.IdempotencyCacheSize < 1 {
+		env.Fail("IDEMPOTENCY_CACHE_SIZE must be at least 1")
+	}
+
+	if len(env.problems) > 0 {
+		return cfg, &ConfigError{Problems: env.problems}
+	}
+	return cfg, nil
+}
+
+// envReader reads typed environment variables, recording a problem for
+// every value it can't use instead of failing on the first one.
+type envReader struct {
+	// lookup returns a variable's value, or "" if it is unset.
+	lookup   func(key string) string
+	problems []string
+}
+
+// get returns the value of the variable key.
+func (r *envReader) get(key string) string {
+	return r.lookup(key)
+}
+
+// Fail records a configuration problem.
+func (r *envReader) Fail(problem string) {
+	r.problems = append(r.problems, problem)
+}
+
+// String returns the variable's value, or fallback if it is unset or empty.
+func (r *envReader) String(key, fallback string) string {
+	if value := strings.TrimSpace(r.get(key)); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// Duration reads a non-negative duration such as "30s" or "2m".
+func (r *envReader) Duration(key string, fallback time.Duration) time.Duration {
+	value := r.get(key)
+	if value == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		r.Fail(fmt.Sprintf("%s %q is not a valid duration (e.g. 30s or 2m)", key, value))
+		return fallback
+	}
+	return d
+}
+
+// Int reads a non-negative integer.
+func (r *envReader) Int(key string, fallback int) int {
+	value := r.get(key)
+	if value == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		r.Fail(fmt.Sprintf("%s %q is not a non-negative integer", key, value))
+		return fallback
+	}
+	return n
+}
+
+// Bool reads a boolean such as "true", "1" or "false".
+func (r *envReader) Bool(key string, fallback bool) bool {
+	value := r.get(key)
+	if value == "" {
+		return fallback
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		r.Fail(fmt.Sprintf("%s %q is not a boolean (use true or false)", key, value))
+		return fallback
+	}
+	return b
+}
+
+// List reads a comma-separated list, skipping empty items.
+func (r *envReader) List(key string) []string {
+	var items []string
+	for _, item := range strings.Split(r.get(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Float reads a non-negative number.
+func (r *envReader) Float(key string, fallback float64) float64 {
+	value := r.get(key)
+	if value == "" {
+		return fallback
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil || f < 0 {
+		r.Fail(fmt.Sprintf("%s %q is not a non-negative number", key, value))
+		return fallback
+	}
+	return f
+}
+
+// Prices reads a comma-separated list of model=prompt/completion pairs, in
+// dollars per million tokens.
+func (r *envReader) Prices(key string) map[string]ModelPrice {
+	prices := make(map[string]ModelPrice)
+	for _, pair := range r.List(key) {
+		model, value, ok := strings.Cut(pair, "=")
+		prompt, completion, ok2 := strings.Cut(value, "/")
+		p, err := strconv.ParseFloat(strings.TrimSpace(prompt), 64)
+		c, err2 := strconv.ParseFloat(strings.TrimSpace(completion), 64)
+		if !ok || !ok2 || err != nil || err2 != nil || p < 0 || c < 0 {
+			r.Fail(fmt.Sprintf("%s entry %q is not of the form model=prompt/completion", key, pair))
+			continue
+		}
+		prices[strings.TrimSpace(model)] = ModelPrice{Prompt: p, Completion: c}
+	}
+	return prices
+}
+
+// Budgets reads a comma-separated list of model=tokens pairs.
+func (r *envReader) Budgets(key string) map[string]int {
+	budgets := make(map[string]int)
+	for _, pair := range r.List(key) {
+		model, value, ok := strings.Cut(pair, "=")
+		budget, err := strconv.Atoi(strings.TrimSpace(value))
+		if !ok || err != nil || budget <= 0 {
+			r.Fail(fmt.Sprintf("%s entry %q is not of the form model=tokens", key, pair))
+			continue
+		}
+		budgets[strings.TrimSpace(model)] = budget
+	}
+	return budgets
+}
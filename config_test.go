@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testEnv returns an envReader that sees only vars.
+func testEnv(vars map[string]string) *envReader {
+	return &envReader{lookup: func(key string) string { return vars[key] }}
+}
+
+// configProblems loads the configuration from vars and returns its problems.
+func configProblems(t *testing.T, vars map[string]string) (Config, []string) {
+	t.Helper()
+	cfg, err := loadConfig(testEnv(vars))
+	if err == nil {
+		return cfg, nil
+	}
+	var cfgErr *ConfigError
+	if !errors.As(err, &cfgErr) {
+		t.Fatalf("loadConfig returned %T, want *ConfigError", err)
+	}
+	return cfg, cfgErr.Problems
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	cfg, problems := configProblems(t, map[string]string{"OPENAI_API_KEY": "sk-test"})
+	if len(problems) > 0 {
+		t.Fatalf("unexpected problems: %v", problems)
+	}
+	if cfg.Port != "8080" || cfg.Provider != "openai" || cfg.Store != "sqlite" {
+		t.Errorf("port, provider, store = %q, %q, %q; want 8080, openai, sqlite", cfg.Port, cfg.Provider, cfg.Store)
+	}
+	if cfg.DefaultModel != defaultModel || cfg.OpenAIBaseURL != defaultOpenAIBaseURL {
+		t.Errorf("model, base URL = %q, %q; want %q, %q", cfg.DefaultModel, cfg.OpenAIBaseURL, defaultModel, defaultOpenAIBaseURL)
+	}
+	if cfg.OpenAITimeout != defaultOpenAITimeout || cfg.MaxRetries != defaultMaxRetries || cfg.APITimeout != defaultAPITimeout {
+		t.Errorf("timeout, retries, API timeout = %v, %d, %v", cfg.OpenAITimeout, cfg.MaxRetries, cfg.APITimeout)
+	}
+	if cfg.MaxMessageBytes != defaultMaxMessageBytes || cfg.DebugAdmin || cfg.MockLLM {
+		t.Errorf("max message bytes, debug admin, mock = %d, %v, %v", cfg.MaxMessageBytes, cfg.DebugAdmin, cfg.MockLLM)
+	}
+}
+
+func TestLoadConfigEmptyEnv(t *testing.T) {
+	cfg, problems := configProblems(t, map[string]string{})
+	if len(problems) != 1 || !strings.Contains(problems[0], "OPENAI_API_KEY") {
+		t.Fatalf("problems = %v, want only the missing OPENAI_API_KEY", problems)
+	}
+	// Defaults are filled in even when the configuration is invalid.
+	if cfg.Port != "8080" {
+		t.Errorf("port = %q, want 8080", cfg.Port)
+	}
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		vars map[string]string
+		want string
+	}{
+		{"bad int", map[string]string{"OPENAI_MAX_RETRIES": "three"}, `OPENAI_MAX_RETRIES "three" is not a non-negative integer`},
+		{"negative int", map[string]string{"MAX_CONNECTIONS": "-1"}, `MAX_CONNECTIONS "-1" is not a non-negative integer`},
+		{"bad duration", map[string]string{"OPENAI_TIMEOUT": "soon"}, `OPENAI_TIMEOUT "soon" is not a valid duration`},
+		{"duration without unit", map[string]string{"API_TIMEOUT": "30"}, `API_TIMEOUT "30" is not a valid duration`},
+		{"debug admin without auth", map[string]string{"DEBUG_ADMIN": "true"}, "AUTH_TOKEN is required for DEBUG_ADMIN"},
+		{"bad stream usage", map[string]string{"OPENAI_STREAM_USAGE": "yes"}, `OPENAI_STREAM_USAGE "yes" must be auto, true or false`},
+		{"no idempotency cache", map[string]string{"IDEMPOTENCY_CACHE_SIZE": "0"}, "IDEMPOTENCY_CACHE_SIZE must be at least 1"},
+		{"model not allowed", map[string]string{"DEFAULT_MODEL": "gpt-unknown"}, `DEFAULT_MODEL "gpt-unknown" is not one of the allowed models`},
+		{"missing CA certs", map[string]string{"LLM_CA_CERTS": "testdata/missing.pem"}, "error reading LLM_CA_CERTS"},
+		{"missing model params", map[string]string{"MODEL_PARAMS_FILE": "testdata/missing.json"}, "error reading MODEL_PARAMS_FILE"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.vars["OPENAI_API_KEY"] = "sk-test"
+			_, problems := configProblems(t, tt.vars)
+			if len(problems) != 1 || !strings.Contains(problems[0], tt.want) {
+				t.Errorf("problems = %q, want one containing %q", problems, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigStartupFiles(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, data string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	templates := filepath.Join(dir, "templates")
+	if err := os.Mkdir(templates, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	write("templates/broken.tmpl", "{{.Name")
+	_, problems := configProblems(t, map[string]string{
+		"OPENAI_API_KEY":       "sk-test",
+		"LLM_CA_CERTS":         write("ca.pem", "not a certificate"),
+		"MODEL_PARAMS_FILE":    write("params.json", `{"gpt-4o": {"min": {"temperature": 1}, "max": {"temperature": 0.5}}}`),
+		"PROMPT_TEMPLATES_DIR": templates,
+	})
+	want := []string{"contains no PEM certificates", "MODEL_PARAMS_FILE: limits for", `error parsing prompt template "broken"`}
+	if len(problems) != len(want) {
+		t.Fatalf("problems = %q, want one for each file", problems)
+	}
+	for i, problem := range problems {
+		if !strings.Contains(problem, want[i]) {
+			t.Errorf("problem %d = %q, want one containing %q", i, problem, want[i])
+		}
+	}
+}
+
+func TestLoadConfigReportsEveryProblem(t *testing.T) {
+	_, problems := configProblems(t, map[string]string{
+		"OPENAI_MAX_RETRIES": "x",
+		"OPENAI_TIMEOUT":     "x",
+		"DEBUG_ADMIN":        "true",
+	})
+	if len(problems) != 4 {
+		t.Errorf("got %d problems, want 4 (key, retries, timeout, auth): %q", len(problems), problems)
+	}
+}
+
+func TestLoadConfigDebugAdminWithAuth(t *testing.T) {
+	cfg, problems := configProblems(t, map[string]string{
+		"OPENAI_API_KEY": "sk-test",
+		"DEBUG_ADMIN":    "true",
+		"AUTH_TOKEN":     "secret",
+	})
+	if len(problems) > 0 || !cfg.DebugAdmin {
+		t.Errorf("debug admin = %v, problems = %v; want true, none", cfg.DebugAdmin, problems)
+	}
+}
+
+func TestLoadConfigCompatibleBackendAnyModel(t *testing.T) {
+	// Other OpenAI-compatible backends have their own model names.
+	_, problems := configProblems(t, map[string]string{
+		"OPENAI_API_KEY":  "sk-test",
+		"OPENAI_BASE_URL": "http://localhost:8000/v1",
+		"DEFAULT_MODEL":   "llama3",
+	})
+	if len(problems) > 0 {
+		t.Errorf("unexpected problems: %v", problems)
+	}
+}
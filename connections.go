@@ -0,0 +1,76 @@
+package main
+
+import (
+	"sort"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// ConnectionsResponse is the body of GET /debug/connections.
+type ConnectionsResponse struct {
+	Count       int              `json:"count"`
+	Connections []ConnectionInfo `json:"connections"`
+}
+
+// ConnectionInfo describes one open WebSocket connection for debugging. It
+// says nothing about what was said.
+type ConnectionInfo struct {
+	ID             string             `json:"id"`
+	ConnectedAt    time.Time          `json:"connectedAt"`
+	Seconds        int                `json:"seconds"`
+	Conversations  []ConversationInfo `json:"conversations"`
+	Current        string             `json:"currentConversation,omitempty"`
+	Room           bool               `json:"room,omitempty"`
+	MemoryBytes    int                `json:"memoryBytes"`
+	QueuedMessages int                `json:"queuedMessages"`
+}
+
+// ConversationInfo describes a conversation attached to a connection.
+type ConversationInfo struct {
+	ID       string `json:"id"`
+	Model    string `json:"model"`
+	Messages int    `json:"messages"`
+}
+
+// handleDebugConnections lists the open WebSocket connections, the oldest
+// first. It is only served with DEBUG_ADMIN=true, which requires AUTH_TOKEN.
+func handleDebugConnections(c *fiber.Ctx) error {
+	now := time.Now()
+	resp := ConnectionsResponse{Connections: []ConnectionInfo{}}
+	registry.Range(func(client *Client) bool {
+		info := ConnectionInfo{
+			ID:             client.ID(),
+			ConnectedAt:    client.connectedAt,
+			Seconds:        int(now.Sub(client.connectedAt).Seconds()),
+			Conversations:  []ConversationInfo{},
+			Room:           client.Room() != nil,
+			QueuedMessages: len(client.jobs),
+		}
+		_, info.MemoryBytes = client.Memory().Facts()
+		if conv := client.Conversation(); conv != nil {
+			info.Current = conv.ID()
+		}
+		for _, conv := range client.Conversations() {
+			info.Conversations = append(info.Conversations, ConversationInfo{
+				ID:       conv.ID(),
+				Model:    conv.Model(),
+				Messages: conv.MessageCount(),
+			})
+		}
+		resp.Connections = append(resp.Connections, info)
+		return true
+	})
+	sort.Slice(resp.Connections, func(i, j int) bool {
+		return resp.Connections[i].ConnectedAt.Before(resp.Connections[j].ConnectedAt)
+	})
+	resp.Count = len(resp.Connections)
+	return c.JSON(resp)
+}
+
+// MessageCount returns how many messages the conversation's history holds.
+func (c *Conversation) MessageCount() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.history)
+}
@@ -0,0 +1,53 @@
+package main
+
+// defaultContextBudget is the prompt token budget for models without a known budget.
+// It can be overridden with the DEFAULT_CONTEXT_BUDGET environment variable.
+const defaultContextBudget = 8192
+
+// contextBudgets is the prompt token budget per model. The budgets are a bit
+// below each model's context window to leave room for the reply and for the
+// inaccuracy of the token estimate. CONTEXT_BUDGETS overrides or extends them,
+// e.g. "gpt-4o=60000,llama3.2=4096".
+var contextBudgets = map[string]int{
+	"gpt-4o-mini":              120000,
+	"gpt-4o":                   120000,
+	"gpt-4-turbo":              120000,
+	"gpt-3.5-turbo":            14000,
+	"o1":                       190000,
+	"o1-mini":                  120000,
+	"o3-mini":                  190000,
+	"claude-3-5-haiku-latest":  190000,
+	"claude-3-5-sonnet-latest": 190000,
+	"claude-3-opus-latest":     190000,
+}
+
+// fallbackContextBudget is used for models missing from contextBudgets.
+var fallbackContextBudget = defaultContextBudget
+
+// contextBudget returns the prompt token budget for a model.
+func contextBudget(model string) int {
+	if budget, ok := contextBudgets[model]; ok {
+		return budget
+	}
+	return fallbackContextBudget
+}
+
+// messagesToDrop works out how many of the oldest history messages must go so
+// that the prompt (the system messages plus the rest of history) fits in budget.
+// Whole turns are dropped, so the remaining history always starts with a user
+// message, and the latest message is always kept even if it alone is too big.
+func messagesToDrop(t Tokenizer, system, history []Message, budget int) int {
+	drop := 0
+	fits := func() bool {
+		prompt := append(append([]Message(nil), system...), history[drop:]...)
+		return t.CountTokens(prompt) <= budget
+	}
+	for drop < len(history)-1 && !fits() {
+		drop++
+		// Skip to the start of the next turn.
+		for drop < len(history)-1 && history[drop].Role != "user" {
+			drop++
+		}
+	}
+	return drop
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// conversationIdleTTL is how long a conversation stays in memory after its last
+// connection closes. Within this window a reconnecting client gets its full state
+// back (system prompt, model, history); afterwards only the stored history remains.
+const conversationIdleTTL = 30 * time.Minute
+
+// Conversation holds everything the server remembers about one conversation.
+// It is keyed by its ID rather than by a connection, so a client that reconnects
+// (e.g. after a browser refresh) can pick up where it left off.
+type Conversation struct {
+	id string
+
+	mu      sync.Mutex
+	history []Message
+	// dropped counts the messages removed from the front of history by
+	// DropOldest; they are still in the store, which numbers messages from 0.
+	dropped      int
+	systemPrompt string
+	model        string
+	params       GenerationParams
+	usage        Usage
+	// cost is what usage cost in dollars, at modelPrices.
+	cost float64
+	// examples are few-shot user/assistant pairs sent after the system prompt.
+	examples []Message
+	// prefill is the text the next reply starts with (see TakePrefill).
+	prefill string
+	// files are the uploads added to the conversation's context.
+	files []*Upload
+	// titled is set once a title has been requested for the conversation.
+	titled bool
+	// summary condenses the turns removed by Summarize.
+	summary string
+	// reply buffers the latest reply for clients resuming it.
+	reply replyBuffer
+}
+
+// ID returns the conversation's unique ID.
+func (c *Conversation) ID() string {
+	return c.id
+}
+
+// AppendMessage adds a message to the end of the conversation history.
+func (c *Conversation) AppendMessage(m Message) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.history = append(c.history, m)
+}
+
+// Messages returns a copy of the conversation history.
+// A copy is returned so callers can use it while other goroutines keep appending.
+func (c *Conversation) Messages() []Message {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	msgs := make([]Message, len(c.history))
+	copy(msgs, c.history)
+	return msgs
+}
+
+// DropOldest removes the n oldest messages from the in-memory history, e.g. to
+// keep the prompt within the model's context window. Stored history is unaffected.
+func (c *Conversation) DropOldest(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if n > len(c.history) {
+		n = len(c.history)
+	}
+	c.history = append([]Message(nil), c.history[n:]...)
+	c.dropped += n
+}
+
+// Reply returns the buffer holding the conversation's latest reply.
+func (c *Conversation) Reply() *replyBuffer {
+	return &c.reply
+}
+
+// Summarize replaces the n oldest messages of the in-memory history by a
+// summary, which takes the place of any earlier one. Like DropOldest, it
+// leaves the stored history alone.
+func (c *Conversation) Summarize(n int, summary string) {
+	c.DropOldest(n)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.summary = summary
+}
+
+// Summary returns the summary of the turns removed by Summarize, if any.
+func (c *Conversation) Summary() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.summary
+}
+
+// TruncateAt removes the user message at index and everything after it, so it
+// can be replaced by an edited version. Like the store, index counts every
+// message of the conversation, including those dropped by DropOldest.
+func (c *Conversation) TruncateAt(index int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	i := index - c.dropped
+	if index < 0 || i >= len(c.history) {
+		return fmt.Errorf("there is no message %d", index)
+	}
+	if i < 0 {
+		return fmt.Errorf("message %d is too old to edit", index)
+	}
+	if c.history[i].Role != "user" {
+		return fmt.Errorf("message %d is not a user message", index)
+	}
+	c.history = c.history[:i]
+	return nil
+}
+
+// LastReply returns the text of the last message if it is an assistant reply.
+func (c *Conversation) LastReply() (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.history) == 0 || c.history[len(c.history)-1].Role != "assistant" {
+		return "", false
+	}
+	return c.history[len(c.history)-1].Content, true
+}
+
+// PopLastReply removes the last message if it is an assistant reply, so it
+// can be generated again. It returns the number of messages left in the whole
+// conversation (as counted by the store), and false if there was no reply to remove.
+func (c *Conversation) PopLastReply() (remaining int, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.history) == 0 || c.history[len(c.history)-1].Role != "assistant" {
+		return 0, false
+	}
+	c.history = c.history[:len(c.history)-1]
+	return c.dropped + len(c.history), true
+}
+
+// AttachFile adds an uploaded file to the context of every following
+// completion. Attaching the same upload twice has no effect.
+func (c *Conversation) AttachFile(u *Upload) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, f := range c.files {
+		if f.ID == u.ID {
+			return
+		}
+	}
+	c.files = append(c.files, u)
+}
+
+// Files returns the uploads attached to the conversation.
+func (c *Conversation) Files() []*Upload {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]*Upload(nil), c.files...)
+}
+
+// NeedsTitle reports whether a title should be generated now: right after the
+// first exchange, and only once per conversation. A recorded welcome message
+// before the first user message doesn't count.
+func (c *Conversation) NeedsTitle() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	users := 0
+	for _, m := range c.history {
+		if m.Role == "user" {
+			users++
+		}
+	}
+	if c.titled || c.dropped > 0 || users != 1 || c.history[len(c.history)-1].Role != "assistant" {
+		return false
+	}
+	c.titled = true
+	return true
+}
+
+// SetSystemPrompt replaces the system prompt used for this conversation.
+// An empty prompt means no system message is sent.
+func (c *Conversation) SetSystemPrompt(prompt string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.systemPrompt = prompt
+}
+
+// SystemPrompt returns the current system prompt for this conversation.
+func (c *Conversation) SystemPrompt() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.systemPrompt
+}
+
+// SetModel changes the model used for the rest of the conversation.
+func (c *Conversation) SetModel(model string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.model = model
+}
+
+// Model returns the model selected for this conversation, or defaultModel if none was chosen.
+func (c *Conversation) Model() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.model == "" {
+		return defaultModel
+	}
+	return c.model
+}
+
+// UpdateParams merges newly set generation parameters into the conversation's settings.
+func (c *Conversation) UpdateParams(update GenerationParams) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.params = c.params.Merge(update)
+}
+
+// Params returns the conversation's generation parameters.
+func (c *Conversation) Params() GenerationParams {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.params
+}
+
+// AddUsage adds one response's token usage, and what it cost, to the
+// conversation's running total and returns the new total.
+func (c *Conversation) AddUsage(u Usage, cost float64) Usage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.usage.PromptTokens += u.PromptTokens
+	c.usage.CompletionTokens += u.CompletionTokens
+	c.cost += cost
+	return c.usage
+}
+
+// Spent returns the conversation's total token usage and its cost.
+func (c *Conversation) Spent() (Usage, float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.usage, c.cost
+}
+
+// conversationEntry tracks how many connections use a conversation and when the last one left.
+type conversationEntry struct {
+	conv       *Conversation
+	clients    int
+	releasedAt time.Time
+}
+
+// ConversationRegistry keeps conversations in memory, keyed by ID.
+// Conversations are loaded from the store on demand and evicted some time after
+// their last connection closes.
+type ConversationRegistry struct {
+	mu            sync.Mutex
+	conversations map[string]*conversationEntry
+}
+
+// NewConversationRegistry creates an empty registry ready for use.
+func NewConversationRegistry() *ConversationRegistry {
+	return &ConversationRegistry{
+		conversations: make(map[string]*conversationEntry),
+	}
+}
+
+// Open attaches a connection to the conversation with the given ID.
+// A conversation still in memory is reused as is; otherwise its history is loaded
+// from the store, along with what it has spent. If id is empty or unknown, a
+// new conversation is created.
+// resumed reports whether an existing conversation was found.
+// Every successful Open must be paired with a call to Release.
+// The store is called without holding the registry's lock, so a slow store
+// only holds up the connections waiting for it.
+func (r *ConversationRegistry) Open(ctx context.Context, id string) (conv *Conversation, resumed bool, err error) {
+	if id != "" {
+		if conv := r.attach(id); conv != nil {
+			return conv, true, nil
+		}
+		history, err := store.LoadMessages(ctx, id)
+		if err == nil {
+			conv = &Conversation{id: id, history: history, systemPrompt: defaultSystemPrompt}
+			// What the conversation spent before it left memory still counts.
+			if recorder, ok := store.(UsageRecorder); ok {
+				if conv.usage, conv.cost, err = recorder.LoadUsage(ctx, id); err != nil {
+					return nil, false, err
+				}
+			}
+			return r.add(conv), true, nil
+		}
+		if !errors.Is(err, ErrConversationNotFound) {
+			return nil, false, err
+		}
+	}
+
+	// The store generates the ID (a UUID) for the new conversation.
+	newID, err := store.CreateConversation(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	return r.add(&Conversation{id: newID, systemPrompt: defaultSystemPrompt}), false, nil
+}
+
+// attach adds a connection to the conversation with the given ID if it is in
+// memory, and returns it; otherwise it returns nil.
+func (r *ConversationRegistry) attach(id string) *Conversation {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.evictIdle()
+	if entry, ok := r.conversations[id]; ok {
+		entry.clients++
+		return entry.conv
+	}
+	return nil
+}
+
+// add keeps conv, just loaded or created, in memory with one connection. If
+// another connection loaded the same conversation in the meantime, that one
+// is attached and returned instead, so both share it.
+func (r *ConversationRegistry) add(conv *Conversation) *Conversation {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if entry, ok := r.conversations[conv.id]; ok {
+		entry.clients++
+		return entry.conv
+	}
+	r.conversations[conv.id] = &conversationEntry{conv: conv, clients: 1}
+	return conv
+}
+
+// Release detaches a connection from a conversation opened with Open.
+func (r *ConversationRegistry) Release(conv *Conversation) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if entry, ok := r.conversations[conv.id]; ok && entry.conv == conv {
+		entry.clients--
+		if entry.clients <= 0 {
+			entry.clients = 0
+			entry.releasedAt = time.Now()
+		}
+	}
+}
+
+// evictIdle drops conversations nobody has used for conversationIdleTTL.
+// The caller must hold r.mu.
+func (r *ConversationRegistry) evictIdle() {
+	for id, entry := range r.conversations {
+		if entry.clients == 0 && time.Since(entry.releasedAt) > conversationIdleTTL {
+			delete(r.conversations, id)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// blockingStore holds up LoadMessages until unblock is closed, announcing
+// every call on loading.
+type blockingStore struct {
+	ConversationStore
+	loading chan struct{}
+	unblock chan struct{}
+}
+
+func (s *blockingStore) LoadMessages(ctx context.Context, id string) ([]Message, error) {
+	s.loading <- struct{}{}
+	<-s.unblock
+	return s.ConversationStore.LoadMessages(ctx, id)
+}
+
+func TestConversationRegistryOpenWithSlowStore(t *testing.T) {
+	ctx := context.Background()
+	mem := newMemoryStore()
+	id, err := mem.CreateConversation(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slow := &blockingStore{ConversationStore: mem, loading: make(chan struct{}, 2), unblock: make(chan struct{})}
+	setForTest[ConversationStore](t, &store, slow)
+	reg := NewConversationRegistry()
+
+	opened := make(chan *Conversation, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			conv, resumed, err := reg.Open(ctx, id)
+			if err != nil || !resumed {
+				t.Errorf("Open(%q) = %v, %v; want the stored conversation", id, resumed, err)
+			}
+			opened <- conv
+		}()
+	}
+	// Both loads reach the store: neither waits for the other.
+	for i := 0; i < 2; i++ {
+		select {
+		case <-slow.loading:
+		case <-time.After(2 * time.Second):
+			t.Fatal("the second Open did not reach the store while the first was loading")
+		}
+	}
+	// Nor do other connections wait for them.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conv, _, err := reg.Open(ctx, "")
+		if err != nil {
+			t.Errorf("Open of a new conversation: %v", err)
+			return
+		}
+		reg.Release(conv)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Open of a new conversation waited for a slow load")
+	}
+
+	close(slow.unblock)
+	a, b := <-opened, <-opened
+	if a == nil || a != b {
+		t.Fatalf("concurrent opens returned %p and %p, want one shared conversation", a, b)
+	}
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if clients := reg.conversations[id].clients; clients != 2 {
+		t.Errorf("conversation has %d clients, want 2", clients)
+	}
+}
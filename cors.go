@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/cors"
+)
+
+// Default CORS methods and headers, used when CORS_ORIGINS is set but
+// CORS_METHODS or CORS_HEADERS aren't.
+const (
+	defaultCORSMethods = "GET,POST,OPTIONS"
+	defaultCORSHeaders = "Content-Type,Authorization"
+)
+
+// corsOrigins lists the extra origins allowed to call the API and open
+// WebSockets, from CORS_ORIGINS. "*" allows any origin. When it is empty
+// only same-origin requests are allowed.
+var corsOrigins []string
+
+// wsAllowedOrigins, from WS_ALLOWED_ORIGINS, replaces corsOrigins for
+// WebSocket upgrades. Besides exact origins and "*" it takes patterns with a
+// wildcard subdomain, such as "https://*.example.com".
+var wsAllowedOrigins []string
+
+// newCORSMiddleware returns Fiber's CORS middleware for corsOrigins,
+// or nil if no cross-origin access is configured.
+func newCORSMiddleware(methods, headers string) fiber.Handler {
+	if len(corsOrigins) == 0 {
+		return nil
+	}
+	return cors.New(cors.Config{
+		AllowOrigins: strings.Join(corsOrigins, ","),
+		AllowMethods: methods,
+		AllowHeaders: headers,
+	})
+}
+
+// originAllowed reports whether a WebSocket upgrade may proceed. Browsers
+// always send an Origin header, so checking it stops other sites from opening
+// a WebSocket with the user's cookies (cross-site WebSocket hijacking).
+// Requests without an Origin come from non-browser clients and are allowed.
+func originAllowed(c *fiber.Ctx) bool {
+	origin := c.Get(fiber.HeaderOrigin)
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && u.Host == string(c.Request().Host()) {
+		return true
+	}
+	patterns := corsOrigins
+	if len(wsAllowedOrigins) > 0 {
+		patterns = wsAllowedOrigins
+	}
+	for _, pattern := range patterns {
+		if originMatches(pattern, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// originMatches reports whether origin matches pattern: "*", an exact origin,
+// or an origin whose host starts with "*.", which matches any subdomain (but
+// not the domain itself) with the same scheme and port.
+func originMatches(pattern, origin string) bool {
+	if pattern == "*" || strings.EqualFold(pattern, origin) {
+		return true
+	}
+	p, err := url.Parse(pattern)
+	if err != nil || !strings.HasPrefix(p.Host, "*.") {
+		return false
+	}
+	o, err := url.Parse(origin)
+	if err != nil || !strings.EqualFold(p.Scheme, o.Scheme) || p.Port() != o.Port() {
+		return false
+	}
+	domain := strings.TrimPrefix(p.Hostname(), "*")
+	host := o.Hostname()
+	return len(host) > len(domain) && strings.EqualFold(host[len(host)-len(domain):], domain)
+}
+
+// checkOriginPattern returns an error unless pattern is "*" or an origin
+// (scheme://host[:port]) whose host may start with "*.".
+func checkOriginPattern(pattern string) error {
+	if pattern == "*" {
+		return nil
+	}
+	u, err := url.Parse(pattern)
+	if err != nil || u.Scheme == "" || u.Host == "" || (u.Path != "" && u.Path != "/") || u.RawQuery != "" {
+		return fmt.Errorf("%q is not an origin such as https://app.example.com", pattern)
+	}
+	if strings.Contains(strings.TrimPrefix(u.Host, "*."), "*") {
+		return fmt.Errorf("%q may only have a wildcard at the start of its host, as in https://*.example.com", pattern)
+	}
+	return nil
+}
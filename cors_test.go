@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestOriginMatches(t *testing.T) {
+	tests := []struct {
+		pattern, origin string
+		want            bool
+	}{
+		{"https://*.example.com", "https://a.example.com", true},
+		{"https://*.example.com", "https://a.b.example.com", true},
+		{"https://*.example.com", "https://A.Example.COM", true},
+		{"https://*.example.com", "https://example.com", false},
+		{"https://*.example.com", "https://evilexample.com", false},
+		{"https://*.example.com", "https://a.example.com.evil.net", false},
+		{"https://*.example.com", "http://a.example.com", false},
+		{"https://*.example.com", "https://a.example.com:8443", false},
+		{"https://*.example.com:8443", "https://a.example.com:8443", true},
+		{"https://*.example.com:8443", "https://a.example.com:9443", false},
+		{"https://*.example.com:8443", "https://a.example.com", false},
+		{"https://app.example.com", "https://app.example.com", true},
+		{"https://app.example.com", "https://APP.example.com", true},
+		{"https://app.example.com", "http://app.example.com", false},
+		{"https://app.example.com", "https://app.example.com:444", false},
+		{"https://app.example.com", "https://a.app.example.com", false},
+		{"*", "https://anything.test", true},
+	}
+	for _, tt := range tests {
+		if got := originMatches(tt.pattern, tt.origin); got != tt.want {
+			t.Errorf("originMatches(%q, %q) = %v, want %v", tt.pattern, tt.origin, got, tt.want)
+		}
+	}
+}
+
+func TestCheckOriginPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		valid   bool
+	}{
+		{"*", true},
+		{"https://app.example.com", true},
+		{"https://*.example.com", true},
+		{"http://localhost:3000", true},
+		{"https://*.example.com:8443", true},
+		{"https://app.example.com/", true},
+		{"app.example.com", false},
+		{"https://app.example.com/path", false},
+		{"https://app.example.com?x=1", false},
+		{"https://a.*.example.com", false},
+		{"https://*example.com", false},
+		{"https://*.*.example.com", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if err := checkOriginPattern(tt.pattern); (err == nil) != tt.valid {
+			t.Errorf("checkOriginPattern(%q) = %v, want valid %v", tt.pattern, err, tt.valid)
+		}
+	}
+}
+
+func TestOriginAllowed(t *testing.T) {
+	savedCORS, savedWS := corsOrigins, wsAllowedOrigins
+	defer func() { corsOrigins, wsAllowedOrigins = savedCORS, savedWS }()
+	app := fiber.New()
+	app.Get("/ws", func(c *fiber.Ctx) error {
+		if !originAllowed(c) {
+			return c.SendStatus(fiber.StatusForbidden)
+		}
+		return c.SendStatus(fiber.StatusOK)
+	})
+	check := func(origin string) bool {
+		t.Helper()
+		req := httptest.NewRequest("GET", "http://chat.test/ws", nil)
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode == fiber.StatusOK
+	}
+
+	corsOrigins, wsAllowedOrigins = []string{"https://cors.example.com"}, nil
+	if !check("") || !check("http://chat.test") {
+		t.Error("requests without an origin or from the server's own host were rejected")
+	}
+	if !check("https://cors.example.com") || check("https://other.example.com") {
+		t.Error("without WS_ALLOWED_ORIGINS, CORS_ORIGINS should decide")
+	}
+	// WS_ALLOWED_ORIGINS replaces CORS_ORIGINS for WebSockets.
+	wsAllowedOrigins = []string{"https://*.app.example.com"}
+	if check("https://cors.example.com") || !check("https://eu.app.example.com") {
+		t.Error("with WS_ALLOWED_ORIGINS, CORS_ORIGINS should be ignored")
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// debugLLM enables logging of upstream requests and raw responses at debug
+// level. It is set from the DEBUG_LLM environment variable and needs
+// LOG_LEVEL=debug for the output to show up.
+var debugLLM bool
+
+// redacted replaces secrets in logged text.
+const redacted = "[REDACTED]"
+
+// secrets are the configured credentials redact removes from text.
+var secrets []string
+
+// bearerPattern matches bearer tokens in headers or error messages, and
+// keyPattern matches OpenAI- and Anthropic-style keys that aren't configured here.
+var (
+	bearerPattern = regexp.MustCompile(`(?i)(bearer\s+)\S+`)
+	keyPattern    = regexp.MustCompile(`sk-[A-Za-z0-9_-]{8,}`)
+)
+
+// loadSecrets collects the credentials to redact from the configuration.
+func loadSecrets(cfg Config) {
+	secrets = nil
+	credentials := append([]string{cfg.OpenAIKey, cfg.AzureKey, cfg.AnthropicKey}, cfg.OpenAIKeys...)
+	for _, secret := range append(credentials, cfg.AuthTokens...) {
+		if secret != "" {
+			secrets = append(secrets, secret)
+		}
+	}
+}
+
+// redact removes API keys and bearer tokens from s.
+func redact(s string) string {
+	for _, secret := range secrets {
+		s = strings.ReplaceAll(s, secret, redacted)
+	}
+	s = bearerPattern.ReplaceAllString(s, "${1}"+redacted)
+	return keyPattern.ReplaceAllString(s, redacted)
+}
+
+// redactHeader returns a copy of header suitable for logging, without credentials.
+func redactHeader(header http.Header) map[string]string {
+	out := make(map[string]string, len(header))
+	for name := range header {
+		switch http.CanonicalHeaderKey(name) {
+		case "Authorization", "X-Api-Key", "Api-Key":
+			out[name] = redacted
+		default:
+			out[name] = redact(header.Get(name))
+		}
+	}
+	return out
+}
+
+// debugRequest logs an outgoing upstream request when DEBUG_LLM is on.
+func debugRequest(ctx context.Context, url string, header http.Header, body []byte) {
+	if !debugLLM {
+		return
+	}
+	loggerFrom(ctx).Debug("upstream request", "url", url, "header", redactHeader(header), "body", redact(string(body)))
+}
+
+// debugResponseLine logs a raw line of an upstream response when DEBUG_LLM is on.
+func debugResponseLine(ctx context.Context, provider, line string) {
+	if !debugLLM {
+		return
+	}
+	loggerFrom(ctx).Debug("upstream response line", "provider", provider, "line", redact(line))
+}
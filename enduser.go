@@ -0,0 +1,55 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Where the end-user ID sent to OpenAI as "user" comes from (OPENAI_USER_ID).
+const (
+	// endUserNone sends no ID.
+	endUserNone = "none"
+	// endUserAuth identifies users by their AUTH_TOKEN, or by IP when
+	// authentication is off.
+	endUserAuth = "auth"
+	// endUserIP identifies users by their IP address.
+	endUserIP = "ip"
+)
+
+var (
+	endUserSource = endUserNone
+	// endUserSalt (OPENAI_USER_ID_SALT) is hashed along with tokens and IPs,
+	// so the IDs OpenAI sees can't be traced back to them.
+	endUserSalt string
+)
+
+// authTokenKey is the Locals key holding the token a request authenticated with.
+const authTokenKey = "auth_token"
+
+// endUserKey is the Locals key holding the end-user ID of a WebSocket
+// connection, worked out before the upgrade.
+const endUserKey = "end_user"
+
+// endUserID returns the ID OpenAI's abuse monitoring should know the sender
+// of c by, or "" if none is sent. IDs are hashes, stable for as long as the
+// token, IP and salt stay the same.
+func endUserID(c *fiber.Ctx) string {
+	switch endUserSource {
+	case endUserAuth:
+		if token, _ := c.Locals(authTokenKey).(string); token != "" {
+			return hashEndUser("token", token)
+		}
+		return hashEndUser("ip", c.IP())
+	case endUserIP:
+		return hashEndUser("ip", c.IP())
+	}
+	return ""
+}
+
+// hashEndUser returns an ID for value, prefixed with its kind.
+func hashEndUser(kind, value string) string {
+	sum := sha256.Sum256([]byte(endUserSalt + "\x00" + value))
+	return kind + "-" + hex.EncodeToString(sum[:16])
+}
@@ -0,0 +1,51 @@
+package main
+
+import "fmt"
+
+// maxExampleMessages caps the few-shot examples of one conversation, which are
+// sent with every request and so cost tokens on every turn.
+const maxExampleMessages = 20
+
+// validateExamples checks few-shot examples set with an "examples" message:
+// pairs of a user message and the assistant's answer to it, in that order.
+func validateExamples(examples []Message) error {
+	if len(examples) > maxExampleMessages {
+		return fmt.Errorf("too many examples (%d messages, the limit is %d)", len(examples), maxExampleMessages)
+	}
+	if len(examples)%2 != 0 {
+		return fmt.Errorf("examples must be pairs of a user message and an assistant reply")
+	}
+	for i, m := range examples {
+		want := "user"
+		if i%2 == 1 {
+			want = "assistant"
+		}
+		if m.Role != want {
+			return fmt.Errorf("examples[%d] must be a %s message, not %q", i, want, m.Role)
+		}
+		if m.Content == "" {
+			return fmt.Errorf("examples[%d] is empty", i)
+		}
+		if len(m.Content) > maxMessageBytes {
+			return fmt.Errorf("examples[%d] is too long (%d bytes, the limit is %d)", i, len(m.Content), maxMessageBytes)
+		}
+	}
+	return nil
+}
+
+// SetExamples replaces the conversation's few-shot examples; none clears them.
+func (c *Conversation) SetExamples(examples []Message) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.examples = make([]Message, len(examples))
+	for i, m := range examples {
+		c.examples[i] = Message{Role: m.Role, Content: m.Content}
+	}
+}
+
+// Examples returns a copy of the conversation's few-shot examples.
+func (c *Conversation) Examples() []Message {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]Message(nil), c.examples...)
+}
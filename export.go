@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// ConversationExport is the JSON export of one conversation.
+type ConversationExport struct {
+	ConversationSummary
+	Messages []Message `json:"messages"`
+}
+
+// conversationLister returns the store as a ConversationLister, or nil if the
+// store doesn't keep conversations persistently.
+func conversationLister() ConversationLister {
+	lister, _ := store.(ConversationLister)
+	return lister
+}
+
+// handleListConversations lists the stored conversations, most recently updated first.
+func handleListConversations(c *fiber.Ctx) error {
+	lister := conversationLister()
+	if lister == nil {
+		return apiError(c, fiber.StatusNotImplemented, "listing conversations needs a persistent store (STORE=sqlite)")
+	}
+	list, err := lister.ListConversations(c.Context())
+	if err != nil {
+		requestLogger(c).Error("error listing conversations", "err", err)
+		return apiError(c, fiber.StatusInternalServerError, "error listing conversations")
+	}
+	if list == nil {
+		list = []ConversationSummary{}
+	}
+	return c.JSON(fiber.Map{"conversations": list})
+}
+
+// handleExportConversation downloads one conversation as JSON (the default) or
+// as Markdown with ?format=markdown.
+func handleExportConversation(c *fiber.Ctx) error {
+	format := c.Query("format", "json")
+	if format != "json" && format != "markdown" {
+		return apiError(c, fiber.StatusBadRequest, fmt.Sprintf("unknown format %q (use json or markdown)", format))
+	}
+	lister := conversationLister()
+	if lister == nil {
+		return apiError(c, fiber.StatusNotImplemented, "exporting conversations needs a persistent store (STORE=sqlite)")
+	}
+	id := c.Params("id")
+	sum, err := lister.GetConversation(c.Context(), id)
+	if err == nil {
+		var msgs []Message
+		msgs, err = store.LoadMessages(c.Context(), id)
+		if err == nil {
+			export := ConversationExport{ConversationSummary: sum, Messages: msgs}
+			return sendExport(c, format, export)
+		}
+	}
+	if errors.Is(err, ErrConversationNotFound) {
+		return apiError(c, fiber.StatusNotFound, "unknown conversation")
+	}
+	requestLogger(c).Error("error exporting conversation", "conversation_id", id, "err", err)
+	return apiError(c, fiber.StatusInternalServerError, "error exporting conversation")
+}
+
+// sendExport writes the export as a file download in the given format.
+func sendExport(c *fiber.Ctx, format string, export ConversationExport) error {
+	if export.Messages == nil {
+		export.Messages = []Message{}
+	}
+	if format == "markdown" {
+		c.Attachment("conversation-" + export.ID + ".md")
+		c.Set(fiber.HeaderContentType, "text/markdown; charset=utf-8")
+		return c.SendString(exportMarkdown(export))
+	}
+	c.Attachment("conversation-" + export.ID + ".json")
+	return c.JSON(export)
+}
+
+// exportMarkdown renders a conversation with a header per turn.
+func exportMarkdown(export ConversationExport) string {
+	var b strings.Builder
+	title := export.Title
+	if title == "" {
+		title = "Conversation " + export.ID
+	}
+	fmt.Fprintf(&b, "# %s\n\n", title)
+	fmt.Fprintf(&b, "_Started %s_\n", export.CreatedAt.UTC().Format(time.RFC1123))
+	for _, m := range export.Messages {
+		fmt.Fprintf(&b, "\n## %s\n\n%s\n", roleHeader(m.Role), strings.TrimSpace(m.Content))
+	}
+	return b.String()
+}
+
+// roleHeader names a message's author for the Markdown export.
+func roleHeader(role string) string {
+	switch role {
+	case "user":
+		return "User"
+	case "assistant":
+		return "Assistant"
+	case "system":
+		return "System"
+	}
+	return role
+}
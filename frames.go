@@ -0,0 +1,76 @@
+package main
+
+import "encoding/json"
+
+// The server sends most updates as WebSocketMessage frames. Frames that carry
+// more than a piece of text have their own types, defined here.
+
+// UsageFrame reports the tokens one response used and the conversation's running total.
+// Estimated is true when the provider didn't report usage and the counts are approximations.
+// SystemFingerprint is the backend configuration OpenAI reported for the reply,
+// to tell whether replies generated with the same seed are comparable.
+type UsageFrame struct {
+	Type              string `json:"type"`
+	Prompt            int    `json:"prompt"`
+	Completion        int    `json:"completion"`
+	TotalPrompt       int    `json:"totalPrompt"`
+	TotalCompletion   int    `json:"totalCompletion"`
+	Estimated         bool   `json:"estimated,omitempty"`
+	SystemFingerprint string `json:"systemFingerprint,omitempty"`
+	ConversationID    string `json:"conversationId,omitempty"`
+}
+
+// ToolCallFrame tells the client the model called a tool.
+// Arguments is the JSON-encoded argument object exactly as the model produced it.
+type ToolCallFrame struct {
+	Type           string `json:"type"`
+	ID             string `json:"id"`
+	Name           string `json:"name"`
+	Arguments      string `json:"arguments"`
+	ConversationID string `json:"conversationId,omitempty"`
+}
+
+// ToolResultFrame reports the result of a tool the server ran itself.
+type ToolResultFrame struct {
+	Type           string `json:"type"`
+	ID             string `json:"id"`
+	Name           string `json:"name"`
+	Result         string `json:"result"`
+	ConversationID string `json:"conversationId,omitempty"`
+}
+
+// TruncatedFrame tells the client a reply was cut off, either because it took
+// longer than GENERATION_TIMEOUT ("timeout"), streamed more than
+// MAX_RESPONSE_TOKENS tokens ("max_tokens") or the model stopped at its
+// max_tokens limit ("length"). A "continue" message asks for the rest.
+type TruncatedFrame struct {
+	Type           string `json:"type"`
+	Reason         string `json:"reason"`
+	ConversationID string `json:"conversationId,omitempty"`
+}
+
+// JSONFrame carries a finished reply generated in JSON mode, once it has been
+// checked to be valid JSON.
+type JSONFrame struct {
+	Type           string          `json:"type"`
+	Data           json.RawMessage `json:"data"`
+	ConversationID string          `json:"conversationId,omitempty"`
+}
+
+// ChoiceFrame streams text of one of several alternative replies to the same
+// message (n > 1), for the client to show side by side. Index 0 is the reply
+// kept in the conversation.
+type ChoiceFrame struct {
+	Type           string `json:"type"`
+	Index          int    `json:"index"`
+	Text           string `json:"text"`
+	ConversationID string `json:"conversationId,omitempty"`
+}
+
+// HTMLFrame carries a finished reply rendered from Markdown to sanitized HTML,
+// for the frontend to swap in place of the streamed text.
+type HTMLFrame struct {
+	Type           string `json:"type"`
+	Content        string `json:"content"`
+	ConversationID string `json:"conversationId,omitempty"`
+}
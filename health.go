@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Upstream checks use a short timeout and their result is cached for a while,
+// so probes running every few seconds don't hammer OpenAI.
+const (
+	upstreamCheckTimeout = 3 * time.Second
+	upstreamCheckTTL     = 15 * time.Second
+)
+
+// checkUpstreamOnReady enables pinging the provider from /readyz.
+// It is read from the READYZ_CHECK_UPSTREAM environment variable.
+var checkUpstreamOnReady bool
+
+// upstreamStatus caches the result of the last provider reachability check.
+type upstreamStatus struct {
+	mu        sync.Mutex
+	checkedAt time.Time
+	err       error
+}
+
+var upstream upstreamStatus
+
+// check returns the cached result if it is still fresh, otherwise it pings the provider again.
+func (u *upstreamStatus) check(ctx context.Context, p Pinger) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if !u.checkedAt.IsZero() && time.Since(u.checkedAt) < upstreamCheckTTL {
+		return u.err
+	}
+	ctx, cancel := context.WithTimeout(ctx, upstreamCheckTimeout)
+	defer cancel()
+	u.err = p.Ping(ctx)
+	u.checkedAt = time.Now()
+	return u.err
+}
+
+// handleHealthz is the liveness probe: if the server can answer, it is alive.
+func handleHealthz(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{"status": "ok"})
+}
+
+// handleReadyz is the readiness probe.
+// It checks that a provider is configured and, optionally, that it is reachable.
+// Providers that can't be pinged are only checked for configuration.
+func handleReadyz(c *fiber.Ctx) error {
+	if llm == nil {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+			"status": "unavailable",
+			"reason": "no LLM provider is configured",
+		})
+	}
+	if err := checkConfig(llm); err != nil {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+			"status": "unavailable",
+			"reason": err.Error(),
+		})
+	}
+	if pinger, ok := llm.(Pinger); ok && checkUpstreamOnReady {
+		if err := upstream.check(c.Context(), pinger); err != nil {
+			return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+				"status": "unavailable",
+				"reason": "provider is unreachable: " + err.Error(),
+			})
+		}
+	}
+	return c.JSON(fiber.Map{"status": "ready"})
+}
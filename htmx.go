@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"strings"
+)
+
+// Frame formats. With FRAME_FORMAT=htmx frames are HTML fragments that htmx's
+// WebSocket extension swaps into the page out of band, so a page can show the
+// chat without any JavaScript of its own. See the README for the elements
+// the fragments target.
+const (
+	frameFormatJSON = "json"
+	frameFormatHTMX = "htmx"
+)
+
+var frameFormat = frameFormatJSON
+
+// IDs of the elements htmx fragments target.
+const (
+	htmxMessagesID = "messages"
+	htmxStatusID   = "chat-status"
+)
+
+// htmxEncoder turns one connection's frames into HTML fragments. Each reply
+// gets its own bubble, appended to #messages, whose ID the encoder remembers
+// so the reply's text frames can be appended to it. It is only used under
+// the connection's write lock.
+type htmxEncoder struct {
+	next int
+	// replies holds the bubble of each conversation's latest reply, and
+	// whether it is still streaming.
+	replies map[string]*htmxReply
+}
+
+type htmxReply struct {
+	id        string
+	streaming bool
+}
+
+func newHTMXEncoder() *htmxEncoder {
+	return &htmxEncoder{replies: make(map[string]*htmxReply)}
+}
+
+// Encode returns the fragment for a frame. Frames that have no place on the
+// page (usage, titles, tool calls, ...) report false and aren't sent.
+func (e *htmxEncoder) Encode(v interface{}) (string, bool) {
+	switch f := v.(type) {
+	case WebSocketMessage:
+		switch {
+		case f.Role == "assistant":
+			// A reply resumed after a reconnect arrives without a "start".
+			var open string
+			reply := e.replies[f.ConversationID]
+			if reply == nil || !reply.streaming {
+				open, reply = e.open(f.ConversationID)
+			}
+			return open + oob(reply.id, "beforeend", "<span>"+html.EscapeString(f.Text)+"</span>"), true
+		case f.Role == "user":
+			return appendMessage("user", f.Text), true
+		case f.Type == "start":
+			// A continued reply keeps streaming into its bubble.
+			if reply := e.replies[f.ConversationID]; reply != nil && f.Offset > 0 {
+				reply.streaming = true
+				return status("streaming"), true
+			}
+			open, _ := e.open(f.ConversationID)
+			return open + status("streaming"), true
+		case f.Type == "done":
+			if reply := e.replies[f.ConversationID]; reply != nil {
+				reply.streaming = false
+			}
+			return status("idle"), true
+		case f.Type == "error" || f.Type == "warning" || f.Type == "info" || f.Type == "restart":
+			return appendMessage(f.Type, f.Text), true
+		case f.Type == "budget_exceeded":
+			return appendMessage("error", f.Text), true
+		}
+	case HTMLFrame:
+		// The rendered reply replaces its streamed text. It is sanitized already.
+		if reply := e.replies[f.ConversationID]; reply != nil {
+			return oob(reply.id, "innerHTML", f.Content), true
+		}
+	case TruncatedFrame:
+		return appendMessage("warning", fmt.Sprintf("the reply was cut off (%s)", f.Reason)), true
+	}
+	return "", false
+}
+
+// open starts a new reply bubble in the conversation and returns the fragment
+// that adds it to the page.
+func (e *htmxEncoder) open(conversationID string) (string, *htmxReply) {
+	e.next++
+	reply := &htmxReply{id: fmt.Sprintf("reply-%d", e.next), streaming: true}
+	e.replies[conversationID] = reply
+	bubble := fmt.Sprintf(`<div id="%s" class="message assistant" data-conversation-id="%s"></div>`,
+		reply.id, html.EscapeString(conversationID))
+	return oob(htmxMessagesID, "beforeend", bubble), reply
+}
+
+// oob wraps content in an element that htmx swaps into the element with the given ID.
+func oob(id, swap, content string) string {
+	return fmt.Sprintf(`<div id="%s" hx-swap-oob="%s">%s</div>`, id, swap, content)
+}
+
+// appendMessage returns the fragment that appends a message of the given kind
+// (user, error, warning, ...) to #messages.
+func appendMessage(kind, text string) string {
+	return oob(htmxMessagesID, "beforeend",
+		fmt.Sprintf(`<div class="message %s">%s</div>`, kind, strings.ReplaceAll(html.EscapeString(text), "\n", "<br>")))
+}
+
+// status returns the fragment that replaces #chat-status, whose data-state is
+// "streaming" while a reply is generated and "idle" once it is done.
+func status(state string) string {
+	return fmt.Sprintf(`<div id="%s" hx-swap-oob="true" data-state="%s"></div>`, htmxStatusID, state)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Defaults for the Idempotency-Key cache of POST /api/chat.
+// They can be overridden with IDEMPOTENCY_CACHE_SIZE and IDEMPOTENCY_TTL.
+const (
+	defaultIdempotencyCacheSize = 1000
+	defaultIdempotencyTTL       = 10 * time.Minute
+)
+
+// idempotentResponse is the response to one idempotency key. fingerprint is
+// the hash of the request body it answers. done is closed, and finished set,
+// once status and body are set.
+type idempotentResponse struct {
+	key         string
+	fingerprint [sha256.Size]byte
+	done        chan struct{}
+	finished    bool
+	status      int
+	body        []byte
+	expires     time.Time
+}
+
+// errIdempotencyKeyReused is returned by Begin for a key that was sent with
+// a different request body.
+var errIdempotencyKeyReused = errors.New("Idempotency-Key was already used with a different request")
+
+// IdempotencyCache remembers responses by Idempotency-Key, so a client can
+// retry a request without paying for a second upstream call. It is an LRU
+// cache: once full, the least recently used key is forgotten. Keys whose
+// response is still being produced are never forgotten, so the cache can
+// briefly hold more than size keys.
+type IdempotencyCache struct {
+	size int
+	ttl  time.Duration
+
+	mu   sync.Mutex
+	keys map[string]*list.Element
+	// lru holds *idempotentResponse values, most recently used first.
+	lru *list.List
+}
+
+// NewIdempotencyCache creates a cache holding up to size keys for ttl each.
+func NewIdempotencyCache(size int, ttl time.Duration) *IdempotencyCache {
+	return &IdempotencyCache{
+		size: size,
+		ttl:  ttl,
+		keys: make(map[string]*list.Element),
+		lru:  list.New(),
+	}
+}
+
+// Begin looks up key for a request whose body hashes to fingerprint. If a
+// response for it is cached or still being produced, Begin returns it with
+// owner false; the caller waits on its done channel and replays it. If that
+// response is for a different body, Begin returns errIdempotencyKeyReused.
+// Otherwise a new entry is reserved and owner is true: the caller must
+// produce the response and pass it to Finish.
+func (c *IdempotencyCache) Begin(key string, fingerprint [sha256.Size]byte) (resp *idempotentResponse, owner bool, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.keys[key]; ok {
+		resp = elem.Value.(*idempotentResponse)
+		if !resp.finished || time.Now().Before(resp.expires) {
+			if resp.fingerprint != fingerprint {
+				return nil, false, errIdempotencyKeyReused
+			}
+			c.lru.MoveToFront(elem)
+			return resp, false, nil
+		}
+		c.remove(elem)
+	}
+
+	resp = &idempotentResponse{key: key, fingerprint: fingerprint, done: make(chan struct{})}
+	c.keys[key] = c.lru.PushFront(resp)
+	c.evict()
+	return resp, true, nil
+}
+
+// Finish stores the response for an entry reserved by Begin and wakes up any
+// requests waiting for it. Only successful responses are kept for later
+// retries; after a failure a retry should try again.
+func (c *IdempotencyCache) Finish(resp *idempotentResponse, status int, body []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	resp.status = status
+	resp.body = body
+	resp.expires = time.Now().Add(c.ttl)
+	resp.finished = true
+	close(resp.done)
+	if status < 200 || status > 299 {
+		if elem, ok := c.keys[resp.key]; ok && elem.Value == resp {
+			c.remove(elem)
+		}
+	}
+	c.evict()
+}
+
+// evict forgets the least recently used finished responses until the cache
+// holds at most size keys, or only pending ones are left over. The caller
+// must hold c.mu.
+func (c *IdempotencyCache) evict() {
+	for elem := c.lru.Back(); elem != nil && c.lru.Len() > c.size; {
+		prev := elem.Prev()
+		if elem.Value.(*idempotentResponse).finished {
+			c.remove(elem)
+		}
+		elem = prev
+	}
+}
+
+// remove deletes an entry. The caller must hold c.mu.
+func (c *IdempotencyCache) remove(elem *list.Element) {
+	c.lru.Remove(elem)
+	delete(c.keys, elem.Value.(*idempotentResponse).key)
+}
+
+// idempotencyKey scopes the Idempotency-Key of c to its sender, a hash of
+// the token it authenticated with or else its IP, so one client can't get
+// the response meant for another by sending the same key.
+func idempotencyKey(c *fiber.Ctx, key string) string {
+	if token, _ := c.Locals(authTokenKey).(string); token != "" {
+		sum := sha256.Sum256([]byte(token))
+		return "token:" + hex.EncodeToString(sum[:]) + "\x00" + key
+	}
+	return "ip:" + c.IP() + "\x00" + key
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestIdempotencyCacheReplay(t *testing.T) {
+	c := NewIdempotencyCache(10, time.Minute)
+	body := sha256.Sum256([]byte(`{"messages":[]}`))
+	first, owner, err := c.Begin("k", body)
+	if err != nil || !owner {
+		t.Fatalf("first Begin = owner %v, err %v; want owner", owner, err)
+	}
+	c.Finish(first, 200, []byte("reply"))
+	again, owner, err := c.Begin("k", body)
+	if err != nil || owner || again != first {
+		t.Fatalf("second Begin = owner %v, err %v; want the cached response", owner, err)
+	}
+	if _, _, err := c.Begin("k", sha256.Sum256([]byte(`{"messages":[1]}`))); !errors.Is(err, errIdempotencyKeyReused) {
+		t.Errorf("Begin with another body: err = %v, want errIdempotencyKeyReused", err)
+	}
+}
+
+func TestIdempotencyCacheMismatchWhilePending(t *testing.T) {
+	c := NewIdempotencyCache(10, time.Minute)
+	c.Begin("k", sha256.Sum256([]byte("a")))
+	if _, _, err := c.Begin("k", sha256.Sum256([]byte("b"))); !errors.Is(err, errIdempotencyKeyReused) {
+		t.Errorf("err = %v, want errIdempotencyKeyReused", err)
+	}
+}
+
+func TestIdempotencyCacheKeepsPending(t *testing.T) {
+	c := NewIdempotencyCache(2, time.Minute)
+	body := sha256.Sum256(nil)
+	pending, _, _ := c.Begin("pending", body)
+	done, _, _ := c.Begin("done", body)
+	c.Finish(done, 200, nil)
+	// The cache is full: the finished entry goes, although the pending one is older.
+	c.Begin("new", body)
+	if _, owner, _ := c.Begin("pending", body); owner {
+		t.Error("the pending entry was evicted")
+	}
+	if _, owner, _ := c.Begin("done", body); !owner {
+		t.Error("the finished entry was kept over the limit")
+	}
+	// With only pending entries left, the cache grows past its size rather
+	// than forgetting one; they are evicted once finished.
+	if c.lru.Len() != 3 {
+		t.Errorf("cache holds %d keys, want 3 pending", c.lru.Len())
+	}
+	c.Finish(pending, 200, nil)
+	if c.lru.Len() != 2 {
+		t.Errorf("cache holds %d keys after a finish, want 2", c.lru.Len())
+	}
+}
+
+func TestHandleChatAPIIdempotency(t *testing.T) {
+	savedLLM, savedTokens, savedCache := llm, authTokens, idempotencyCache
+	defer func() { llm, authTokens, idempotencyCache = savedLLM, savedTokens, savedCache }()
+	llm = &MockProvider{Text: "Hello there"}
+	authTokens = []string{"alice", "bob"}
+	idempotencyCache = NewIdempotencyCache(10, time.Minute)
+
+	app := fiber.New()
+	app.Post("/api/chat", requireAuth, handleChatAPI)
+	post := func(token, key, body string) (int, bool) {
+		t.Helper()
+		req := httptest.NewRequest("POST", "/api/chat", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Idempotency-Key", key)
+		resp, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, resp.Header.Get("Idempotent-Replayed") == "true"
+	}
+	body := `{"messages":[{"role":"user","content":"Hi"}]}`
+
+	if status, replayed := post("alice", "k1", body); status != 200 || replayed {
+		t.Fatalf("first request: status %d, replayed %v", status, replayed)
+	}
+	if status, replayed := post("alice", "k1", body); status != 200 || !replayed {
+		t.Errorf("retry: status %d, replayed %v; want a replay", status, replayed)
+	}
+	if status, replayed := post("bob", "k1", body); status != 200 || replayed {
+		t.Errorf("same key from another token: status %d, replayed %v; want a new completion", status, replayed)
+	}
+	if status, _ := post("alice", "k1", `{"messages":[{"role":"user","content":"Something else"}]}`); status != fiber.StatusUnprocessableEntity {
+		t.Errorf("same key with another body: status %d, want 422", status)
+	}
+}
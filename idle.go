@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/gofiber/websocket/v2"
+)
+
+// idleTimeout closes connections that haven't sent a message for this long
+// (IDLE_TIMEOUT); 0 disables it.
+var idleTimeout time.Duration
+
+// idleWarningLead is how long before an idle connection is closed the client
+// is warned, so it can send a message to keep the connection open.
+const idleWarningLead = 30 * time.Second
+
+// startIdleTimer closes the client's connection once no message has arrived
+// for idleTimeout, after warning it shortly before. Closing the connection
+// makes the read loop fail, which deregisters the client as usual.
+// A connection with a response still streaming is never considered idle.
+// reset must be called after every message read.
+func startIdleTimer(ctx context.Context, client *Client) (reset func()) {
+	if idleTimeout <= 0 {
+		return func() {}
+	}
+	lead := idleWarningLead
+	if lead > idleTimeout/2 {
+		lead = idleTimeout / 2
+	}
+	activity := make(chan struct{}, 1)
+
+	go func() {
+		timer := time.NewTimer(idleTimeout - lead)
+		defer timer.Stop()
+		restart := func(d time.Duration) {
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(d)
+		}
+		warned := false
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-activity:
+				warned = false
+				restart(idleTimeout - lead)
+			case <-timer.C:
+				switch {
+				case client.Generating():
+					warned = false
+					timer.Reset(idleTimeout - lead)
+				case !warned:
+					warned = true
+					client.WriteJSON(WebSocketMessage{
+						Type: "warning",
+						Text: fmt.Sprintf("closing this idle connection in %s unless a message arrives", lead),
+					})
+					timer.Reset(lead)
+				default:
+					loggerFrom(ctx).Info("closing idle connection", "idle_timeout", idleTimeout)
+					client.Close(websocket.CloseNormalClosure, "idle timeout")
+					return
+				}
+			}
+		}
+	}()
+
+	return func() {
+		select {
+		case activity <- struct{}{}:
+		default:
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Response format types. "text" is the default and turns JSON mode off again.
+const (
+	responseFormatText       = "text"
+	responseFormatJSONObject = "json_object"
+	responseFormatJSONSchema = "json_schema"
+)
+
+// ResponseFormat asks the model for JSON output: any JSON object with
+// "json_object", or JSON matching a schema with "json_schema". JSONSchema is
+// passed to OpenAI unchanged, e.g. {"name":"person","schema":{...},"strict":true}.
+type ResponseFormat struct {
+	Type       string          `json:"type"`
+	JSONSchema json.RawMessage `json:"json_schema,omitempty"`
+}
+
+// jsonModels lists the models that support JSON mode, and whether they also
+// support JSON schemas.
+var jsonModels = map[string]bool{
+	"gpt-4o-mini":   true,
+	"gpt-4o":        true,
+	"gpt-4-turbo":   false,
+	"gpt-3.5-turbo": false,
+}
+
+// Validate checks that the format is one OpenAI accepts.
+func (f *ResponseFormat) Validate() error {
+	switch f.Type {
+	case responseFormatText, responseFormatJSONObject:
+		if len(f.JSONSchema) > 0 {
+			return fmt.Errorf("response_format.json_schema is only allowed with type %q", responseFormatJSONSchema)
+		}
+	case responseFormatJSONSchema:
+		var schema map[string]interface{}
+		if err := json.Unmarshal(f.JSONSchema, &schema); err != nil || schema == nil {
+			return fmt.Errorf("response_format.json_schema must be an object")
+		}
+	default:
+		return fmt.Errorf("response_format.type must be text, json_object or json_schema, got %q", f.Type)
+	}
+	return nil
+}
+
+// JSONMode reports whether the format asks for JSON output.
+func (f *ResponseFormat) JSONMode() bool {
+	return f != nil && f.Type != responseFormatText
+}
+
+// checkResponseFormat returns an error if model can't produce the format.
+func checkResponseFormat(model string, f *ResponseFormat) error {
+	if !f.JSONMode() {
+		return nil
+	}
+	schemas, ok := jsonModels[model]
+	if !ok {
+		return fmt.Errorf("model %q does not support JSON mode", model)
+	}
+	if f.Type == responseFormatJSONSchema && !schemas {
+		return fmt.Errorf("model %q does not support JSON schemas", model)
+	}
+	return nil
+}
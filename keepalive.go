@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/gofiber/websocket/v2"
+)
+
+// Default keepalive settings; an interval of 0 disables pings.
+// They can be overridden with PING_INTERVAL and PONG_TIMEOUT.
+const (
+	defaultPingInterval = 30 * time.Second
+	defaultPongTimeout  = 60 * time.Second
+)
+
+// pingInterval is how often idle connections are pinged, and pongTimeout how
+// long a connection may stay silent (no pong, no message) before it is dropped.
+var (
+	pingInterval = defaultPingInterval
+	pongTimeout  = defaultPongTimeout
+)
+
+// startKeepAlive pings the client every pingInterval until ctx is done, and
+// makes reads fail once nothing, not even a pong, has arrived for pongTimeout.
+// Without it, a connection silently dropped by a load balancer would block in
+// ReadJSON forever and never be removed from the registry.
+// extend must be called after every message read to push the deadline back.
+func startKeepAlive(ctx context.Context, c *websocket.Conn) (extend func()) {
+	if pingInterval <= 0 {
+		return func() {}
+	}
+	extend = func() {
+		c.SetReadDeadline(time.Now().Add(pongTimeout))
+	}
+	extend()
+	c.SetPongHandler(func(string) error {
+		extend()
+		return nil
+	})
+
+	go func() {
+		ticker := time.NewTicker(pingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				// WriteControl may be called concurrently with the other writers.
+				if err := c.WriteControl(websocket.PingMessage, nil, time.Now().Add(time.Second)); err != nil {
+					loggerFrom(ctx).Debug("ping failed", "err", err)
+					return
+				}
+			}
+		}
+	}()
+	return extend
+}
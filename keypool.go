@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// keyCooldown is how long a key is skipped after OpenAI rejected it (401) or
+// rate limited it (429).
+const keyCooldown = time.Minute
+
+// KeyPool hands out the API keys of OPENAI_API_KEYS in turn, one per
+// request, skipping keys that are cooling down. It is safe for concurrent use.
+type KeyPool struct {
+	mu   sync.Mutex
+	keys []string
+	// until holds the end of each key's cooldown; zero if it has none.
+	until []time.Time
+	next  int
+}
+
+// openAIKeys is the pool of OPENAI_API_KEYS, shared by the openai provider
+// and the moderator so both skip the same rejected keys; nil means both use
+// OPENAI_API_KEY.
+var openAIKeys *KeyPool
+
+// newKeyPool returns a pool of keys, or nil if there are none.
+func newKeyPool(keys []string) *KeyPool {
+	if len(keys) == 0 {
+		return nil
+	}
+	return &KeyPool{keys: keys, until: make([]time.Time, len(keys))}
+}
+
+// Next returns the next key that isn't cooling down. If all of them are, it
+// returns the one whose cooldown ends first rather than failing the request.
+func (p *KeyPool) Next() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	best := -1
+	for i := range p.keys {
+		k := (p.next + i) % len(p.keys)
+		if !p.until[k].After(now) {
+			best = k
+			break
+		}
+		if best < 0 || p.until[k].Before(p.until[best]) {
+			best = k
+		}
+	}
+	p.next = (best + 1) % len(p.keys)
+	return p.keys[best]
+}
+
+// Available reports how many keys aren't cooling down.
+func (p *KeyPool) Available() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	n := 0
+	for _, until := range p.until {
+		if !until.After(now) {
+			n++
+		}
+	}
+	return n
+}
+
+// MarkUnavailable starts key's cooldown.
+func (p *KeyPool) MarkUnavailable(key string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, k := range p.keys {
+		if k == key {
+			p.until[i] = time.Now().Add(keyCooldown)
+		}
+	}
+}
+
+// isKeyRejection reports whether a status code means the key itself can't be
+// used right now, so another key is worth trying.
+func isKeyRejection(code int) bool {
+	return code == http.StatusUnauthorized || code == http.StatusTooManyRequests
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// setupLogger configures the default structured logger.
+// format is text (the default) or json.
+func setupLogger(level slog.Level, format string) {
+	opts := &slog.HandlerOptions{Level: level}
+
+	var handler slog.Handler
+	if strings.EqualFold(format, "json") {
+		handler = slog.NewJSONHandler(os.Stdout, opts)
+	} else {
+		handler = slog.NewTextHandler(os.Stdout, opts)
+	}
+	slog.SetDefault(slog.New(handler))
+}
+
+// loggerKey is the context key for a request- or connection-scoped logger.
+type loggerKey struct{}
+
+// withLogger returns a copy of ctx that carries logger.
+// Code further down the call chain (e.g. providers) picks it up with loggerFrom,
+// so its log lines include the same correlation ID.
+func withLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// loggerFrom returns the logger stored in ctx, or the default logger if there is none.
+func loggerFrom(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
@@ -0,0 +1,40 @@
+package main
+
+import "fmt"
+
+// maxTopLogprobs is the most alternatives per token OpenAI reports.
+const maxTopLogprobs = 20
+
+// logprobsModels lists the models that can report token log probabilities.
+var logprobsModels = map[string]bool{
+	"gpt-4o-mini":   true,
+	"gpt-4o":        true,
+	"gpt-4-turbo":   true,
+	"gpt-3.5-turbo": true,
+}
+
+// TokenLogprob is the log probability of one streamed token and, with
+// top_logprobs, of the most likely alternatives. It is decoded from OpenAI's
+// stream and sent on to the client as is.
+type TokenLogprob struct {
+	Token       string       `json:"token"`
+	Logprob     float64      `json:"logprob"`
+	TopLogprobs []TopLogprob `json:"top_logprobs,omitempty"`
+}
+
+// TopLogprob is an alternative the model considered for a token.
+type TopLogprob struct {
+	Token   string  `json:"token"`
+	Logprob float64 `json:"logprob"`
+}
+
+// checkLogprobs returns an error if p asks for log probabilities model can't report.
+func checkLogprobs(model string, p GenerationParams) error {
+	if p.TopLogprobs != nil && !p.WantsLogprobs() {
+		return fmt.Errorf("top_logprobs needs logprobs to be true")
+	}
+	if p.WantsLogprobs() && !logprobsModels[model] {
+		return fmt.Errorf("model %q does not report logprobs", model)
+	}
+	return nil
+}
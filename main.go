@@ -6,199 +6,1392 @@ package main
 // 2. Import statements
 // These import external packages that this program will use.
 import (
-	"bufio"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
 	"github.com/gofiber/websocket/v2"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 // 3. Constants
-// This defines a constant for the OpenAI API URL.
 // Constants in Go are declared using the 'const' keyword.
-const openAIURL = "https://api.openai.com/v1/chat/completions"
+// The provider-specific API URLs live next to each provider (see openai.go and anthropic.go).
+
+// defaultOpenAITimeout bounds a whole OpenAI request, including reading the stream.
+// It can be overridden with the OPENAI_TIMEOUT environment variable (e.g. "90s").
+const defaultOpenAITimeout = 2 * time.Minute
+
+// defaultMaxMessageBytes is the default size limit for the text of one message.
+// It can be overridden with the MAX_MESSAGE_BYTES environment variable.
+const defaultMaxMessageBytes = 32 * 1024
+
+// maxMessageBytes is the configured size limit for the text of one message.
+var maxMessageBytes = defaultMaxMessageBytes
+
+// defaultGenerationTimeout caps how long one response may take, tool calls included.
+// It can be overridden with the GENERATION_TIMEOUT environment variable (0 disables it).
+const defaultGenerationTimeout = 5 * time.Minute
+
+// generationTimeout and maxResponseTokens bound the cost of a single response.
+// maxResponseTokens (MAX_RESPONSE_TOKENS) is the number of tokens streamed to
+// the client before the response is cut off; 0 means no limit.
+var (
+	generationTimeout = defaultGenerationTimeout
+	maxResponseTokens int
+)
+
+// continuePrompt follows a reply that was cut off when the client asks for
+// the rest of it with a "continue" message. It isn't kept in the history.
+const continuePrompt = "Your last reply was cut off. Continue it exactly where it stopped, without repeating anything or adding an introduction."
 
 // 4. Global variables
-// This declares a global variable to store the OpenAI API key.
 // In Go, variables declared outside of functions are package-level variables.
-var openAIKey string
+// llm is the provider that generates replies, selected by the LLM_PROVIDER environment variable.
+var llm Provider
+
+// defaultModel is used when the client does not pick a model or picks one that is not allowed.
+// Providers other than OpenAI replace it with one of their own models.
+var defaultModel = "gpt-4o-mini"
+
+// fallbackModel replaces the conversation's model for one response when the
+// model is rate limited or unavailable upstream. It is set by FALLBACK_MODEL and
+// may be empty.
+var fallbackModel string
+
+// defaultSystemPrompt seeds the system prompt of every new connection.
+// It is read from the DEFAULT_SYSTEM_PROMPT environment variable and may be empty.
+var defaultSystemPrompt string
+
+// welcomeMessage greets every new conversation as if the assistant had said
+// it, without calling the model (WELCOME_MESSAGE). With recordWelcomeMessage
+// it is also kept in the history, so the model sees it too.
+var (
+	welcomeMessage       string
+	recordWelcomeMessage bool
+)
+
+// allowedModels lists the models a client may select at runtime.
+// Requests for any other model are rejected so clients can't run up costs on arbitrary models.
+var allowedModels = map[string]bool{
+	"gpt-4o-mini":   true,
+	"gpt-4o":        true,
+	"gpt-4-turbo":   true,
+	"gpt-3.5-turbo": true,
+	"o1":            true,
+	"o1-mini":       true,
+	"o3-mini":       true,
+}
 
 // 5. Struct definitions
 // Structs in Go are used to create custom data types.
 // The `json` tags are used for JSON marshaling and unmarshaling.
 
 // Message represents a single message in the chat.
+// Assistant messages that call tools carry ToolCalls, and the "tool" messages
+// answering them carry the ToolCallID they answer.
 type Message struct {
-	Role    string `json:"role"`
-	Content string `json:"content"`
-}
-
-// OpenAIRequest represents the structure of a request to the OpenAI API.
-type OpenAIRequest struct {
-	Model    string    `json:"model"`
-	Messages []Message `json:"messages"`
-	Stream   bool      `json:"stream"`
-}
-
-// OpenAIResponse represents the structure of a response from the OpenAI API.
-type OpenAIResponse struct {
-	Choices []struct {
-		Delta struct {
-			Content string `json:"content"`
-		} `json:"delta"`
-	} `json:"choices"`
+	Role       string     `json:"role"`
+	Content    string     `json:"content"`
+	ToolCalls  []ToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string     `json:"tool_call_id,omitempty"`
+	// Parts holds the message as a content array when it has images. It is sent
+	// in place of Content (see MarshalJSON) and only kept in memory.
+	Parts []ContentPart `json:"-"`
 }
 
 // WebSocketMessage represents a message sent over WebSocket.
+// Type is optional: an empty type is a regular chat message, while "system"
+// sets the system prompt for the rest of the session. The server uses the
+// "error" type to report problems back to the client, and brackets every
+// response with a "start" frame when generation begins and a "done" frame at its end. A "stop" message aborts the response in progress.
+// Model optionally switches the model used for this and all following turns.
+// ConversationID says which conversation a message belongs to, so one
+// connection can serve several conversations at once (e.g. one per tab).
+// Untagged messages go to the conversation used last. A "new" message starts
+// another conversation. A "regenerate" message replaces the last reply with a
+// new one; its generation parameters apply to that response only. An "edit"
+// message replaces the user message at Index with Text, drops everything
+// after it and generates a new reply.
+// The server sends a "conversation" frame with the ID
+// whenever it attaches one, and tags every frame about a conversation with its ID.
+// The embedded GenerationParams (temperature, top_p, max_tokens, stop) update the
+// conversation's sampling settings; they persist until changed again.
+// A "tool_result" message answers the tool call with ID ToolCallID; its Text is the result.
+// A "resume" message, sent after reconnecting, asks for the rest of the latest
+// reply after Offset. An "examples" message sets the few-shot examples in
+// Messages, which every request sends after the system prompt. A "prefill"
+// message sets the text the next reply starts with. A "remember" message
+// stores the facts in Vars in the connection's memory, a "memory" message
+// asks for them and a "forget" message removes the fact Name, or all of them.
 type WebSocketMessage struct {
-	Text string `json:"text"`
+	Type string `json:"type,omitempty"`
+	// ID is an optional client-chosen message ID, echoed by the "ack" or
+	// "error" frame that answers the message.
+	ID string `json:"id,omitempty"`
+	// Role is set to "assistant" on the frames that stream a reply.
+	Role           string `json:"role,omitempty"`
+	Text           string `json:"text"`
+	Model          string `json:"model,omitempty"`
+	ConversationID string `json:"conversationId,omitempty"`
+	ToolCallID     string `json:"toolCallId,omitempty"`
+	Index          *int   `json:"index,omitempty"`
+	// Offset is the length in bytes of the reply streamed so far, sent with
+	// every reply frame; a "resume" message sends the last one received.
+	Offset int `json:"offset,omitempty"`
+	// Images attaches image URLs or base64 data URIs to a chat message.
+	Images []string `json:"images,omitempty"`
+	// Uploads adds files uploaded through POST /api/upload to the conversation's context.
+	Uploads []string `json:"uploads,omitempty"`
+	// Tokens has the log probabilities of a reply frame's tokens when the
+	// conversation asked for logprobs.
+	Tokens []TokenLogprob `json:"tokens,omitempty"`
+	// Reason is set on "done" frames to the finish reason of the reply: "stop",
+	// "length", "tool_calls" or "content_filter". It is empty if the stream
+	// ended without one, e.g. because the reply was stopped.
+	Reason string `json:"reason,omitempty"`
+	// Messages holds the examples of an "examples" message.
+	Messages []Message `json:"messages,omitempty"`
+	// Name and Vars pick the prompt template a "template" message fills in,
+	// and hold the facts of "remember" and "forget" messages.
+	Name string            `json:"name,omitempty"`
+	Vars map[string]string `json:"vars,omitempty"`
+	GenerationParams
 }
 
 // 6. More global variables
-// This creates a map to store active WebSocket connections.
+// This creates a registry to store active WebSocket connections,
+// and another one that keeps conversations in memory by ID.
+// The registry guards its map with a mutex, so it is safe to use from many goroutines.
 // The 'var' block allows declaring multiple variables together.
+// The HTTP client is shared by all requests so connections to OpenAI are reused.
 var (
-	clients = make(map[*websocket.Conn]bool)
+	registry      = NewClientRegistry(0)
+	conversations = NewConversationRegistry()
+	limiter       = NewRateLimiter(defaultMaxConnsPerIP, defaultMsgsPerMinute)
+	httpClient    = &http.Client{Timeout: defaultOpenAITimeout}
 )
 
 // 7. Main function
-// The main function is the entry point of the Go program.
+// The main function is the entry point of the Go program. A server that can't
+// start exits with status 1, so supervisors see the failure.
 func main() {
-	// 8. Environment variable retrieval
-	// os.Getenv retrieves the value of an environment variable.
-	openAIKey = os.Getenv("OPENAI_API_KEY")
-	if openAIKey == "" {
-		fmt.Println("Please set the OPENAI_API_KEY environment variable")
-		return
+	if err := run(); err != nil {
+		slog.Error("server failed", "err", err)
+		os.Exit(1)
+	}
+}
+
+// run starts the server and returns once it has shut down, or with the error
+// that kept it from starting or stopped it.
+func run() error {
+	// 8. Configuration
+	// All settings are read from the environment once, up front. Any problem
+	// stops the server right away, with every invalid setting listed.
+	cfg, err := LoadConfig()
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+	setupLogger(cfg.LogLevel, cfg.LogFormat)
+	defaultSystemPrompt = cfg.DefaultSystemPrompt
+	welcomeMessage = cfg.WelcomeMessage
+	recordWelcomeMessage = cfg.RecordWelcomeMessage
+	staticDir = cfg.StaticDir
+	staticAssetsPrefix = cfg.StaticAssetsPrefix
+	fallbackModel = cfg.FallbackModel
+	httpClient.Timeout = cfg.OpenAITimeout
+	httpClient.Transport, err = newHTTPTransport(cfg.LLMProxy, cfg.LLMCACerts, cfg.LLMInsecureSkipVerify)
+	if err != nil {
+		return fmt.Errorf("configuration error: %w", err)
+	}
+	maxRetries = cfg.MaxRetries
+	maxMessageBytes = cfg.MaxMessageBytes
+	maxImageBytes = cfg.MaxImageBytes
+	maxUploadBytes = cfg.MaxUploadBytes
+	apiMaxBodyBytes = cfg.APIMaxBodyBytes
+	apiMaxMessages = cfg.APIMaxMessages
+	apiMaxChars = cfg.APIMaxChars
+	apiTimeout = cfg.APITimeout
+	generationTimeout = cfg.GenerationTimeout
+	maxResponseTokens = cfg.MaxResponseTokens
+	messageQueueSize = cfg.MessageQueueSize
+	sendQueueSize = cfg.SendQueueSize
+	sendOverflow = cfg.SendQueueOverflow
+	latestMessageWins = cfg.LatestMessageWins
+	frameFormat = cfg.FrameFormat
+	fallbackContextBudget = cfg.DefaultContextBudget
+	contextStrategy = cfg.ContextStrategy
+	summarizeThreshold = cfg.SummarizeThreshold
+	summarizeTurns = cfg.SummarizeTurns
+	for model, budget := range cfg.ContextBudgets {
+		contextBudgets[model] = budget
+	}
+	tokenBudget = cfg.TokenBudget
+	costBudget = cfg.CostBudget
+	for model, price := range cfg.ModelPrices {
+		modelPrices[model] = price
+	}
+	prefillSticky = cfg.PrefillSticky
+	outputFilters = cfg.OutputFilters
+	if len(cfg.ProfanityWords) > 0 {
+		profanityWords = map[string]bool{}
+		for _, word := range cfg.ProfanityWords {
+			profanityWords[strings.ToLower(word)] = true
+		}
+	}
+	toolsEnabled = cfg.EnableTools
+	renderMarkdown = cfg.RenderMarkdown
+	generateTitles = cfg.GenerateTitles
+	corsOrigins = cfg.CORSOrigins
+	wsAllowedOrigins = cfg.WSAllowedOrigins
+	memoryMaxBytes = cfg.MemoryMaxBytes
+	memoryInPrompt = cfg.MemoryInPrompt
+	endUserSource = cfg.EndUserID
+	endUserSalt = cfg.EndUserSalt
+	authTokens = cfg.AuthTokens
+	streamChunkBytes = cfg.StreamChunkBytes
+	streamFlushInterval = cfg.StreamFlushInterval
+	streamCoalesceInterval = cfg.StreamCoalesceInterval
+	streamCoalesceBytes = cfg.StreamCoalesceBytes
+	resumeWindow = cfg.ResumeWindow
+	requireSubprotocol = cfg.WSRequireSubprotocol
+	setMaxConcurrentUpstream(cfg.MaxConcurrentUpstream)
+	upstreamWaitTimeout = cfg.UpstreamWaitTimeout
+	upstreamBreaker = newBreaker(cfg.BreakerFailures, cfg.BreakerCooldown)
+	pingInterval = cfg.PingInterval
+	pongTimeout = cfg.PongTimeout
+	idleTimeout = cfg.IdleTimeout
+	idempotencyCache = NewIdempotencyCache(cfg.IdempotencyCacheSize, cfg.IdempotencyTTL)
+	checkUpstreamOnReady = cfg.ReadyzCheckUpstream
+	limiter = NewRateLimiter(cfg.MaxConnsPerIP, cfg.MsgsPerMinute)
+	registry = NewClientRegistry(cfg.MaxConnections)
+	connectionWait = cfg.MaxConnectionsWait
+	debugLLM = cfg.DebugLLM
+	openAIKeys = newKeyPool(cfg.OpenAIKeys)
+	if cfg.Moderation {
+		m := newOpenAIModerator(cfg.OpenAIKey, cfg.OpenAIBaseURL, cfg.ModerationModel)
+		m.Keys = openAIKeys
+		moderator = m
 	}
+	moderationFailClosed = cfg.ModerationFailClosed
+	loadSecrets(cfg)
 
+	// Every exchange is appended to the audit log when AUDIT_LOG is set.
+	auditLog, err = OpenAuditLog(cfg.AuditLog, cfg.AuditHashContent)
+	if err != nil {
+		return fmt.Errorf("configuration error: %w", err)
+	}
+	defer auditLog.Close()
+	if err := loadModelParams(cfg.ModelParamsFile); err != nil {
+		return fmt.Errorf("configuration error: %w", err)
+	}
+	promptTemplates, err = loadTemplates(cfg.TemplatesDir)
+	if err != nil {
+		return fmt.Errorf("configuration error: %w", err)
+	}
+	llm, err = newProvider(cfg)
+	if err != nil {
+		return fmt.Errorf("configuration error: %w", err)
+	}
+	// Conversations are stored in SQLite unless STORE=memory is set.
+	store, err = newStore(cfg.Store, cfg.SQLitePath)
+	if err != nil {
+		return fmt.Errorf("error opening conversation store: %w", err)
+	}
+	// In room mode all connections share one conversation, opened once for the server's lifetime.
+	if cfg.RoomMode {
+		conv, _, err := conversations.Open(context.Background(), "")
+		if err != nil {
+			return fmt.Errorf("error creating the room's conversation: %w", err)
+		}
+		room = NewRoom(conv)
+		go room.ProcessQueue(context.Background())
+		slog.Info("room mode enabled", "conversation_id", conv.ID())
+	}
+
+	// 9.-11. The Fiber app with its middleware and routes; see newApp.
+	app := newApp(cfg)
+
+	// 12. Port configuration
+	// The port comes from the PORT environment variable (see LoadConfig) and defaults to 8080.
+
+	// 13. Start the server
+	// This starts the Fiber server on the specified port in the background,
+	// so main can wait for a shutdown signal at the same time.
+	slog.Info("server starting", "port", cfg.Port, "provider", cfg.Provider)
+	if cfg.MockLLM {
+		slog.Warn("MOCK_LLM is on: replies are canned and no provider is called")
+	}
+	listenErr := make(chan error, 1)
+	go func() {
+		listenErr <- app.Listen(":" + cfg.Port)
+	}()
+
+	// 14. Graceful shutdown
+	// Wait for Ctrl+C (SIGINT) or SIGTERM, then let in-flight responses finish,
+	// say goodbye to every client and stop the server within the timeout.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-listenErr:
+		return fmt.Errorf("server error: %w", err)
+	case <-signals:
+	}
+
+	shutdownTimeout := cfg.ShutdownTimeout
+	deadline := time.Now().Add(shutdownTimeout)
+	slog.Info("shutting down", "timeout", shutdownTimeout)
+	if !waitForStreams(shutdownTimeout) {
+		slog.Warn("timed out waiting for active responses")
+	}
+	closeAllClients("server shutting down")
+	if err := app.ShutdownWithTimeout(time.Until(deadline)); err != nil {
+		slog.Error("error during shutdown", "err", err)
+	}
+	return nil
+}
+
+// newApp creates the Fiber app with the server's middleware and routes. It
+// relies on the package settings main applies from cfg, and reads from cfg
+// only the settings used nowhere else.
+func newApp(cfg Config) *fiber.App {
 	// 9. Fiber app initialization
 	// This creates a new instance of the Fiber web framework.
-	app := fiber.New()
+	// Bodies are capped by the largest route limit (API_MAX_BODY_BYTES or an
+	// upload with its multipart envelope); Fiber answers bigger ones with 413.
+	app := fiber.New(fiber.Config{BodyLimit: bodyLimit()})
+	// Every request gets an X-Request-ID, which its log lines carry.
+	app.Use(handleRequestID)
+	// Cross-origin requests are only answered for the origins in CORS_ORIGINS.
+	if corsMiddleware := newCORSMiddleware(cfg.CORSMethods, cfg.CORSHeaders); corsMiddleware != nil {
+		app.Use(corsMiddleware)
+	}
+	// The frontend is served with a Content-Security-Policy and other hardening
+	// headers, unless SECURITY_HEADERS=false.
+	if cfg.SecurityHeaders {
+		app.Use(newSecurityHeaders(buildCSP(cfg.CSP, cfg.CSPConnectSrc)))
+	}
 
 	// 10. Static file serving
-	// This tells Fiber to serve static files from the "./static" directory.
-	app.Static("/", "./static")
+	// This tells Fiber to serve static files from STATIC_DIR ("./static" by default).
+	// API and WebSocket paths are skipped so a stray file can't shadow them.
+	app.Static("/", staticDir, fiber.Static{Next: func(c *fiber.Ctx) bool {
+		return isServerPath(c.Path())
+	}})
 
 	// 11. Route handlers
 	// These set up the routes for the web application.
 	app.Get("/", handleHome)
-	app.Get("/ws", websocket.New(handleWebSocket))
-
-	// 12. Port configuration
-	// This gets the port from an environment variable, or uses a default.
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	// With AUTH_TOKEN set, the WebSocket and the chat APIs need a token.
+	app.Use("/ws", requireAuth)
+	app.Use("/api", requireAuth)
+	// The client IP is only available before the upgrade, so it is stashed in Locals for the handler.
+	// Upgrades from other sites' pages are refused unless their origin is allowed.
+	app.Use("/ws", func(c *fiber.Ctx) error {
+		if !originAllowed(c) {
+			slog.Warn("websocket upgrade rejected: origin not allowed", "origin", c.Get(fiber.HeaderOrigin), "ip", c.IP())
+			return fiber.ErrForbidden
+		}
+		// A full server turns upgrades away right away, unless connections may
+		// wait for a slot (see handleWebSocket).
+		if connectionWait <= 0 && registry.Full() {
+			slog.Warn("websocket upgrade rejected: MAX_CONNECTIONS reached", "ip", c.IP())
+			countError(errorTypeConnectionLimit)
+			return fiber.NewError(fiber.StatusServiceUnavailable, "server full, please try again later")
+		}
+		c.Locals("ip", c.IP())
+		c.Locals(endUserKey, endUserID(c))
+		return c.Next()
+	})
+	// With WS_COMPRESSION set, clients that support permessage-deflate get compressed frames.
+	// Clients choose a protocol version through the WebSocket subprotocol.
+	app.Get("/ws", websocket.New(handleWebSocket, websocket.Config{
+		EnableCompression: cfg.WSCompression,
+		Subprotocols:      subprotocols,
+	}))
+	// One-shot, non-streaming chat completions for clients without WebSockets.
+	app.Post("/api/chat", handleChatAPI)
+	// The same reply streamed as Server-Sent Events.
+	app.Get("/api/stream", handleStreamAPI)
+	app.Post("/api/stream", handleStreamAPI)
+	// The models clients may choose.
+	app.Get("/api/models", handleListModels)
+	// Text files to add to a conversation's context.
+	app.Post("/api/upload", handleUpload)
+	// Stored conversations, for browsing and exporting chat history.
+	app.Get("/api/conversations", handleListConversations)
+	app.Get("/api/conversations/:id/export", handleExportConversation)
+	// Liveness and readiness probes for Kubernetes and load balancers.
+	app.Get("/healthz", handleHealthz)
+	app.Get("/readyz", handleReadyz)
+	// Prometheus metrics.
+	app.Get("/metrics", adaptor.HTTPHandler(promhttp.Handler()))
+	// With DEBUG_ADMIN set, token holders can see who is connected.
+	if cfg.DebugAdmin {
+		app.Get("/debug/connections", requireAuth, handleDebugConnections)
 	}
-
-	// 13. Start the server
-	// This starts the Fiber server on the specified port.
-	fmt.Printf("Server starting on :%s\n", port)
-	app.Listen(":" + port)
+	// Anything else is a client-side route of the single-page app; it must stay last.
+	app.Use(handleSPAFallback)
+	return app
 }
 
-// 14. Home route handler
+// 15. Home route handler
 // This function handles requests to the root ("/") path.
 func handleHome(c *fiber.Ctx) error {
 	// It sends the index.html file as the response.
-	return c.SendFile("./static/index.html")
+	return c.SendFile(filepath.Join(staticDir, "index.html"))
 }
 
-// 15. WebSocket handler
+// 16. WebSocket handler
 // This function handles WebSocket connections.
+// Clients may pass ?conversationId=... when connecting to resume a conversation.
 func handleWebSocket(c *websocket.Conn) {
-	// 16. Add client to the clients map
-	// The clients map keeps track of all active WebSocket connections.
-	clients[c] = true
-	// This defers the removal of the client from the map until the function returns.
-	defer delete(clients, c)
+	// Every connection holds one of the MAX_CONNECTIONS slots until the handler
+	// returns, however it returns. Connections that got past the check before
+	// the upgrade but find no free slot are closed with 1013.
+	if !registry.Acquire(connectionWait) {
+		ip, _ := c.Locals("ip").(string)
+		slog.Warn("connection rejected: MAX_CONNECTIONS reached", "ip", ip, "waited", connectionWait)
+		countError(errorTypeConnectionLimit)
+		closeConnection(c, websocket.CloseTryAgainLater, "server full")
+		return
+	}
+	defer registry.Release()
+
+	// 17. Add client to the registry
+	// The registry keeps track of all active WebSocket connections.
+	client := registry.Add(c)
+	// This defers the removal of the client from the registry until the function returns.
+	// The connection is only handed back once the client's writer has stopped.
+	defer client.waitWriter()
+	defer registry.Remove(c)
+	// Every log line about this connection carries its correlation ID.
+	ip, _ := c.Locals("ip").(string)
+	requestID, _ := c.Locals(requestIDKey).(string)
+	logger := slog.With("conn_id", client.ID(), "request_id", requestID, "ip", ip)
+	client.user, _ = c.Locals(endUserKey).(string)
+
+	// Clients that don't speak a protocol version the server knows would misread its frames.
+	protocol := c.Subprotocol()
+	if protocol == "" && requireSubprotocol {
+		logger.Warn("connection rejected: no supported subprotocol requested")
+		countError(errorTypeUnsupportedProtocol)
+		client.Close(closeUnsupportedProtocol, "unsupported protocol version, use "+subprotocols[0])
+		return
+	}
+	if protocol == "" {
+		protocol = subprotocols[0]
+	}
+	client.WriteJSON(HelloFrame{Type: "hello", Protocol: protocol, Version: protocolVersion})
+
+	// Each IP may only hold a limited number of connections at once.
+	if !limiter.AcquireConn(ip) {
+		logger.Warn("connection rejected: too many connections from this IP")
+		countError(errorTypeConnectionLimit)
+		sendError(client, "too many connections from your address, please close some tabs and try again")
+		client.Close(websocket.ClosePolicyViolation, "too many connections")
+		return
+	}
+	defer limiter.ReleaseConn(ip)
+	// The deferred decrement also runs when the connection drops abnormally.
+	metricActiveConnections.Inc()
+	defer metricActiveConnections.Dec()
+
+	// This context lives as long as the connection.
+	// Cancelling it when the handler returns aborts any in-flight OpenAI requests.
+	ctx, cancel := context.WithCancel(withRequestID(withLogger(context.Background(), logger), requestID))
+	defer cancel()
+
+	// Frames far beyond the message limit are refused by the connection itself,
+	// which closes it; the headroom covers the JSON envelope and escaping, so
+	// merely oversized messages get a friendly error frame below instead.
+	c.SetReadLimit(int64(maxMessageBytes)*2 + int64(maxImageBytes) + 4096)
+
+	// The worker answers queued messages one at a time until the connection closes.
+	go client.ProcessQueue(ctx)
+	// Pings detect dead connections; a read times out once pongs stop coming.
+	extendDeadline := startKeepAlive(ctx, c)
+	// Connections that stop sending messages are closed after IDLE_TIMEOUT.
+	resetIdle := startIdleTimer(ctx, client)
+
+	// Attach the connection to its conversation, creating a new one if needed.
+	// In room mode everybody joins the room's conversation instead.
+	// The deferred release covers every conversation attached along the way.
+	conversationID := c.Query("conversationId")
+	if room != nil {
+		conversationID = room.Conversation().ID()
+	}
+	if attachConversation(ctx, client, conversationID) == nil {
+		client.Close(websocket.CloseInternalServerErr, "could not open conversation")
+		return
+	}
+	defer func() {
+		for _, conv := range client.Conversations() {
+			conv.Reply().Unfollow(client)
+			conversations.Release(conv)
+		}
+	}()
+	if room != nil {
+		room.Join(client)
+		defer room.Leave(client)
+	}
+
+	openedAt := time.Now()
+	logger.Info("connection opened", "conversation_id", client.Conversation().ID())
+	defer func() { logger.Info("connection closed", "duration", time.Since(openedAt)) }()
 
-	// 17. Infinite loop to handle incoming messages
+	// 18. Infinite loop to handle incoming messages
 	for {
 		var msg WebSocketMessage
-		// ReadJSON reads a JSON message from the WebSocket connection.
-		err := c.ReadJSON(&msg)
+		// Only a failed read ends the connection. A message that isn't valid
+		// JSON is answered with an error saying why, and the next one is read.
+		_, data, err := c.ReadMessage()
 		if err != nil {
+			logReadError(logger, err)
 			break
 		}
-		// Start a new goroutine to handle the response streaming.
-		// This allows multiple clients to be served concurrently.
-		go streamResponse(msg.Text, c)
+		extendDeadline()
+		resetIdle()
+		if err := json.Unmarshal(data, &msg); err != nil {
+			logger.Debug("malformed message received", "err", err, "bytes", len(data))
+			countError(errorTypeInvalidMessage)
+			sendError(client, "invalid JSON message"+describeJSONError(err))
+			continue
+		}
+		logger.Debug("message received", "type", msg.Type, "bytes", len(msg.Text))
+		// Find the conversation the message is for, attaching it if needed.
+		conv := client.Conversation()
+		// A room has exactly one conversation.
+		if room != nil && (msg.Type == "new" || (msg.ConversationID != "" && msg.ConversationID != room.Conversation().ID())) {
+			countError(errorTypeInvalidMessage)
+			rejectMessage(client, "", msg.ID, "everybody shares one conversation in room mode, it can't be switched")
+			continue
+		}
+		switch {
+		case msg.Type == "new":
+			conv = attachConversation(ctx, client, "")
+		case msg.ConversationID != "" && msg.ConversationID != conv.ID():
+			conv = attachConversation(ctx, client, msg.ConversationID)
+		}
+		if conv == nil {
+			return
+		}
+		// Out-of-range generation parameters reject the whole message.
+		if err := msg.GenerationParams.Validate(); err != nil {
+			countError(errorTypeInvalidMessage)
+			rejectMessage(client, conv.ID(), msg.ID, err.Error())
+			continue
+		}
+		// The parameters sent with a "regenerate" or "continue" message only apply
+		// to that one response, e.g. to re-roll an answer at a higher temperature.
+		if msg.Type != "regenerate" && msg.Type != "continue" {
+			conv.UpdateParams(msg.GenerationParams)
+		}
+		// Switch models if the client asked for one.
+		// Unknown models fall back to the default and the client is told why.
+		if msg.Model != "" {
+			if allowedModels[msg.Model] {
+				conv.SetModel(msg.Model)
+			} else {
+				conv.SetModel(defaultModel)
+				countError(errorTypeInvalidMessage)
+				sendConversationError(client, conv.ID(), fmt.Sprintf("model %q is not allowed, using %s", msg.Model, defaultModel))
+			}
+		}
+		// Referenced uploads stay in the conversation's context from now on.
+		if err := attachUploads(conv, msg.Uploads); err != nil {
+			countError(errorTypeInvalidMessage)
+			rejectMessage(client, conv.ID(), msg.ID, err.Error())
+			continue
+		}
+		// A "resume" message picks up the latest reply where the client lost it.
+		if msg.Type == "resume" {
+			ackMessage(client, conv.ID(), msg.ID)
+			resumeReply(client, conv, msg.Offset)
+			continue
+		}
+		// A "template" message is a chat message rendered from a prompt template.
+		if msg.Type == "template" {
+			text, err := renderTemplate(msg.Name, msg.Vars)
+			if err != nil {
+				countError(errorTypeInvalidMessage)
+				rejectMessage(client, conv.ID(), msg.ID, err.Error())
+				continue
+			}
+			msg.Text = text
+		}
+		// A message that only changes settings (conversation, model, parameters, uploads)
+		// doesn't need a reply, and a "ping" only keeps an idle connection open.
+		if msg.Type == "new" || msg.Type == "ping" || (msg.Type == "" && msg.Text == "" && len(msg.Images) == 0) {
+			ackMessage(client, conv.ID(), msg.ID)
+			continue
+		}
+		if len(msg.Text) > maxMessageBytes {
+			countError(errorTypeInvalidMessage)
+			rejectMessage(client, conv.ID(), msg.ID, fmt.Sprintf("message is too long (%d bytes, the limit is %d)", len(msg.Text), maxMessageBytes))
+			continue
+		}
+		// Images are only accepted by vision models.
+		if err := validateImages(conv.Model(), msg.Images); err != nil {
+			countError(errorTypeInvalidMessage)
+			rejectMessage(client, conv.ID(), msg.ID, err.Error())
+			continue
+		}
+		// A "stop" message aborts the response being generated in its
+		// conversation, or in every conversation if it isn't tagged. In a
+		// room, any member can stop the room's reply.
+		if msg.Type == "stop" {
+			stopID := ""
+			if msg.ConversationID != "" {
+				stopID = conv.ID()
+			}
+			if len(client.StopReplies(stopID)) == 0 {
+				rejectMessage(client, stopID, msg.ID, "nothing to stop")
+			} else {
+				ackMessage(client, stopID, msg.ID)
+			}
+			continue
+		}
+		// A "tool_result" message answers a tool call the server is waiting on.
+		if msg.Type == "tool_result" {
+			if !client.DeliverToolResult(msg.ToolCallID, msg.Text) {
+				rejectMessage(client, "", msg.ID, fmt.Sprintf("no tool call %q is waiting for a result", msg.ToolCallID))
+			} else {
+				ackMessage(client, conv.ID(), msg.ID)
+			}
+			continue
+		}
+		// An "examples" message replaces the conversation's few-shot examples;
+		// an empty list clears them. Neither calls the model.
+		if msg.Type == "examples" {
+			if err := validateExamples(msg.Messages); err != nil {
+				countError(errorTypeInvalidMessage)
+				rejectMessage(client, conv.ID(), msg.ID, err.Error())
+				continue
+			}
+			conv.SetExamples(msg.Messages)
+			ackMessage(client, conv.ID(), msg.ID)
+			continue
+		}
+		// Memory messages change or show the connection's memory, for every
+		// conversation on it. Like settings, they don't call the model.
+		switch msg.Type {
+		case "remember":
+			if err := client.Memory().Set(msg.Vars); err != nil {
+				countError(errorTypeInvalidMessage)
+				rejectMessage(client, conv.ID(), msg.ID, err.Error())
+				continue
+			}
+			ackMessage(client, conv.ID(), msg.ID)
+			continue
+		case "forget":
+			client.Memory().Forget(msg.Name)
+			ackMessage(client, conv.ID(), msg.ID)
+			continue
+		case "memory":
+			ackMessage(client, conv.ID(), msg.ID)
+			facts, size := client.Memory().Facts()
+			client.WriteJSON(MemoryFrame{Type: "memory", Memory: facts, Bytes: size, Limit: memoryMaxBytes, ConversationID: conv.ID()})
+			continue
+		}
+		// A "prefill" message sets the start of the next reply (of every reply
+		// with PREFILL_STICKY). Trailing whitespace is dropped because Anthropic
+		// rejects a prefill ending in it. An empty text clears the prefill.
+		if msg.Type == "prefill" {
+			if len(msg.Text) > maxMessageBytes {
+				countError(errorTypeInvalidMessage)
+				rejectMessage(client, conv.ID(), msg.ID, fmt.Sprintf("prefill too long (%d bytes, the limit is %d)", len(msg.Text), maxMessageBytes))
+				continue
+			}
+			conv.SetPrefill(strings.TrimRightFunc(msg.Text, unicode.IsSpace))
+			ackMessage(client, conv.ID(), msg.ID)
+			continue
+		}
+		// A "system" message only updates the conversation's system prompt and does not call the model.
+		if msg.Type == "system" {
+			conv.SetSystemPrompt(msg.Text)
+			ackMessage(client, conv.ID(), msg.ID)
+			continue
+		}
+		if msg.Type == "edit" && (msg.Index == nil || *msg.Index < 0) {
+			countError(errorTypeInvalidMessage)
+			rejectMessage(client, conv.ID(), msg.ID, "an edit needs the index of the message to replace")
+			continue
+		}
+		// An empty message isn't worth an upstream call.
+		if msg.Type != "regenerate" && msg.Type != "continue" && strings.TrimSpace(msg.Text) == "" && len(msg.Images) == 0 {
+			countError(errorTypeInvalidMessage)
+			rejectMessage(client, conv.ID(), msg.ID, "message is empty")
+			continue
+		}
+		// A conversation that used up its budget gets no more replies.
+		if err := checkBudget(conv); err != nil {
+			logger.Info("message rejected: budget exceeded", "conversation_id", conv.ID())
+			countError(errorTypeBudgetExceeded)
+			client.WriteJSON(WebSocketMessage{Type: "budget_exceeded", ID: msg.ID, Text: err.Error(), ConversationID: conv.ID()})
+			continue
+		}
+		// Every chat message costs an upstream call, so each IP gets a limited number per minute.
+		if !limiter.AllowMessage(ip) {
+			logger.Warn("message rejected: rate limit exceeded")
+			countError(errorTypeRateLimited)
+			rejectMessage(client, conv.ID(), msg.ID, "you are sending messages too quickly, please wait a moment")
+			continue
+		}
+		// With LATEST_MESSAGE_WINS a new message aborts the reply still streaming,
+		// and the client is told which one was cut short.
+		if latestMessageWins {
+			for _, id := range client.StopReplies("") {
+				client.WriteJSON(WebSocketMessage{Type: "cancelled", ConversationID: id})
+			}
+		}
+		// Replies are generated one at a time, in order, by the connection's worker.
+		// Messages sent while a reply is streaming wait in a small queue; once it
+		// is full, further messages are rejected instead of piling up.
+		userMsg := Message{Role: "user", Content: msg.Text, Parts: contentParts(msg.Text, msg.Images)}
+		msgType, index, msgID := msg.Type, msg.Index, msg.ID
+		var override GenerationParams
+		if msgType == "regenerate" || msgType == "continue" {
+			override = msg.GenerationParams
+		}
+		// The ack is only sent once the message is queued, but must reach the
+		// client before the reply's "start" frame, so the job waits for it.
+		acked := make(chan struct{})
+		queued := client.Enqueue(func() {
+			<-acked
+			// trackStream lets shutdown wait for the response to finish. Once
+			// shutdown has started, no new responses are generated.
+			started := trackStream(func() {
+				// With MODERATION set, flagged messages never reach the model.
+				if msgType != "regenerate" && msgType != "continue" {
+					if err := moderate(ctx, userMsg.Content); err != nil {
+						countModerationError(err)
+						rejectMessage(client, conv.ID(), msgID, err.Error())
+						return
+					}
+				}
+				switch msgType {
+				case "regenerate":
+					// The last reply is replaced by a new one generated from the same context.
+					if !popLastReply(ctx, conv) {
+						rejectMessage(client, conv.ID(), msgID, "there is no reply to regenerate")
+						return
+					}
+				case "continue":
+					// The last reply is extended rather than replaced (see streamResponse).
+					if _, ok := conv.LastReply(); !ok {
+						rejectMessage(client, conv.ID(), msgID, "there is no reply to continue")
+						return
+					}
+				case "edit":
+					// The conversation continues from the edited message; the old branch is dropped.
+					if err := truncateConversation(ctx, conv, *index); err != nil {
+						rejectMessage(client, conv.ID(), msgID, err.Error())
+						return
+					}
+					recordMessage(ctx, conv, userMsg)
+					shareUserMessage(client, conv, userMsg)
+				default:
+					// Record the user's turn so the model sees it as part of the conversation.
+					recordMessage(ctx, conv, userMsg)
+					shareUserMessage(client, conv, userMsg)
+				}
+				// Each response gets its own context so a "stop" message can cancel just that response.
+				genCtx, finish := client.StartReply(ctx, conv)
+				defer finish()
+				streamResponse(genCtx, conv, client, override, msgType == "continue")
+			})
+			if !started {
+				rejectMessage(client, conv.ID(), msgID, "server is shutting down")
+			}
+		})
+		if queued {
+			metricMessages.Inc()
+			ackMessage(client, conv.ID(), msgID)
+			close(acked)
+		} else {
+			countError(errorTypeQueueFull)
+			rejectMessage(client, conv.ID(), msgID, "too many messages waiting for a reply, please wait for the current response")
+		}
 	}
 }
 
-// 18. Response streaming function
-// This function streams responses from the OpenAI API to the client.
-func streamResponse(message string, conn *websocket.Conn) {
-	// 19. Prepare OpenAI API request
-	openAIReq := OpenAIRequest{
-		Model: "gpt-4o-mini",
-		Messages: []Message{
-			{Role: "user", Content: message},
-		},
-		Stream: true,
+// 19. Response streaming function
+// This function streams a reply from the configured provider to the client.
+// The context is tied to the connection, so a closed connection stops the stream.
+// Parameters set in override take precedence over the conversation's for this response only.
+// With continued set, the model is asked to carry on with the conversation's
+// last reply, which was cut off; the new text streams as the rest of that reply.
+func streamResponse(ctx context.Context, conv *Conversation, client *Client, override GenerationParams, continued bool) {
+	// Every response starts with a "start" frame, so the frontend can show that
+	// the model is working before the first token arrives, and ends with exactly
+	// one "done" frame, however it finishes, so it knows it can accept the next message.
+	// The reply is buffered for clients that reconnect and resume it.
+	// A continued reply's "start" frame carries the offset it continues from.
+	buf := conv.Reply()
+	var prefix string
+	if continued {
+		prefix, _ = conv.LastReply()
+		buf.Continue(prefix)
+	} else {
+		buf.Start()
 	}
-	// Marshal the request into JSON.
-	reqBody, _ := json.Marshal(openAIReq)
+	client.Publish(WebSocketMessage{Type: "start", Offset: len(prefix), ConversationID: conv.ID()})
+	// finishReason is why the model stopped, as reported by the provider. The
+	// "done" frame passes it on.
+	var finishReason string
+	defer func() {
+		done := WebSocketMessage{Type: "done", Reason: finishReason, ConversationID: conv.ID()}
+		buf.Finish(done)
+		client.Publish(done)
+	}()
 
-	// 20. Create and send HTTP request to OpenAI API
-	req, _ := http.NewRequest("POST", openAIURL, strings.NewReader(string(reqBody)))
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+openAIKey)
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		fmt.Println("Error calling OpenAI API:", err)
+	// A provider without its API key can't answer. The details are only logged;
+	// the client just learns the server isn't set up.
+	if err := checkConfig(llm); err != nil {
+		loggerFrom(ctx).Error("provider is not configured", "conversation_id", conv.ID(), "err", err)
+		countError(errorTypeUpstream)
+		sendConversationError(client, conv.ID(), "server not configured, please contact the administrator")
 		return
 	}
-	// Ensure the response body is closed when the function returns.
-	defer resp.Body.Close()
 
-	// 21. Read the streaming response
-	reader := bufio.NewReader(resp.Body)
-	isFirstToken := true
-	for {
-		// Read each line of the stream.
-		line, err := reader.ReadString('\n')
+	// 20. Prepare the completion request
+	// The full conversation history is sent so the model has context from earlier turns.
+	history := conv.Messages()
+	// If the session has a system prompt, it always goes first.
+	var system []Message
+	if systemPrompt := conv.SystemPrompt(); systemPrompt != "" {
+		system = []Message{{Role: "system", Content: systemPrompt}}
+	}
+	// Few-shot examples come right after it and are never dropped either, and
+	// neither are the facts in the connection's memory.
+	system = append(system, conv.Examples()...)
+	system = append(system, memoryContext(client.Memory())...)
+	// Uploaded files follow the system prompt and, like it, are never dropped.
+	system = append(system, fileContext(conv.Files())...)
+	// With CONTEXT_STRATEGY=summarize, the oldest turns are condensed into a
+	// summary before the prompt reaches the budget.
+	if contextStrategy == contextStrategySummarize && summarizeOldest(ctx, conv, client, system, history) {
+		history = conv.Messages()
+	}
+	system = append(system, summaryContext(conv.Summary())...)
+	// Long conversations eventually outgrow the model's context window, so the
+	// oldest turns are dropped from memory once the prompt exceeds the budget.
+	// The system prompt is never dropped.
+	if drop := messagesToDrop(tokenizer, system, history, contextBudget(conv.Model())); drop > 0 {
+		conv.DropOldest(drop)
+		history = history[drop:]
+		client.Publish(WebSocketMessage{
+			Type:           "warning",
+			Text:           fmt.Sprintf("dropped the %d oldest messages to fit the model's context window", drop),
+			ConversationID: conv.ID(),
+		})
+	}
+	messages := append(system, history...)
+	if continued {
+		messages = append(messages, Message{Role: "user", Content: continuePrompt})
+	}
+	// A prefilled reply starts with the prefill, which the model continues if
+	// the provider lets it. Otherwise it is only shown in front of the reply.
+	var prefill string
+	if !continued {
+		prefill = conv.TakePrefill()
+	}
+	if prefill != "" {
+		if supportsPrefill(llm) {
+			messages = append(messages, Message{Role: "assistant", Content: prefill})
+		} else {
+			loggerFrom(ctx).Warn("provider does not support prefill, only showing it", "conversation_id", conv.ID())
+			client.Publish(WebSocketMessage{
+				Type:           "warning",
+				Text:           "this provider can't continue a prefilled reply, so the prefill is only shown in front of it",
+				ConversationID: conv.ID(),
+			})
+		}
+	}
+	// Images in the history can't go to a model that doesn't accept them.
+	if !visionModels[conv.Model()] {
+		messages = textOnly(messages)
+	}
+
+	// 21. Start the stream
+	// The provider sends the request upstream and hands back a channel of stream events.
+	model := conv.Model()
+	// Each model gets its parameter defaults and limits (see modelParams), and
+	// the client is told about parameters it asked for that the model rejects.
+	requested := conv.Params().Merge(override)
+	warnDropped := func(model string, dropped []string) {
+		if len(dropped) > 0 {
+			client.Publish(WebSocketMessage{
+				Type:           "warning",
+				Text:           fmt.Sprintf("%s does not support %s, so it was not sent", model, strings.Join(dropped, ", ")),
+				ConversationID: conv.ID(),
+			})
+		}
+	}
+	params, dropped := applyModelParams(model, requested)
+	warnDropped(model, dropped)
+	// JSON mode and logprobs are only available on some models.
+	if err := checkResponseFormat(model, params.ResponseFormat); err != nil {
+		countError(errorTypeInvalidMessage)
+		sendConversationError(client, conv.ID(), err.Error())
+		return
+	}
+	if err := checkLogprobs(model, params); err != nil {
+		countError(errorTypeInvalidMessage)
+		sendConversationError(client, conv.ID(), err.Error())
+		return
+	}
+	logger := loggerFrom(ctx).With("conversation_id", conv.ID(), "model", model)
+	start := time.Now()
+	// Each response gets a deadline and a token allowance. Hitting either cuts
+	// the reply off and the client gets a "truncated" frame saying why.
+	parent := ctx
+	var cancel context.CancelFunc
+	if generationTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, generationTimeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	defer cancel()
+	var truncated string
+	timedOut := func() bool {
+		return parent.Err() == nil && errors.Is(ctx.Err(), context.DeadlineExceeded)
+	}
+	streamedTokens := 0
+	// publish sends a streamed frame. A failed write means the client has gone,
+	// so its connection is dropped. Without RESUME_WINDOW nobody can pick the
+	// response up again, so it is stopped too instead of streaming to the end.
+	var clientGone sync.Once
+	publish := func(v interface{}) {
+		if err := client.Publish(v); err != nil {
+			clientGone.Do(func() {
+				logger.Debug("client write failed, dropping the connection", "err", err)
+				registry.Deregister(client)
+				if resumeWindow <= 0 {
+					cancel()
+				}
+			})
+		}
+	}
+	// sendText sends streamed text to the client. The text is exactly what the
+	// model wrote; the frontend labels it using the role. Tokens arriving close
+	// together are coalesced into one frame (STREAM_COALESCE_INTERVAL).
+	frames := newCoalescingWriter(func(text string) {
+		publish(buf.Append(text, func(offset int) interface{} {
+			return WebSocketMessage{Role: "assistant", Text: text, Offset: offset, ConversationID: conv.ID()}
+		}))
+	})
+	defer frames.Flush()
+	sendText := frames.Write
+	// Tokens may be grouped into larger chunks that end at word boundaries (STREAM_CHUNK_BYTES).
+	chunks := newChunkBuffer()
+	// The reply is assembled here so it can be stored in the history once streaming ends.
+	var reply strings.Builder
+	// Providers that support it report usage in one of the last events.
+	// With tool calls there is one upstream request per round, so usage is summed.
+	var usage *Usage
+	// OpenAI reports the backend configuration, which matters when comparing seeded replies.
+	var fingerprint string
+	// Several alternative replies can't each call tools, so tools are only
+	// offered for a single reply.
+	choices := params.Choices()
+	logprobs := params.WantsLogprobs()
+	tools := toolDefinitions()
+	if choices > 1 {
+		tools = nil
+	}
+	if prefill != "" {
+		reply.WriteString(prefill)
+		sendText(prefill)
+	}
+	// The model's text goes through OUTPUT_FILTERS before the client or the
+	// history sees it. Alternative replies would mix in one filter's state, so
+	// they are left as they are.
+	var filters filterChain
+	if choices == 1 {
+		filters = newOutputFilters()
+	}
+	for round := 0; ; round++ {
+		logger.Info("upstream request started", "messages", len(messages), "round", round)
+		roundStart := time.Now()
+		finishReason = ""
+
+		events, err := streamCompletion(ctx, llm, CompletionRequest{
+			Model:    model,
+			Messages: messages,
+			Params:   params,
+			Tools:    tools,
+			User:     client.user,
+		})
+		// If the model is rate limited or unavailable before anything was streamed,
+		// the fallback model gets one try at the same request, as long as it
+		// can stream the same number of replies, with or without logprobs.
+		fallbackParams, fallbackDropped := applyModelParams(fallbackModel, requested)
+		if err != nil && ctx.Err() == nil && reply.Len() == 0 && shouldFallBack(err, model) &&
+			checkResponseFormat(fallbackModel, fallbackParams.ResponseFormat) == nil && checkLogprobs(fallbackModel, fallbackParams) == nil &&
+			fallbackParams.Choices() == choices && fallbackParams.WantsLogprobs() == logprobs {
+			logger.Warn("upstream request failed, trying the fallback model", "err", err, "fallback_model", fallbackModel)
+			model = fallbackModel
+			params = fallbackParams
+			warnDropped(model, fallbackDropped)
+			if !visionModels[model] {
+				messages = textOnly(messages)
+			}
+			logger = loggerFrom(ctx).With("conversation_id", conv.ID(), "model", model)
+			client.Publish(WebSocketMessage{
+				Type:           "info",
+				Text:           fmt.Sprintf("%s is unavailable, answering with %s", conv.Model(), model),
+				ConversationID: conv.ID(),
+			})
+			round--
+			continue
+		}
 		if err != nil {
-			if err == io.EOF {
+			// A cancelled context means the client is gone, so there is nobody to tell.
+			if errors.Is(err, ErrUpstreamBusy) {
+				logger.Warn("upstream request not started: too many in flight", "waited", time.Since(start))
+				countError(errorTypeUpstreamBusy)
+				sendConversationError(client, conv.ID(), err.Error())
+			} else if errors.Is(err, ErrUpstreamUnavailable) {
+				logger.Warn("upstream request not started: circuit breaker is open")
+				countError(errorTypeUpstreamUnavailable)
+				sendConversationError(client, conv.ID(), err.Error())
+			} else if ctx.Err() == nil {
+				logger.Error("upstream request failed", "err", err, "duration", time.Since(start))
+				countError(errorTypeUpstream)
+				sendConversationError(client, conv.ID(), err.Error())
+			} else if timedOut() {
+				logger.Warn("response truncated", "reason", "timeout")
+				client.Publish(TruncatedFrame{Type: "truncated", Reason: "timeout", ConversationID: conv.ID()})
+			}
+			return
+		}
+
+		// 22. Send each chunk to the WebSocket client
+		var toolCalls []ToolCall
+		var streamErr error
+		for event := range events {
+			// Once cancelled (by "stop" or a disconnect) no more tokens go out.
+			if ctx.Err() != nil {
+				break
+			}
+			// A stream that broke off ends the reply with what arrived so far.
+			if event.Err != nil {
+				streamErr = event.Err
 				break
 			}
-			fmt.Println("Error reading stream:", err)
+			if event.Usage != nil {
+				if usage == nil {
+					usage = &Usage{}
+				}
+				usage.PromptTokens += event.Usage.PromptTokens
+				usage.CompletionTokens += event.Usage.CompletionTokens
+			}
+			toolCalls = append(toolCalls, event.ToolCalls...)
+			if event.SystemFingerprint != "" {
+				fingerprint = event.SystemFingerprint
+			}
+			if event.FinishReason != "" {
+				finishReason = event.FinishReason
+			}
+			// Reasoning is shown separately from the answer and isn't kept in the history.
+			if event.Reasoning != "" {
+				publish(WebSocketMessage{Type: "reasoning", Text: event.Reasoning, ConversationID: conv.ID()})
+			}
+			content := filters.Process(event.Content)
+			if content == "" {
+				continue
+			}
+			// With n > 1 every reply streams in its own "choice" frames, and the
+			// first one is kept in the conversation.
+			if choices > 1 {
+				publish(ChoiceFrame{Type: "choice", Index: event.Choice, Text: content, ConversationID: conv.ID()})
+				if event.Choice == 0 {
+					reply.WriteString(content)
+				}
+			} else if logprobs {
+				// Log probabilities belong to tokens, so each event gets its own frame.
+				reply.WriteString(content)
+				publish(buf.Append(content, func(offset int) interface{} {
+					return WebSocketMessage{Role: "assistant", Text: content, Offset: offset, Tokens: event.Logprobs, ConversationID: conv.ID()}
+				}))
+			} else {
+				reply.WriteString(content)
+				sendText(chunks.Add(content))
+			}
+			streamedTokens += estimateTokens(content)
+			if maxResponseTokens > 0 && streamedTokens >= maxResponseTokens {
+				truncated = "max_tokens"
+				cancel()
+				break
+			}
+		}
+		// Whatever is still buffered goes out before any tool call frames or the
+		// end of the reply, starting with what the filters held back.
+		if rest := filters.Finalize(); rest != "" {
+			reply.WriteString(rest)
+			sendText(chunks.Add(rest))
+		}
+		sendText(chunks.Flush())
+		frames.Flush()
+		metricUpstreamDuration.Observe(time.Since(roundStart).Seconds())
+		if streamErr != nil {
+			countError(errorTypeUpstream)
+			sendConversationError(client, conv.ID(), "the reply was interrupted by an upstream error, please try again")
+			break
+		}
+		if len(toolCalls) == 0 || ctx.Err() != nil {
+			break
+		}
+		if round == maxToolRounds {
+			logger.Warn("too many tool call rounds, giving up")
+			countError(errorTypeUpstream)
+			sendConversationError(client, conv.ID(), "the model kept calling tools without answering")
 			break
 		}
 
-		// 22. Process each line
-		line = strings.TrimSpace(line)
-		if line == "" || line == "data: [DONE]" {
-			continue
+		// The model asked for tools instead of answering. Run them, add their
+		// results to the prompt and ask again. The exchange is only part of this
+		// request; the conversation keeps just the final answer.
+		messages = append(messages, Message{Role: "assistant", ToolCalls: toolCalls})
+		for _, call := range toolCalls {
+			result := runToolCall(ctx, client, conv.ID(), call)
+			messages = append(messages, Message{Role: "tool", ToolCallID: call.ID, Content: result})
+		}
+	}
+
+	if truncated == "" && timedOut() {
+		truncated = "timeout"
+	}
+	// The model itself stopping at max_tokens cuts the reply off as well.
+	if truncated == "" && finishReason == "length" {
+		truncated = "length"
+	}
+	if truncated != "" {
+		logger.Warn("response truncated", "reason", truncated)
+		client.Publish(TruncatedFrame{Type: "truncated", Reason: truncated, ConversationID: conv.ID()})
+	}
+
+	// Without reported usage, fall back to an estimate so the client still gets numbers.
+	estimated := usage == nil
+	if estimated {
+		usage = &Usage{
+			PromptTokens:     estimateMessageTokens(messages),
+			CompletionTokens: estimateTokens(reply.String()),
 		}
-		line = strings.TrimPrefix(line, "data: ")
-		var aiResp OpenAIResponse
-		err = json.Unmarshal([]byte(line), &aiResp)
+	}
+	metricTokensStreamed.Add(float64(usage.CompletionTokens))
+	total := chargeConversation(ctx, conv, model, *usage)
+	auditLog.Record(ctx, AuditEntry{
+		ConversationID:   conv.ID(),
+		Source:           "websocket",
+		Model:            model,
+		Prompt:           lastUserMessage(messages),
+		Response:         reply.String(),
+		PromptTokens:     usage.PromptTokens,
+		CompletionTokens: usage.CompletionTokens,
+		UsageEstimated:   estimated,
+	})
+	client.Publish(UsageFrame{
+		Type:              "usage",
+		Prompt:            usage.PromptTokens,
+		Completion:        usage.CompletionTokens,
+		TotalPrompt:       total.PromptTokens,
+		TotalCompletion:   total.CompletionTokens,
+		Estimated:         estimated,
+		SystemFingerprint: fingerprint,
+		ConversationID:    conv.ID(),
+	})
+	// With a budget set, the client learns how much of it is left.
+	if frame, ok := budgetFrame(conv); ok {
+		client.Publish(frame)
+	}
+
+	logger.Info("upstream request finished",
+		"prompt_tokens", usage.PromptTokens,
+		"completion_tokens", usage.CompletionTokens,
+		"usage_estimated", estimated,
+		"chars", reply.Len(),
+		"duration", time.Since(start),
+		"cancelled", parent.Err() != nil,
+		"truncated", truncated,
+	)
+
+	// 23. Store the assistant reply in the conversation history
+	// A continuation replaces the reply it continues with the whole text.
+	full := prefix + reply.String()
+	if reply.Len() > 0 {
+		if continued {
+			popLastReply(ctx, conv)
+		}
+		recordMessage(ctx, conv, Message{Role: "assistant", Content: full})
+		// After the first exchange the conversation gets a title, without delaying this response.
+		startTitleGeneration(ctx, conv, client)
+	}
+
+	// In JSON mode the finished reply is checked and sent again as data. A reply
+	// cut short by the client is incomplete anyway and isn't checked.
+	if params.ResponseFormat.JSONMode() && reply.Len() > 0 && parent.Err() == nil {
+		if data := strings.TrimSpace(full); json.Valid([]byte(data)) {
+			client.Publish(JSONFrame{Type: "json", Data: json.RawMessage(data), ConversationID: conv.ID()})
+		} else {
+			logger.Warn("reply in JSON mode is not valid JSON", "truncated", truncated)
+			countError(errorTypeUpstream)
+			sendConversationError(client, conv.ID(), "the model's reply is not valid JSON")
+		}
+	}
+
+	// With RENDER_MARKDOWN set, the raw tokens are followed by the whole reply
+	// as HTML, which the frontend swaps in once streaming is done.
+	if renderMarkdown && reply.Len() > 0 {
+		html, err := markdownToHTML(full)
 		if err != nil {
-			continue
+			logger.Error("error rendering markdown", "err", err)
+			return
 		}
+		client.Publish(HTMLFrame{Type: "html", Content: html, ConversationID: conv.ID()})
+	}
+}
 
-		// 23. Send processed content to WebSocket client
-		if len(aiResp.Choices) > 0 {
-			content := aiResp.Choices[0].Delta.Content
-			if content != "" {
-				if isFirstToken {
-					// Send first token with "AI: " prefix.
-					conn.WriteJSON(WebSocketMessage{Text: "AI: " + content})
-					isFirstToken = false
-				} else {
-					// Send subsequent tokens without prefix.
-					conn.WriteJSON(WebSocketMessage{Text: content})
-				}
-			}
+// 24. Conversation helpers
+// attachConversation makes the conversation with the given ID the client's
+// current one, attaching it to the connection first if necessary. An empty or
+// unknown ID attaches a new conversation. Newly attached conversations are
+// announced with a "conversation" frame so the client learns their ID.
+// It returns nil if no conversation could be opened.
+func attachConversation(ctx context.Context, client *Client, id string) *Conversation {
+	if id != "" {
+		if conv := client.UseConversation(id); conv != nil {
+			return conv
+		}
+	}
+	conv, resumed, err := conversations.Open(ctx, id)
+	if err != nil {
+		sendError(client, "could not open conversation: "+err.Error())
+		return nil
+	}
+	if detached := client.AttachConversation(conv); detached != nil {
+		conversations.Release(detached)
+	}
+	if id != "" && !resumed {
+		sendConversationError(client, conv.ID(), "unknown conversation, starting a new one")
+	}
+	client.WriteJSON(WebSocketMessage{Type: "conversation", ConversationID: conv.ID()})
+	// Only new conversations are greeted; resumed ones already have their history.
+	if !resumed && welcomeMessage != "" {
+		if recordWelcomeMessage {
+			recordMessage(ctx, conv, Message{Role: "assistant", Content: welcomeMessage})
 		}
+		client.WriteJSON(WebSocketMessage{Role: "assistant", Text: welcomeMessage, ConversationID: conv.ID()})
+	}
+	return conv
+}
+
+// recordMessage appends a message to the conversation's history and persists it.
+// The write ignores cancellation of ctx so a reply is saved even if the client just left.
+func recordMessage(ctx context.Context, conv *Conversation, m Message) {
+	conv.AppendMessage(m)
+	if err := store.AppendMessage(context.WithoutCancel(ctx), conv.ID(), m); err != nil {
+		loggerFrom(ctx).Error("error saving message", "conversation_id", conv.ID(), "err", err)
+	}
+}
+
+// popLastReply removes the conversation's last assistant reply from memory and
+// from the store. It reports false if the conversation doesn't end in a reply.
+func popLastReply(ctx context.Context, conv *Conversation) bool {
+	remaining, ok := conv.PopLastReply()
+	if !ok {
+		return false
+	}
+	if err := store.TruncateMessages(context.WithoutCancel(ctx), conv.ID(), remaining); err != nil {
+		loggerFrom(ctx).Error("error deleting message", "conversation_id", conv.ID(), "err", err)
+	}
+	return true
+}
+
+// shouldFallBack reports whether a failed request for model should be retried
+// with the fallback model: the upstream rate limited the request (429), doesn't
+// know the model (404) or is overloaded (503). The fallback model itself never
+// falls back, so a failing fallback ends the response.
+func shouldFallBack(err error, model string) bool {
+	if fallbackModel == "" || model == fallbackModel {
+		return false
+	}
+	var upstreamErr *UpstreamError
+	if !errors.As(err, &upstreamErr) {
+		return false
+	}
+	switch upstreamErr.StatusCode {
+	case http.StatusTooManyRequests, http.StatusNotFound, http.StatusServiceUnavailable:
+		return true
+	}
+	return false
+}
+
+// shareUserMessage shows a member's message to the rest of their room. With
+// FRAME_FORMAT=htmx the sender gets it too.
+func shareUserMessage(client *Client, conv *Conversation, m Message) {
+	frame := WebSocketMessage{Role: "user", Text: m.Content, ConversationID: conv.ID()}
+	// An htmx page has no script of its own to show what was sent.
+	var except *Client
+	if frameFormat != frameFormatHTMX {
+		except = client
+	}
+	if room := client.Room(); room != nil {
+		room.Broadcast(frame, except)
+	} else if except == nil {
+		client.WriteJSON(frame)
+	}
+}
+
+// truncateConversation removes the user message at index and everything after
+// it from memory and from the store.
+func truncateConversation(ctx context.Context, conv *Conversation, index int) error {
+	if err := conv.TruncateAt(index); err != nil {
+		return err
+	}
+	if err := store.TruncateMessages(context.WithoutCancel(ctx), conv.ID(), index); err != nil {
+		loggerFrom(ctx).Error("error deleting messages", "conversation_id", conv.ID(), "err", err)
+	}
+	return nil
+}
+
+// 25. Error reporting helpers
+// sendError sends an error frame to the client so the frontend can show what went wrong.
+// Messages are redacted since they often wrap upstream errors.
+func sendError(client *Client, message string) {
+	sendConversationError(client, "", message)
+}
+
+// sendConversationError sends an error frame tagged with the conversation it is about.
+func sendConversationError(client *Client, conversationID, message string) {
+	rejectMessage(client, conversationID, "", message)
+}
+
+// rejectMessage sends the error frame for a message that wasn't accepted,
+// echoing the ID the client gave it, if any.
+func rejectMessage(client *Client, conversationID, messageID, message string) {
+	client.WriteJSON(WebSocketMessage{Type: "error", ID: messageID, Text: redact(message), ConversationID: conversationID})
+}
+
+// ackMessage tells the client that the message with the given ID was
+// accepted. Messages without an ID aren't acknowledged.
+func ackMessage(client *Client, conversationID, messageID string) {
+	if messageID != "" {
+		client.WriteJSON(WebSocketMessage{Type: "ack", ID: messageID, ConversationID: conversationID})
 	}
 }
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"bytes"
+
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+)
+
+// renderMarkdown enables converting finished replies to HTML.
+// It is set from the RENDER_MARKDOWN environment variable.
+var renderMarkdown bool
+
+// markdown converts GitHub-flavored Markdown (tables, strikethrough, autolinks).
+var markdown = goldmark.New(goldmark.WithExtensions(extension.GFM))
+
+// htmlPolicy strips anything from rendered replies that could run script or
+// otherwise misbehave. Model output is untrusted: a prompt can make it write raw HTML.
+var htmlPolicy = func() *bluemonday.Policy {
+	policy := bluemonday.UGCPolicy()
+	// Keep the language classes of fenced code blocks for syntax highlighting.
+	policy.AllowAttrs("class").Matching(bluemonday.SpaceSeparatedTokens).OnElements("code")
+	return policy
+}()
+
+// markdownToHTML renders a Markdown reply to sanitized HTML.
+func markdownToHTML(source string) (string, error) {
+	var buf bytes.Buffer
+	if err := markdown.Convert([]byte(source), &buf); err != nil {
+		return "", err
+	}
+	return htmlPolicy.Sanitize(buf.String()), nil
+}
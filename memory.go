@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// defaultMemoryMaxBytes caps the keys and values one connection's memory
+// holds together; MEMORY_MAX_BYTES overrides it.
+const defaultMemoryMaxBytes = 4096
+
+// maxMemoryKeyBytes caps the length of one memory key.
+const maxMemoryKeyBytes = 64
+
+var (
+	memoryMaxBytes = defaultMemoryMaxBytes
+	// memoryInPrompt (MEMORY_IN_PROMPT) adds the remembered facts to every
+	// request, after the system prompt.
+	memoryInPrompt = true
+)
+
+// Memory is a connection's scratchpad of facts to remember, such as the
+// user's name, kept apart from the history. The client sets it with
+// "remember" messages and the model with the remember tool. It is safe for
+// concurrent use; the zero value is empty.
+type Memory struct {
+	mu    sync.Mutex
+	facts map[string]string
+	size  int
+}
+
+// Set stores the values of facts under their keys, and removes the keys whose
+// value is empty. Nothing is changed if a key is invalid or the memory would
+// grow past MEMORY_MAX_BYTES.
+func (m *Memory) Set(facts map[string]string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	size := m.size
+	for key, value := range facts {
+		if key == "" || len(key) > maxMemoryKeyBytes {
+			return fmt.Errorf("memory keys must be 1 to %d bytes long", maxMemoryKeyBytes)
+		}
+		if old, ok := m.facts[key]; ok {
+			size -= len(key) + len(old)
+		}
+		if value != "" {
+			size += len(key) + len(value)
+		}
+	}
+	if size > memoryMaxBytes {
+		return fmt.Errorf("memory is full (%d bytes, the limit is %d)", size, memoryMaxBytes)
+	}
+	if m.facts == nil {
+		m.facts = map[string]string{}
+	}
+	for key, value := range facts {
+		if value == "" {
+			delete(m.facts, key)
+		} else {
+			m.facts[key] = value
+		}
+	}
+	m.size = size
+	return nil
+}
+
+// Forget removes key, or everything if key is empty.
+func (m *Memory) Forget(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if key == "" {
+		m.facts, m.size = nil, 0
+		return
+	}
+	if value, ok := m.facts[key]; ok {
+		delete(m.facts, key)
+		m.size -= len(key) + len(value)
+	}
+}
+
+// Facts returns a copy of the remembered facts and their size in bytes.
+func (m *Memory) Facts() (map[string]string, int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	facts := make(map[string]string, len(m.facts))
+	for key, value := range m.facts {
+		facts[key] = value
+	}
+	return facts, m.size
+}
+
+// MemoryFrame answers a "memory" message with what the connection remembers.
+type MemoryFrame struct {
+	Type           string            `json:"type"`
+	Memory         map[string]string `json:"memory"`
+	Bytes          int               `json:"bytes"`
+	Limit          int               `json:"limit"`
+	ConversationID string            `json:"conversationId,omitempty"`
+}
+
+// memoryContext returns the system message telling the model what it has
+// been asked to remember, one "key: value" line per fact, or nothing if the
+// memory is empty or MEMORY_IN_PROMPT is off.
+func memoryContext(m *Memory) []Message {
+	facts, _ := m.Facts()
+	if !memoryInPrompt || len(facts) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(facts))
+	for key := range facts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	b.WriteString("Facts you have been asked to remember:")
+	for _, key := range keys {
+		fmt.Fprintf(&b, "\n%s: %s", key, facts[key])
+	}
+	return []Message{{Role: "system", Content: b.String()}}
+}
+
+// rememberTool implements the remember tool.
+func rememberTool(ctx context.Context, client *Client, arguments string) (string, error) {
+	var args struct {
+		Key   string `json:"key"`
+		Value string `json:"value"`
+	}
+	if err := json.Unmarshal([]byte(arguments), &args); err != nil {
+		return "", fmt.Errorf("invalid arguments: %w", err)
+	}
+	if err := client.Memory().Set(map[string]string{args.Key: args.Value}); err != nil {
+		return "", err
+	}
+	if args.Value == "" {
+		return "forgotten", nil
+	}
+	return "remembered", nil
+}
+
+// recallTool implements the recall tool.
+func recallTool(ctx context.Context, client *Client, arguments string) (string, error) {
+	facts, _ := client.Memory().Facts()
+	data, err := json.Marshal(facts)
+	return string(data), err
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Prometheus metrics, served at GET /metrics.
+var (
+	metricActiveConnections = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "chat_active_connections",
+		Help: "Number of open WebSocket connections.",
+	})
+	metricMessages = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "chat_messages_total",
+		Help: "Number of chat messages accepted for a reply.",
+	})
+	metricUpstreamDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "chat_upstream_request_duration_seconds",
+		Help:    "Time from sending an upstream request until its stream ended.",
+		Buckets: []float64{0.25, 0.5, 1, 2, 5, 10, 20, 40, 80},
+	})
+	metricTokensStreamed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "chat_tokens_streamed_total",
+		Help: "Number of completion tokens streamed to clients (estimated where the provider doesn't report usage).",
+	})
+	metricBreakerState = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "chat_upstream_breaker_state",
+		Help: "State of the circuit breaker in front of the provider: 0 closed, 1 half-open, 2 open.",
+	})
+	metricErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "chat_errors_total",
+		Help: "Number of errors reported to clients, by type.",
+	}, []string{"type"})
+)
+
+// Error types used as the "type" label of chat_errors_total.
+const (
+	errorTypeUpstream            = "upstream"
+	errorTypeUpstreamBusy        = "upstream_busy"
+	errorTypeUpstreamUnavailable = "upstream_unavailable"
+	errorTypeRateLimited         = "rate_limited"
+	errorTypeQueueFull           = "queue_full"
+	errorTypeInvalidMessage      = "invalid_message"
+	errorTypeModerated           = "moderated"
+	errorTypeBudgetExceeded      = "budget_exceeded"
+	errorTypeConnectionLimit     = "connection_limit"
+	errorTypeUnsupportedProtocol = "unsupported_protocol"
+)
+
+// countError increments chat_errors_total for the given error type.
+func countError(errorType string) {
+	metricErrors.WithLabelValues(errorType).Inc()
+}
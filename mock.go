@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Defaults for MOCK_LLM mode, overridable with MOCK_RESPONSE and MOCK_DELAY.
+const (
+	defaultMockResponse = "This is a canned reply from MOCK_LLM mode. You said: {message}"
+	defaultMockDelay    = 50 * time.Millisecond
+)
+
+// MockProvider answers every request with the same canned text, streamed a
+// word at a time, so the frontend can be developed without an API key.
+// "{message}" in Text is replaced with the last user message.
+type MockProvider struct {
+	Text  string
+	Delay time.Duration
+}
+
+// StreamCompletion implements Provider.
+func (p *MockProvider) StreamCompletion(ctx context.Context, req CompletionRequest) (<-chan StreamEvent, error) {
+	var last string
+	for _, m := range req.Messages {
+		if m.Role == "user" {
+			last = m.Content
+		}
+	}
+	text := strings.ReplaceAll(p.Text, "{message}", last)
+	// Like a real model, the reply stops after max_tokens tokens (words here).
+	tokens := splitWords(text)
+	finish := "stop"
+	if limit := req.Params.MaxTokens; limit != nil && *limit < len(tokens) {
+		tokens, finish = tokens[:*limit], "length"
+	}
+
+	events := make(chan StreamEvent)
+	go func() {
+		defer close(events)
+		for _, token := range tokens {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(p.Delay):
+			}
+			if !sendEvent(ctx, events, StreamEvent{Content: token}) {
+				return
+			}
+		}
+		sendEvent(ctx, events, StreamEvent{FinishReason: finish})
+	}()
+	return events, nil
+}
+
+// splitWords cuts text into tokens that each start with the whitespace before a
+// word, resembling how real models stream.
+func splitWords(text string) []string {
+	var tokens []string
+	start := 0
+	for i, r := range text {
+		if i > start && unicode.IsSpace(r) && !unicode.IsSpace(rune(text[i-1])) {
+			tokens = append(tokens, text[start:i])
+			start = i
+		}
+	}
+	if start < len(text) {
+		tokens = append(tokens, text[start:])
+	}
+	return tokens
+}
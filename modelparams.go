@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// ModelParams are the parameter settings for one model. Defaults fill in
+// parameters the conversation leaves unset, Min and Max clamp the numeric
+// ones (temperature, top_p, max_tokens and the penalties), and Unsupported
+// names parameters the model rejects, which are never sent to it.
+// MaxCompletionTokens sends max_tokens to OpenAI as max_completion_tokens,
+// the only name reasoning models accept.
+type ModelParams struct {
+	Defaults            GenerationParams `json:"defaults"`
+	Min                 GenerationParams `json:"min"`
+	Max                 GenerationParams `json:"max"`
+	Unsupported         []string         `json:"unsupported"`
+	MaxCompletionTokens bool             `json:"max_completion_tokens"`
+}
+
+// modelParams holds the settings per model. MODEL_PARAMS_FILE, a JSON object
+// of model names to ModelParams, replaces or extends them.
+var modelParams = map[string]ModelParams{
+	// Reasoning models only sample at their fixed settings.
+	"o1":      {Unsupported: reasoningUnsupported, MaxCompletionTokens: true},
+	"o1-mini": {Unsupported: reasoningUnsupported, MaxCompletionTokens: true},
+	"o3-mini": {Unsupported: reasoningUnsupported, MaxCompletionTokens: true},
+	// Anthropic's temperature only goes up to 1.
+	"claude-3-5-haiku-latest":  {Max: GenerationParams{Temperature: floatPtr(1)}},
+	"claude-3-5-sonnet-latest": {Max: GenerationParams{Temperature: floatPtr(1)}},
+	"claude-3-opus-latest":     {Max: GenerationParams{Temperature: floatPtr(1)}},
+}
+
+var reasoningUnsupported = []string{"temperature", "top_p", "presence_penalty", "frequency_penalty", "logprobs", "top_logprobs"}
+
+// paramDroppers clear one parameter each, by its JSON name, and report
+// whether it was set.
+var paramDroppers = map[string]func(p *GenerationParams) bool{
+	"temperature":       func(p *GenerationParams) bool { set := p.Temperature != nil; p.Temperature = nil; return set },
+	"top_p":             func(p *GenerationParams) bool { set := p.TopP != nil; p.TopP = nil; return set },
+	"max_tokens":        func(p *GenerationParams) bool { set := p.MaxTokens != nil; p.MaxTokens = nil; return set },
+	"stop":              func(p *GenerationParams) bool { set := len(p.Stop) > 0; p.Stop = nil; return set },
+	"presence_penalty":  func(p *GenerationParams) bool { set := p.PresencePenalty != nil; p.PresencePenalty = nil; return set },
+	"frequency_penalty": func(p *GenerationParams) bool { set := p.FrequencyPenalty != nil; p.FrequencyPenalty = nil; return set },
+	"seed":              func(p *GenerationParams) bool { set := p.Seed != nil; p.Seed = nil; return set },
+	"response_format":   func(p *GenerationParams) bool { set := p.ResponseFormat != nil; p.ResponseFormat = nil; return set },
+	"n":                 func(p *GenerationParams) bool { set := p.N != nil; p.N = nil; return set },
+	"logprobs":          func(p *GenerationParams) bool { set := p.Logprobs != nil; p.Logprobs = nil; return set },
+	"top_logprobs":      func(p *GenerationParams) bool { set := p.TopLogprobs != nil; p.TopLogprobs = nil; return set },
+}
+
+// loadModelParams reads MODEL_PARAMS_FILE. Its entries replace the built-in
+// settings of the models they name.
+func loadModelParams(path string) error {
+	loaded, err := readModelParams(path)
+	if err != nil {
+		return err
+	}
+	for model, mp := range loaded {
+		modelParams[model] = mp
+	}
+	return nil
+}
+
+// readModelParams reads and checks the entries of MODEL_PARAMS_FILE; an
+// empty path has none.
+func readModelParams(path string) (map[string]ModelParams, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading MODEL_PARAMS_FILE: %w", err)
+	}
+	var loaded map[string]ModelParams
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		return nil, fmt.Errorf("error parsing MODEL_PARAMS_FILE: %w", err)
+	}
+	for model, mp := range loaded {
+		if err := mp.Defaults.Validate(); err != nil {
+			return nil, fmt.Errorf("MODEL_PARAMS_FILE: defaults for %q: %w", model, err)
+		}
+		if err := mp.Min.Validate(); err != nil {
+			return nil, fmt.Errorf("MODEL_PARAMS_FILE: min for %q: %w", model, err)
+		}
+		if err := mp.Max.Validate(); err != nil {
+			return nil, fmt.Errorf("MODEL_PARAMS_FILE: max for %q: %w", model, err)
+		}
+		if err := checkLimits(mp.Min, mp.Max); err != nil {
+			return nil, fmt.Errorf("MODEL_PARAMS_FILE: limits for %q: %w", model, err)
+		}
+		for _, name := range mp.Unsupported {
+			if paramDroppers[name] == nil {
+				return nil, fmt.Errorf("MODEL_PARAMS_FILE: unknown parameter %q for %q", name, model)
+			}
+		}
+	}
+	return loaded, nil
+}
+
+// checkLimits reports a parameter whose minimum is above its maximum.
+func checkLimits(lo, hi GenerationParams) error {
+	floats := []struct {
+		name   string
+		lo, hi *float64
+	}{
+		{"temperature", lo.Temperature, hi.Temperature},
+		{"top_p", lo.TopP, hi.TopP},
+		{"presence_penalty", lo.PresencePenalty, hi.PresencePenalty},
+		{"frequency_penalty", lo.FrequencyPenalty, hi.FrequencyPenalty},
+	}
+	for _, f := range floats {
+		if f.lo != nil && f.hi != nil && *f.lo > *f.hi {
+			return fmt.Errorf("%s min %g is above max %g", f.name, *f.lo, *f.hi)
+		}
+	}
+	if lo.MaxTokens != nil && hi.MaxTokens != nil && *lo.MaxTokens > *hi.MaxTokens {
+		return fmt.Errorf("max_tokens min %d is above max %d", *lo.MaxTokens, *hi.MaxTokens)
+	}
+	return nil
+}
+
+// applyModelParams returns p with model's defaults, limits and unsupported
+// parameters applied, and the sorted names of the parameters that were set
+// but had to be dropped.
+func applyModelParams(model string, p GenerationParams) (GenerationParams, []string) {
+	mp, ok := modelParams[model]
+	if !ok {
+		return p, nil
+	}
+	p = mp.Defaults.Merge(p)
+	p.Temperature = clamp(p.Temperature, mp.Min.Temperature, mp.Max.Temperature)
+	p.TopP = clamp(p.TopP, mp.Min.TopP, mp.Max.TopP)
+	p.MaxTokens = clamp(p.MaxTokens, mp.Min.MaxTokens, mp.Max.MaxTokens)
+	p.PresencePenalty = clamp(p.PresencePenalty, mp.Min.PresencePenalty, mp.Max.PresencePenalty)
+	p.FrequencyPenalty = clamp(p.FrequencyPenalty, mp.Min.FrequencyPenalty, mp.Max.FrequencyPenalty)
+	var dropped []string
+	for _, name := range mp.Unsupported {
+		if paramDroppers[name](&p) {
+			dropped = append(dropped, name)
+		}
+	}
+	sort.Strings(dropped)
+	return p, dropped
+}
+
+// clamp returns v limited to lo and hi where they are set. v itself is never
+// changed, since it may be shared with the conversation.
+func clamp[T int | float64](v, lo, hi *T) *T {
+	if v == nil {
+		return nil
+	}
+	if lo != nil && *v < *lo {
+		return lo
+	}
+	if hi != nil && *v > *hi {
+		return hi
+	}
+	return v
+}
+
+func floatPtr(f float64) *float64 { return &f }
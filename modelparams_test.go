@@ -0,0 +1,65 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// loadParamsFile writes data to a MODEL_PARAMS_FILE and loads it, putting the
+// built-in settings back when the test ends.
+func loadParamsFile(t *testing.T, data string) error {
+	t.Helper()
+	saved := make(map[string]ModelParams, len(modelParams))
+	for model, mp := range modelParams {
+		saved[model] = mp
+	}
+	t.Cleanup(func() { modelParams = saved })
+	path := filepath.Join(t.TempDir(), "params.json")
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return loadModelParams(path)
+}
+
+func TestLoadModelParamsLimits(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want string
+	}{
+		{"valid", `{"gpt-4o":{"min":{"temperature":0.2},"max":{"temperature":1.5,"max_tokens":4096}}}`, ""},
+		{"min above max", `{"gpt-4o":{"min":{"temperature":1.5},"max":{"temperature":0.5}}}`, "temperature min 1.5 is above max 0.5"},
+		{"max_tokens min above max", `{"gpt-4o":{"min":{"max_tokens":500},"max":{"max_tokens":100}}}`, "max_tokens min 500 is above max 100"},
+		{"max temperature out of range", `{"gpt-4o":{"max":{"temperature":3}}}`, `max for "gpt-4o": temperature must be between 0 and 2`},
+		{"min top_p out of range", `{"gpt-4o":{"min":{"top_p":-1}}}`, `min for "gpt-4o": top_p must be between 0 and 1`},
+		{"bad default", `{"gpt-4o":{"defaults":{"presence_penalty":5}}}`, `defaults for "gpt-4o"`},
+		{"unknown parameter", `{"gpt-4o":{"unsupported":["warmth"]}}`, `unknown parameter "warmth"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := loadParamsFile(t, tt.data)
+			if tt.want == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error = %v, want one containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestReasoningModelsAllowed(t *testing.T) {
+	for _, model := range []string{"o1", "o1-mini", "o3-mini"} {
+		if !allowedModels[model] {
+			t.Errorf("%s has model parameters but is not in allowedModels", model)
+		}
+		if !modelParams[model].MaxCompletionTokens {
+			t.Errorf("%s does not send max_completion_tokens", model)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	// modelsCacheTTL is how long the upstream model list is used before it is
+	// fetched again.
+	modelsCacheTTL = 5 * time.Minute
+	// modelsFetchTimeout bounds one fetch of the upstream model list.
+	modelsFetchTimeout = 10 * time.Second
+)
+
+// nonChatModelPrefixes are model families listed by OpenAI-compatible
+// backends that can't be used for chat completions.
+var nonChatModelPrefixes = []string{
+	"text-embedding", "embedding", "whisper", "tts", "dall-e", "gpt-image",
+	"text-moderation", "omni-moderation", "davinci", "babbage",
+}
+
+// ModelInfo describes one model clients may choose.
+type ModelInfo struct {
+	ID      string `json:"id"`
+	Default bool   `json:"default,omitempty"`
+	Vision  bool   `json:"vision,omitempty"`
+}
+
+// modelCache holds the models the backend reported, refreshed in the
+// background once they are older than modelsCacheTTL.
+type modelCache struct {
+	mu         sync.Mutex
+	models     []string
+	fetched    time.Time
+	refreshing bool
+}
+
+var upstreamModels = &modelCache{}
+
+// Get returns the cached upstream model list, or nil if the backend can't list
+// models or hasn't answered yet. A stale list is returned as it is while a
+// fresh one is fetched, so callers never wait for the backend.
+func (mc *modelCache) Get() []string {
+	lister, ok := llm.(ModelLister)
+	if !ok {
+		return nil
+	}
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	if time.Since(mc.fetched) >= modelsCacheTTL && !mc.refreshing {
+		mc.refreshing = true
+		go mc.refresh(lister)
+	}
+	return mc.models
+}
+
+// refresh fetches the model list. A failed fetch keeps the previous list; it
+// is retried once the TTL has passed again.
+func (mc *modelCache) refresh(lister ModelLister) {
+	ctx, cancel := context.WithTimeout(context.Background(), modelsFetchTimeout)
+	defer cancel()
+	list, err := lister.ListModels(ctx)
+	if err != nil {
+		slog.Warn("error listing upstream models", "err", err)
+	}
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	if err == nil {
+		mc.models = list
+	}
+	mc.fetched = time.Now()
+	mc.refreshing = false
+}
+
+// isChatModel reports whether a listed model can be used for chat completions.
+func isChatModel(id string) bool {
+	for _, prefix := range nonChatModelPrefixes {
+		if strings.HasPrefix(id, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// handleListModels lists the models clients may choose, e.g. for a dropdown.
+// It is the allowlist, trimmed to the chat models the backend actually
+// offers once it has reported them; until then, or if none of them match, the
+// whole allowlist is returned.
+func handleListModels(c *fiber.Ctx) error {
+	var ids []string
+	for _, id := range upstreamModels.Get() {
+		if allowedModels[id] && isChatModel(id) {
+			ids = append(ids, id)
+		}
+	}
+	source := "upstream"
+	if len(ids) == 0 {
+		source = "allowlist"
+		for id := range allowedModels {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	list := make([]ModelInfo, 0, len(ids))
+	for _, id := range ids {
+		list = append(list, ModelInfo{ID: id, Default: id == defaultModel, Vision: visionModels[id]})
+	}
+	return c.JSON(fiber.Map{"models": list, "source": source})
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// defaultModerationModel is the OpenAI model that checks user input with
+// MODERATION=true. It can be overridden with MODERATION_MODEL.
+const defaultModerationModel = "omni-moderation-latest"
+
+// moderationTimeout bounds one moderation check, so a slow moderator can't
+// hold up every message.
+const moderationTimeout = 10 * time.Second
+
+// ErrModerationUnavailable is returned for input that couldn't be checked
+// when MODERATION_FAIL_CLOSED is set.
+var ErrModerationUnavailable = errors.New("content moderation is unavailable, please try again shortly")
+
+// Moderator checks user input before it is sent to the model. Implementations
+// other than OpenAIModerator can be plugged in by setting moderator.
+type Moderator interface {
+	Moderate(ctx context.Context, text string) (ModerationResult, error)
+}
+
+// ModerationResult is a moderator's verdict on one input. Categories names
+// what it was flagged for, if the moderator says.
+type ModerationResult struct {
+	Flagged    bool
+	Categories []string
+}
+
+// ModerationError is returned for input the moderator flagged. Its message
+// is meant for the client.
+type ModerationError struct {
+	Categories []string
+}
+
+func (e *ModerationError) Error() string {
+	if len(e.Categories) == 0 {
+		return "your message was flagged by content moderation and was not sent"
+	}
+	return fmt.Sprintf("your message was flagged by content moderation (%s) and was not sent", strings.Join(e.Categories, ", "))
+}
+
+// moderator checks every user message before it reaches the model; nil
+// turns moderation off. If it fails, messages are let through unless
+// moderationFailClosed is set.
+var (
+	moderator            Moderator
+	moderationFailClosed bool
+)
+
+// moderate runs text through the moderator. It returns a *ModerationError if
+// the text was flagged, and ErrModerationUnavailable if it couldn't be
+// checked and moderation fails closed.
+func moderate(ctx context.Context, text string) error {
+	if moderator == nil || strings.TrimSpace(text) == "" {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, moderationTimeout)
+	defer cancel()
+	result, err := moderator.Moderate(ctx, text)
+	if err != nil {
+		loggerFrom(ctx).Warn("moderation check failed", "fail_closed", moderationFailClosed, "err", err)
+		if moderationFailClosed {
+			return ErrModerationUnavailable
+		}
+		return nil
+	}
+	if result.Flagged {
+		loggerFrom(ctx).Info("message flagged by moderation", "categories", result.Categories)
+		return &ModerationError{Categories: result.Categories}
+	}
+	return nil
+}
+
+// OpenAIModerator implements Moderator with OpenAI's moderation endpoint.
+type OpenAIModerator struct {
+	APIKey string
+	// Keys, if set, replaces APIKey the same way it does for OpenAIProvider.
+	Keys   *KeyPool
+	URL    string
+	Model  string
+	Client *http.Client
+}
+
+// newOpenAIModerator returns an OpenAIModerator for the API at baseURL.
+func newOpenAIModerator(apiKey, baseURL, model string) *OpenAIModerator {
+	return &OpenAIModerator{
+		APIKey: apiKey,
+		URL:    strings.TrimRight(baseURL, "/") + "/moderations",
+		Model:  model,
+		Client: httpClient,
+	}
+}
+
+// OpenAIModeration is the response of the moderations endpoint.
+type OpenAIModeration struct {
+	Results []struct {
+		Flagged    bool            `json:"flagged"`
+		Categories map[string]bool `json:"categories"`
+	} `json:"results"`
+}
+
+// Moderate implements Moderator.
+func (m *OpenAIModerator) Moderate(ctx context.Context, text string) (ModerationResult, error) {
+	reqBody, err := json.Marshal(map[string]string{"model": m.Model, "input": text})
+	if err != nil {
+		return ModerationResult{}, fmt.Errorf("%w: %w", ErrMarshal, err)
+	}
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	key := m.APIKey
+	if m.Keys != nil {
+		key = m.Keys.Next()
+	}
+	header.Set("Authorization", "Bearer "+key)
+	resp, err := doWithRetry(ctx, m.Client, "POST", m.URL, reqBody, header, maxRetries)
+	if err != nil {
+		return ModerationResult{}, fmt.Errorf("error calling OpenAI moderation API: %w", err)
+	}
+	defer resp.Body.Close()
+	if m.Keys != nil && isKeyRejection(resp.StatusCode) {
+		m.Keys.MarkUnavailable(key)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return ModerationResult{}, readUpstreamError("OpenAI", resp)
+	}
+	var moderation OpenAIModeration
+	if err := json.NewDecoder(resp.Body).Decode(&moderation); err != nil {
+		return ModerationResult{}, fmt.Errorf("%w (moderation): %w", ErrDecode, err)
+	}
+	var result ModerationResult
+	for _, r := range moderation.Results {
+		result.Flagged = result.Flagged || r.Flagged
+		for category, flagged := range r.Categories {
+			if flagged {
+				result.Categories = append(result.Categories, category)
+			}
+		}
+	}
+	sort.Strings(result.Categories)
+	return result, nil
+}
+
+// countModerationError counts an error returned by moderate.
+func countModerationError(err error) {
+	if errors.Is(err, ErrModerationUnavailable) {
+		countError(errorTypeUpstreamUnavailable)
+	} else {
+		countError(errorTypeModerated)
+	}
+}
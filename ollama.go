@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// defaultOllamaHost is where a local Ollama server listens by default.
+// It can be overridden with the OLLAMA_HOST environment variable.
+const defaultOllamaHost = "http://localhost:11434"
+
+// defaultOllamaModel is used when OLLAMA_MODEL is not set.
+const defaultOllamaModel = "llama3.2"
+
+// OllamaRequest represents a request to Ollama's /api/chat endpoint.
+// Sampling parameters go in Options, using Ollama's own names.
+type OllamaRequest struct {
+	Model    string         `json:"model"`
+	Messages []Message      `json:"messages"`
+	Stream   bool           `json:"stream"`
+	Options  *OllamaOptions `json:"options,omitempty"`
+}
+
+// OllamaOptions holds the model parameters Ollama accepts per request.
+type OllamaOptions struct {
+	Temperature *float64 `json:"temperature,omitempty"`
+	TopP        *float64 `json:"top_p,omitempty"`
+	NumPredict  *int     `json:"num_predict,omitempty"`
+	Stop        []string `json:"stop,omitempty"`
+
+	PresencePenalty  *float64 `json:"presence_penalty,omitempty"`
+	FrequencyPenalty *float64 `json:"frequency_penalty,omitempty"`
+	Seed             *int     `json:"seed,omitempty"`
+}
+
+// OllamaResponse represents one line of Ollama's streamed reply.
+// Each line is a complete JSON object; the last one has Done set to true,
+// and DoneReason "length" if the reply hit the num_predict limit.
+// Thinking models stream their reasoning in message.thinking.
+type OllamaResponse struct {
+	Message struct {
+		Content  string `json:"content"`
+		Thinking string `json:"thinking"`
+	} `json:"message"`
+	Done       bool   `json:"done"`
+	DoneReason string `json:"done_reason"`
+	Error      string `json:"error"`
+	// The final line reports token counts.
+	PromptEvalCount int `json:"prompt_eval_count"`
+	EvalCount       int `json:"eval_count"`
+}
+
+// OllamaProvider streams completions from a local Ollama server.
+type OllamaProvider struct {
+	URL    string
+	Client *http.Client
+}
+
+// StreamCompletion implements Provider.
+func (p *OllamaProvider) StreamCompletion(ctx context.Context, req CompletionRequest) (<-chan StreamEvent, error) {
+	ollamaReq := OllamaRequest{
+		Model:    req.Model,
+		Messages: req.Messages,
+		Stream:   true,
+	}
+	if !req.Params.IsZero() {
+		ollamaReq.Options = &OllamaOptions{
+			Temperature:      req.Params.Temperature,
+			TopP:             req.Params.TopP,
+			NumPredict:       req.Params.MaxTokens,
+			Stop:             req.Params.Stop,
+			PresencePenalty:  req.Params.PresencePenalty,
+			FrequencyPenalty: req.Params.FrequencyPenalty,
+			Seed:             req.Params.Seed,
+		}
+	}
+	reqBody, err := json.Marshal(ollamaReq)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrMarshal, err)
+	}
+
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	resp, err := doWithRetry(ctx, p.Client, "POST", p.URL, reqBody, header, maxRetries)
+	if err != nil {
+		return nil, fmt.Errorf("error calling Ollama: %w", err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		return nil, readUpstreamError("Ollama", resp)
+	}
+
+	events := make(chan StreamEvent)
+	go func() {
+		defer close(events)
+		defer resp.Body.Close()
+		readOllamaStream(ctx, resp.Body, events)
+	}()
+	return events, nil
+}
+
+// readOllamaStream reads Ollama's newline-delimited JSON and sends each content chunk to events.
+func readOllamaStream(ctx context.Context, body io.Reader, events chan<- StreamEvent) {
+	defer closeOnCancel(ctx, body)()
+	reader := bufio.NewReader(body)
+	for {
+		line, err := reader.ReadString('\n')
+		// The final line may not end in a newline, so handle any data before the error.
+		if line = strings.TrimSpace(line); line != "" {
+			debugResponseLine(ctx, "ollama", line)
+			var chunk OllamaResponse
+			if jsonErr := json.Unmarshal([]byte(line), &chunk); jsonErr != nil {
+				loggerFrom(ctx).Warn("skipping malformed stream line", "provider", "ollama", "err", jsonErr)
+			} else {
+				if chunk.Error != "" {
+					sendStreamError(ctx, events, "ollama", fmt.Errorf("%w: Ollama: %s", ErrUpstream, chunk.Error))
+					return
+				}
+				if chunk.Message.Thinking != "" {
+					if !sendEvent(ctx, events, StreamEvent{Reasoning: chunk.Message.Thinking}) {
+						return
+					}
+				}
+				if chunk.Message.Content != "" {
+					if !sendEvent(ctx, events, StreamEvent{Content: chunk.Message.Content}) {
+						return
+					}
+				}
+				if chunk.Done {
+					if chunk.PromptEvalCount > 0 || chunk.EvalCount > 0 {
+						usage := &Usage{PromptTokens: chunk.PromptEvalCount, CompletionTokens: chunk.EvalCount}
+						sendEvent(ctx, events, StreamEvent{Usage: usage})
+					}
+					// Ollama's reasons, "stop" and "length", are the same as OpenAI's.
+					if chunk.DoneReason != "" {
+						sendEvent(ctx, events, StreamEvent{FinishReason: chunk.DoneReason})
+					}
+					return
+				}
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				sendStreamError(ctx, events, "ollama", fmt.Errorf("error reading Ollama stream: %w", err))
+			}
+			return
+		}
+	}
+}
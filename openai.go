@@ -0,0 +1,424 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// defaultOpenAIBaseURL is OpenAI's API. Any backend that speaks the same API
+// (Together, Groq, LocalAI, vLLM, ...) can be used instead via OPENAI_BASE_URL.
+const defaultOpenAIBaseURL = "https://api.openai.com/v1"
+
+// OpenAIRequest represents the structure of a request to the OpenAI API.
+// The optional sampling parameters are pointers so unset values are omitted.
+type OpenAIRequest struct {
+	Model       string    `json:"model"`
+	Messages    []Message `json:"messages"`
+	Stream      bool      `json:"stream"`
+	Temperature *float64  `json:"temperature,omitempty"`
+	TopP        *float64  `json:"top_p,omitempty"`
+	MaxTokens   *int      `json:"max_tokens,omitempty"`
+	Stop        []string  `json:"stop,omitempty"`
+	// MaxCompletionTokens replaces MaxTokens for reasoning models, which
+	// count their hidden reasoning against it too.
+	MaxCompletionTokens *int `json:"max_completion_tokens,omitempty"`
+	// PresencePenalty and FrequencyPenalty are between -2 and 2.
+	PresencePenalty  *float64 `json:"presence_penalty,omitempty"`
+	FrequencyPenalty *float64 `json:"frequency_penalty,omitempty"`
+	Seed             *int     `json:"seed,omitempty"`
+	// ResponseFormat asks for JSON output.
+	ResponseFormat *ResponseFormat `json:"response_format,omitempty"`
+	// N is the number of alternative replies; their chunks are interleaved,
+	// each tagged with its choice index.
+	N *int `json:"n,omitempty"`
+	// Logprobs adds the log probability of every token to the stream.
+	Logprobs    bool `json:"logprobs,omitempty"`
+	TopLogprobs *int `json:"top_logprobs,omitempty"`
+	// Tools lists the functions the model may call.
+	Tools []ToolDefinition `json:"tools,omitempty"`
+	// User is a stable ID of the end user, for OpenAI's abuse monitoring.
+	User string `json:"user,omitempty"`
+	// StreamOptions asks for a final chunk with token usage when streaming.
+	StreamOptions *OpenAIStreamOptions `json:"stream_options,omitempty"`
+}
+
+// OpenAIStreamOptions configures what OpenAI includes in a stream.
+type OpenAIStreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+// OpenAIUsage reports how many tokens a request consumed.
+type OpenAIUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+}
+
+// OpenAIResponse represents the structure of a streamed chunk from the OpenAI API.
+// With include_usage set, the last chunk has no choices and carries Usage instead.
+// Tool calls arrive in pieces: the first delta for each index carries the ID and
+// function name, and later ones append to the arguments.
+// Reasoning models stream their thinking in reasoning (or reasoning_content,
+// depending on the backend) before the answer. Every chunk repeats the system
+// fingerprint. With n > 1 the chunks of all choices are interleaved. With
+// logprobs set, each chunk also has the log probabilities of its tokens.
+type OpenAIResponse struct {
+	Choices []struct {
+		Index int `json:"index"`
+		Delta struct {
+			Content          string `json:"content"`
+			Reasoning        string `json:"reasoning"`
+			ReasoningContent string `json:"reasoning_content"`
+			ToolCalls        []struct {
+				Index    int              `json:"index"`
+				ID       string           `json:"id"`
+				Type     string           `json:"type"`
+				Function ToolFunctionCall `json:"function"`
+			} `json:"tool_calls"`
+		} `json:"delta"`
+		Logprobs *struct {
+			Content []TokenLogprob `json:"content"`
+		} `json:"logprobs"`
+		FinishReason string `json:"finish_reason"`
+	} `json:"choices"`
+	Usage *OpenAIUsage `json:"usage"`
+	// SystemFingerprint identifies the backend configuration that produced the
+	// reply; replies with the same seed are only comparable if it matches.
+	SystemFingerprint string `json:"system_fingerprint"`
+}
+
+// OpenAICompletion represents a non-streaming response from the OpenAI API.
+type OpenAICompletion struct {
+	Choices []struct {
+		Message Message `json:"message"`
+	} `json:"choices"`
+}
+
+// OpenAIProvider streams completions from the OpenAI chat completions API.
+// URL is the chat completions endpoint and ModelsURL a cheap authenticated
+// endpoint used to check that the API is reachable. The key is sent in
+// AuthHeader, prefixed with AuthScheme unless that is empty. With Keys set,
+// each request takes its key from the pool instead of APIKey. StreamUsage
+// asks streams for a final chunk with token usage, which not every
+// OpenAI-compatible backend accepts.
+type OpenAIProvider struct {
+	APIKey      string
+	Keys        *KeyPool
+	URL         string
+	ModelsURL   string
+	AuthHeader  string
+	AuthScheme  string
+	StreamUsage bool
+	Client      *http.Client
+}
+
+// newOpenAIProvider returns an OpenAIProvider for the API at baseURL.
+func newOpenAIProvider(apiKey, baseURL, authHeader, authScheme string) *OpenAIProvider {
+	baseURL = strings.TrimRight(baseURL, "/")
+	return &OpenAIProvider{
+		APIKey:     apiKey,
+		URL:        baseURL + "/chat/completions",
+		ModelsURL:  baseURL + "/models",
+		AuthHeader: authHeader,
+		AuthScheme: authScheme,
+		Client:     httpClient,
+	}
+}
+
+// key returns the API key for the next request.
+func (p *OpenAIProvider) key() string {
+	if p.Keys != nil {
+		return p.Keys.Next()
+	}
+	return p.APIKey
+}
+
+// setAuth adds key to header.
+func (p *OpenAIProvider) setAuth(header http.Header, key string) {
+	value := key
+	if p.AuthScheme != "" {
+		value = p.AuthScheme + " " + value
+	}
+	header.Set(p.AuthHeader, value)
+}
+
+// CheckConfig implements ConfigChecker.
+func (p *OpenAIProvider) CheckConfig() error {
+	if p.APIKey == "" && p.Keys == nil {
+		return fmt.Errorf("%w: OPENAI_API_KEY is not set", ErrNotConfigured)
+	}
+	return nil
+}
+
+// StreamCompletion implements Provider.
+func (p *OpenAIProvider) StreamCompletion(ctx context.Context, req CompletionRequest) (<-chan StreamEvent, error) {
+	// Without a key the request would only come back as a confusing 401.
+	if err := p.CheckConfig(); err != nil {
+		return nil, err
+	}
+	reqBody, err := json.Marshal(p.request(req, true))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrMarshal, err)
+	}
+
+	// The request carries the caller's context so it is aborted if the client goes away.
+	// Transient failures (rate limits, 5xx, network errors) are retried with backoff.
+	resp, err := p.post(ctx, reqBody)
+	if err != nil {
+		return nil, fmt.Errorf("error calling OpenAI API: %w", err)
+	}
+
+	// Non-2xx responses carry a JSON error body instead of a stream.
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		return nil, readUpstreamError("OpenAI", resp)
+	}
+
+	events := make(chan StreamEvent)
+	go func() {
+		defer close(events)
+		defer resp.Body.Close()
+		readOpenAIStream(ctx, resp.Body, events)
+	}()
+	return events, nil
+}
+
+// Complete implements Completer using a regular, non-streaming request.
+func (p *OpenAIProvider) Complete(ctx context.Context, req CompletionRequest) (string, error) {
+	if err := p.CheckConfig(); err != nil {
+		return "", err
+	}
+	reqBody, err := json.Marshal(p.request(req, false))
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrMarshal, err)
+	}
+
+	resp, err := p.post(ctx, reqBody)
+	if err != nil {
+		return "", fmt.Errorf("error calling OpenAI API: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", readUpstreamError("OpenAI", resp)
+	}
+
+	var completion OpenAICompletion
+	if err := json.NewDecoder(resp.Body).Decode(&completion); err != nil {
+		return "", fmt.Errorf("%w from OpenAI: %w", ErrDecode, err)
+	}
+	if len(completion.Choices) == 0 {
+		return "", fmt.Errorf("OpenAI returned no choices")
+	}
+	return completion.Choices[0].Message.Content, nil
+}
+
+// request builds the body of a completion request. Only a stream asks for
+// several choices, log probabilities and the final usage chunk; a regular
+// completion returns just the first choice's text.
+func (p *OpenAIProvider) request(req CompletionRequest, stream bool) OpenAIRequest {
+	r := OpenAIRequest{
+		Model:            req.Model,
+		Messages:         req.Messages,
+		Stream:           stream,
+		Temperature:      req.Params.Temperature,
+		TopP:             req.Params.TopP,
+		MaxTokens:        req.Params.MaxTokens,
+		Stop:             req.Params.Stop,
+		PresencePenalty:  req.Params.PresencePenalty,
+		FrequencyPenalty: req.Params.FrequencyPenalty,
+		Seed:             req.Params.Seed,
+		ResponseFormat:   req.Params.ResponseFormat,
+		Tools:            req.Tools,
+		User:             req.User,
+	}
+	if modelParams[req.Model].MaxCompletionTokens {
+		r.MaxCompletionTokens, r.MaxTokens = r.MaxTokens, nil
+	}
+	if stream {
+		r.N = req.Params.N
+		r.Logprobs = req.Params.WantsLogprobs()
+		r.TopLogprobs = req.Params.TopLogprobs
+		if p.StreamUsage {
+			r.StreamOptions = &OpenAIStreamOptions{IncludeUsage: true}
+		}
+	}
+	return r
+}
+
+// post sends a completion request.
+func (p *OpenAIProvider) post(ctx context.Context, body []byte) (*http.Response, error) {
+	return p.send(ctx, "POST", p.URL, body)
+}
+
+// send sends a request to the API, retrying transient failures. With a key
+// pool, a key that is rejected (401) or still rate limited after
+// doWithRetry's retries (429) is put on cooldown and the request is tried
+// again with the next key, until no key is left to try.
+func (p *OpenAIProvider) send(ctx context.Context, method, url string, body []byte) (*http.Response, error) {
+	for {
+		key := p.key()
+		header := http.Header{}
+		if body != nil {
+			header.Set("Content-Type", "application/json")
+		}
+		p.setAuth(header, key)
+		resp, err := doWithRetry(ctx, p.Client, method, url, body, header, maxRetries)
+		if err != nil || p.Keys == nil || !isKeyRejection(resp.StatusCode) {
+			return resp, err
+		}
+		p.Keys.MarkUnavailable(key)
+		loggerFrom(ctx).Warn("OpenAI rejected an API key, skipping it", "status", resp.StatusCode, "cooldown", keyCooldown)
+		if p.Keys.Available() == 0 {
+			return resp, nil
+		}
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+		resp.Body.Close()
+	}
+}
+
+// readOpenAIStream reads OpenAI's server-sent events and sends each content delta to events.
+// Each event carries a JSON chunk, and the stream ends with a "[DONE]" event.
+// Tool call deltas are assembled and sent as a single event when the choice
+// finishes with "tool_calls", or at the end of the stream.
+func readOpenAIStream(ctx context.Context, body io.Reader, events chan<- StreamEvent) {
+	defer closeOnCancel(ctx, body)()
+	reader := newSSEReader(body)
+	var toolCalls []ToolCall
+	fingerprint := ""
+	for {
+		// Read the next complete event of the stream.
+		data, err := reader.Next()
+		if err != nil {
+			// EOF means the stream finished, even if a compatible backend left
+			// out [DONE]; a cancelled context means the client left.
+			if err != io.EOF {
+				sendStreamError(ctx, events, "openai", fmt.Errorf("error reading OpenAI stream: %w", err))
+			} else if len(toolCalls) > 0 {
+				sendEvent(ctx, events, StreamEvent{ToolCalls: toolCalls})
+			}
+			return
+		}
+		debugResponseLine(ctx, "openai", data)
+
+		// The [DONE] sentinel marks the end of the reply.
+		if data == "[DONE]" {
+			if len(toolCalls) > 0 {
+				sendEvent(ctx, events, StreamEvent{ToolCalls: toolCalls})
+			}
+			return
+		}
+		var aiResp OpenAIResponse
+		if err := json.Unmarshal([]byte(data), &aiResp); err != nil {
+			loggerFrom(ctx).Warn("skipping malformed stream event", "provider", "openai", "err", err)
+			continue
+		}
+		if aiResp.SystemFingerprint != "" && aiResp.SystemFingerprint != fingerprint {
+			fingerprint = aiResp.SystemFingerprint
+			if !sendEvent(ctx, events, StreamEvent{SystemFingerprint: fingerprint}) {
+				return
+			}
+		}
+		if aiResp.Usage != nil {
+			usage := &Usage{
+				PromptTokens:     aiResp.Usage.PromptTokens,
+				CompletionTokens: aiResp.Usage.CompletionTokens,
+			}
+			if !sendEvent(ctx, events, StreamEvent{Usage: usage}) {
+				return
+			}
+		}
+		// With n > 1 each chunk belongs to one of the choices. Tools and
+		// reasoning are only followed for the first; the others just stream text.
+		for _, choice := range aiResp.Choices {
+			if choice.Index > 0 {
+				if choice.Delta.Content != "" && !sendEvent(ctx, events, StreamEvent{Content: choice.Delta.Content, Choice: choice.Index}) {
+					return
+				}
+				continue
+			}
+			for _, delta := range choice.Delta.ToolCalls {
+				for len(toolCalls) <= delta.Index {
+					toolCalls = append(toolCalls, ToolCall{Type: "function"})
+				}
+				call := &toolCalls[delta.Index]
+				if delta.ID != "" {
+					call.ID = delta.ID
+				}
+				if delta.Function.Name != "" {
+					call.Function.Name = delta.Function.Name
+				}
+				call.Function.Arguments += delta.Function.Arguments
+			}
+			if reasoning := choice.Delta.Reasoning + choice.Delta.ReasoningContent; reasoning != "" {
+				if !sendEvent(ctx, events, StreamEvent{Reasoning: reasoning}) {
+					return
+				}
+			}
+			event := StreamEvent{Content: choice.Delta.Content, FinishReason: choice.FinishReason}
+			if choice.Logprobs != nil {
+				event.Logprobs = choice.Logprobs.Content
+			}
+			if (event.Content != "" || event.FinishReason != "") && !sendEvent(ctx, events, event) {
+				return
+			}
+			// The calls are complete once the choice finishes for them; the
+			// usage chunk or [DONE] may still follow, or never come.
+			if choice.FinishReason == "tool_calls" && len(toolCalls) > 0 {
+				if !sendEvent(ctx, events, StreamEvent{ToolCalls: toolCalls}) {
+					return
+				}
+				toolCalls = nil
+			}
+		}
+	}
+}
+
+// OpenAIModelList is the response of the models endpoint.
+type OpenAIModelList struct {
+	Data []struct {
+		ID string `json:"id"`
+	} `json:"data"`
+}
+
+// ListModels implements ModelLister using the models endpoint, with the same
+// base URL and authentication as completions.
+func (p *OpenAIProvider) ListModels(ctx context.Context) ([]string, error) {
+	if err := p.CheckConfig(); err != nil {
+		return nil, err
+	}
+	resp, err := p.send(ctx, "GET", p.ModelsURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, readUpstreamError("OpenAI", resp)
+	}
+	var list OpenAIModelList
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, fmt.Errorf("%w (model list): %w", ErrDecode, err)
+	}
+	models := make([]string, 0, len(list.Data))
+	for _, m := range list.Data {
+		models = append(models, m.ID)
+	}
+	return models, nil
+}
+
+// Ping implements Pinger by listing models, which verifies both reachability and the API key.
+// Like completions, it is retried and moves on to the next key in the pool,
+// so one rate-limited key doesn't make the API look down.
+func (p *OpenAIProvider) Ping(ctx context.Context) error {
+	resp, err := p.send(ctx, "GET", p.ModelsURL, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("OpenAI returned status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	fastws "github.com/fasthttp/websocket"
+)
+
+// sseWriter writes a canned OpenAI stream, flushing every event so the
+// server reads them one at a time.
+type sseWriter struct {
+	w http.ResponseWriter
+}
+
+// event sends one "data:" event.
+func (s sseWriter) event(data string) {
+	fmt.Fprintf(s.w, "data: %s\n\n", data)
+	s.w.(http.Flusher).Flush()
+}
+
+// raw sends lines as they are, for comments and malformed events.
+func (s sseWriter) raw(lines string) {
+	fmt.Fprint(s.w, lines)
+	s.w.(http.Flusher).Flush()
+}
+
+// content sends a chunk of the reply's text.
+func (s sseWriter) content(text string) {
+	data, _ := json.Marshal(text)
+	s.event(`{"choices":[{"index":0,"delta":{"content":` + string(data) + `}}]}`)
+}
+
+// finish ends the reply with reason and the [DONE] sentinel.
+func (s sseWriter) finish(reason string) {
+	s.event(`{"choices":[{"index":0,"delta":{},"finish_reason":"` + reason + `"}]}`)
+	s.event("[DONE]")
+}
+
+// startMockOpenAI runs an OpenAI API that answers the nth chat completion
+// request (counting from 0) with handle, and returns a provider calling it.
+func startMockOpenAI(t *testing.T, handle func(n int, req OpenAIRequest, s sseWriter, r *http.Request)) *OpenAIProvider {
+	t.Helper()
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/chat/completions" || r.Header.Get("Authorization") != "Bearer sk-test" {
+			http.Error(w, `{"error":{"message":"unexpected request"}}`, http.StatusBadRequest)
+			return
+		}
+		var req OpenAIRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || !req.Stream {
+			http.Error(w, `{"error":{"message":"want a streaming request"}}`, http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		handle(int(requests.Add(1)-1), req, sseWriter{w}, r)
+	}))
+	t.Cleanup(srv.Close)
+	// Titles would cost another request the tests don't expect.
+	setForTest(t, &generateTitles, false)
+	p := newOpenAIProvider("sk-test", srv.URL+"/v1", "Authorization", "Bearer")
+	p.Client = srv.Client()
+	return p
+}
+
+// chat sends text and returns the frames up to the reply's "done" frame.
+func chat(t *testing.T, url, text string) []testFrame {
+	t.Helper()
+	conn, _ := connect(t, url)
+	if err := conn.WriteJSON(WebSocketMessage{Text: text}); err != nil {
+		t.Fatal(err)
+	}
+	return readUntil(t, conn, "done")
+}
+
+// framesOfType returns the frames of type frameType.
+func framesOfType(frames []testFrame, frameType string) []testFrame {
+	var found []testFrame
+	for _, frame := range frames {
+		if frame.Type == frameType {
+			found = append(found, frame)
+		}
+	}
+	return found
+}
+
+func TestOpenAIStreamReply(t *testing.T) {
+	p := startMockOpenAI(t, func(n int, req OpenAIRequest, s sseWriter, r *http.Request) {
+		if last := req.Messages[len(req.Messages)-1]; last.Role != "user" || last.Content != "Hi" {
+			t.Errorf("last message = %+v, want the user's Hi", last)
+		}
+		s.content("Hel")
+		// Comments and malformed events are skipped.
+		s.raw(": keep-alive\n\n")
+		s.raw("data: {not json\n\n")
+		s.content("lo")
+		s.finish("stop")
+	})
+	frames := chat(t, startTestServer(t, p), "Hi")
+
+	if len(framesOfType(frames, "start")) != 1 {
+		t.Errorf("frames = %+v, want one start frame", frames)
+	}
+	if errs := framesOfType(frames, "error"); len(errs) > 0 {
+		t.Errorf("error frames %+v", errs)
+	}
+	if got := replyText(frames); got != "Hello" {
+		t.Errorf("reply = %q, want Hello", got)
+	}
+	// Offsets count the reply streamed up to and including each frame.
+	offset := 0
+	for _, frame := range frames {
+		if frame.Role == "assistant" && frame.Type == "" {
+			offset += len(frame.Text)
+			if frame.Offset != offset {
+				t.Errorf("frame %q has offset %d, want %d", frame.Text, frame.Offset, offset)
+			}
+		}
+	}
+	if done := frames[len(frames)-1]; done.Reason != "stop" {
+		t.Errorf("done reason = %q, want stop", done.Reason)
+	}
+}
+
+func TestOpenAIStreamErrorMidReply(t *testing.T) {
+	p := startMockOpenAI(t, func(n int, req OpenAIRequest, s sseWriter, r *http.Request) {
+		s.content("Hel")
+		// Dropping the connection cuts the chunked body short.
+		panic(http.ErrAbortHandler)
+	})
+	frames := chat(t, startTestServer(t, p), "Hi")
+
+	if got := replyText(frames); got != "Hel" {
+		t.Errorf("reply = %q, want the Hel streamed before the error", got)
+	}
+	errs := framesOfType(frames, "error")
+	if len(errs) != 1 || errs[0].Text != "the reply was interrupted by an upstream error, please try again" {
+		t.Errorf("error frames = %+v, want one saying the reply was interrupted", errs)
+	}
+	if done := frames[len(frames)-1]; done.Reason != "" {
+		t.Errorf("done reason = %q, want none", done.Reason)
+	}
+}
+
+func TestOpenAIStreamToolCall(t *testing.T) {
+	p := startMockOpenAI(t, func(n int, req OpenAIRequest, s sseWriter, r *http.Request) {
+		switch n {
+		case 0:
+			// The arguments come in pieces, as they do from the API.
+			s.event(`{"choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"id":"call_1","type":"function","function":{"name":"get_current_time","arguments":"{\"timezone\":"}}]}}]}`)
+			s.event(`{"choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"\"UTC\"}"}}]}}]}`)
+			s.finish("tool_calls")
+		case 1:
+			// The tool's result is sent back after the assistant's call.
+			msgs := req.Messages
+			call, result := msgs[len(msgs)-2], msgs[len(msgs)-1]
+			if call.Role != "assistant" || len(call.ToolCalls) != 1 || call.ToolCalls[0].ID != "call_1" {
+				t.Errorf("second to last message = %+v, want the assistant's call_1", call)
+			}
+			if result.Role != "tool" || result.ToolCallID != "call_1" || result.Content == "" {
+				t.Errorf("last message = %+v, want the result of call_1", result)
+			}
+			s.content("It is noon.")
+			s.finish("stop")
+		default:
+			t.Errorf("unexpected request %d", n)
+		}
+	})
+	frames := chat(t, startTestServer(t, p), "What time is it?")
+
+	calls := framesOfType(frames, "tool_call")
+	if len(calls) != 1 || calls[0].ID != "call_1" || calls[0].Name != "get_current_time" || calls[0].Arguments != `{"timezone":"UTC"}` {
+		t.Fatalf("tool_call frames = %+v, want get_current_time with its whole arguments", calls)
+	}
+	results := framesOfType(frames, "tool_result")
+	if len(results) != 1 || results[0].ID != "call_1" || results[0].Result == "" {
+		t.Fatalf("tool_result frames = %+v, want the result of call_1", results)
+	}
+	if got := replyText(frames); got != "It is noon." {
+		t.Errorf("reply = %q, want It is noon.", got)
+	}
+	if done := frames[len(frames)-1]; done.Reason != "stop" {
+		t.Errorf("done reason = %q, want stop", done.Reason)
+	}
+}
+
+func TestOpenAIStreamClientCancel(t *testing.T) {
+	stop := func(t *testing.T, conn *fastws.Conn) {
+		if err := conn.WriteJSON(WebSocketMessage{Type: "stop", ID: "s1"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	disconnect := func(t *testing.T, conn *fastws.Conn) { conn.Close() }
+	tests := []struct {
+		name   string
+		cancel func(t *testing.T, conn *fastws.Conn)
+		// resumeWindow is how long a reply outlives its connection.
+		resumeWindow time.Duration
+		// stopped is whether the connection stays open and gets the rest of the reply's frames.
+		stopped bool
+	}{
+		{"stop message", stop, defaultResumeWindow, true},
+		{"disconnect", disconnect, 0, false},
+		{"disconnect, nobody resumes", disconnect, 50 * time.Millisecond, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setForTest(t, &resumeWindow, tt.resumeWindow)
+			streaming, upstreamDone := make(chan struct{}), make(chan struct{})
+			p := startMockOpenAI(t, func(n int, req OpenAIRequest, s sseWriter, r *http.Request) {
+				s.content("Hel")
+				close(streaming)
+				// The rest of the reply never comes; only the server giving up ends the request.
+				<-r.Context().Done()
+				close(upstreamDone)
+			})
+			conn, _ := connect(t, startTestServer(t, p))
+			if err := conn.WriteJSON(WebSocketMessage{Text: "Hi"}); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case <-streaming:
+			case <-time.After(2 * time.Second):
+				t.Fatal("the reply did not start streaming")
+			}
+			tt.cancel(t, conn)
+
+			select {
+			case <-upstreamDone:
+			case <-time.After(2 * time.Second):
+				t.Fatal("the upstream request was not cancelled")
+			}
+			if !tt.stopped {
+				return
+			}
+			frames := readUntil(t, conn, "done")
+			if acks := framesOfType(frames, "ack"); len(acks) != 1 || acks[0].ID != "s1" {
+				t.Errorf("ack frames = %+v, want the stop message's", acks)
+			}
+			if errs := framesOfType(frames, "error"); len(errs) > 0 {
+				t.Errorf("error frames %+v, want none for a stopped reply", errs)
+			}
+			if done := frames[len(frames)-1]; done.Reason != "" {
+				t.Errorf("done reason = %q, want none", done.Reason)
+			}
+		})
+	}
+}
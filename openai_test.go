@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// marshalRequest returns the JSON fields p sends for req.
+func marshalRequest(t *testing.T, p *OpenAIProvider, req CompletionRequest, stream bool) map[string]any {
+	t.Helper()
+	data, err := json.Marshal(p.request(req, stream))
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	var fields map[string]any
+	if err := json.Unmarshal(data, &fields); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	return fields
+}
+
+func TestOpenAIRequestBasics(t *testing.T) {
+	req := CompletionRequest{
+		Model:    "gpt-4o-mini",
+		Messages: []Message{{Role: "user", Content: "Hi"}},
+		User:     "u1",
+	}
+	fields := marshalRequest(t, &OpenAIProvider{}, req, true)
+	if fields["model"] != "gpt-4o-mini" || fields["stream"] != true || fields["user"] != "u1" {
+		t.Errorf("model, stream, user = %v, %v, %v", fields["model"], fields["stream"], fields["user"])
+	}
+	for _, key := range []string{"temperature", "top_p", "max_tokens", "stop", "n", "logprobs", "tools", "response_format"} {
+		if _, ok := fields[key]; ok {
+			t.Errorf("unset %s was sent: %v", key, fields[key])
+		}
+	}
+}
+
+func TestOpenAIRequestSeed(t *testing.T) {
+	seed := 42
+	tests := []struct {
+		name   string
+		params GenerationParams
+		stream bool
+		want   any
+	}{
+		{"stream with seed", GenerationParams{Seed: &seed}, true, float64(42)},
+		{"complete with seed", GenerationParams{Seed: &seed}, false, float64(42)},
+		{"stream without seed", GenerationParams{}, true, nil},
+		{"complete without seed", GenerationParams{}, false, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := CompletionRequest{Model: "gpt-4o-mini", Params: tt.params}
+			got, ok := marshalRequest(t, &OpenAIProvider{}, req, tt.stream)["seed"]
+			if tt.want == nil && ok {
+				t.Errorf("seed = %v, want it omitted", got)
+			}
+			if tt.want != nil && got != tt.want {
+				t.Errorf("seed = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOpenAIRequestStreamOnlyFields(t *testing.T) {
+	n, logprobs := 2, true
+	req := CompletionRequest{Model: "gpt-4o-mini", Params: GenerationParams{N: &n, Logprobs: &logprobs}}
+	stream := marshalRequest(t, &OpenAIProvider{StreamUsage: true}, req, true)
+	if stream["n"] != float64(2) || stream["logprobs"] != true || stream["stream_options"] == nil {
+		t.Errorf("stream n, logprobs, stream_options = %v, %v, %v", stream["n"], stream["logprobs"], stream["stream_options"])
+	}
+	// A regular completion only reads the first choice's text.
+	complete := marshalRequest(t, &OpenAIProvider{StreamUsage: true}, req, false)
+	for _, key := range []string{"n", "logprobs", "stream_options"} {
+		if _, ok := complete[key]; ok {
+			t.Errorf("completion sent %s: %v", key, complete[key])
+		}
+	}
+}
+
+// streamEvents runs readOpenAIStream over stream and returns what it sent.
+func streamEvents(stream string) []StreamEvent {
+	events := make(chan StreamEvent)
+	go func() {
+		defer close(events)
+		readOpenAIStream(context.Background(), strings.NewReader(stream), events)
+	}()
+	var got []StreamEvent
+	for event := range events {
+		got = append(got, event)
+	}
+	return got
+}
+
+func TestReadOpenAIStreamToolCalls(t *testing.T) {
+	deltas := "data: {\"choices\":[{\"index\":0,\"delta\":{\"tool_calls\":[{\"index\":0,\"id\":\"call_1\",\"function\":{\"name\":\"get_time\",\"arguments\":\"{\\\"zo\"}}]}}]}\n\n" +
+		"data: {\"choices\":[{\"index\":0,\"delta\":{\"tool_calls\":[{\"index\":0,\"function\":{\"arguments\":\"ne\\\":\\\"UTC\\\"}\"}}]}}]}\n\n"
+	finish := "data: {\"choices\":[{\"index\":0,\"delta\":{},\"finish_reason\":\"tool_calls\"}]}\n\n"
+	usage := "data: {\"choices\":[],\"usage\":{\"prompt_tokens\":5,\"completion_tokens\":3}}\n\n"
+	done := "data: [DONE]\n\n"
+	tests := []struct {
+		name   string
+		stream string
+	}{
+		{"finish reason and [DONE]", deltas + finish + usage + done},
+		{"finish reason without [DONE]", deltas + finish},
+		{"[DONE] without finish reason", deltas + done},
+		{"clean EOF only", deltas},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls [][]ToolCall
+			for _, event := range streamEvents(tt.stream) {
+				if event.Err != nil {
+					t.Fatalf("stream error: %v", event.Err)
+				}
+				if event.ToolCalls != nil {
+					calls = append(calls, event.ToolCalls)
+				}
+			}
+			if len(calls) != 1 || len(calls[0]) != 1 {
+				t.Fatalf("tool call events = %+v, want one with one call", calls)
+			}
+			call := calls[0][0]
+			if call.ID != "call_1" || call.Function.Name != "get_time" || call.Function.Arguments != `{"zone":"UTC"}` {
+				t.Errorf("call = %+v", call)
+			}
+		})
+	}
+}
+
+func TestOpenAIRequestStreamUsageOff(t *testing.T) {
+	fields := marshalRequest(t, &OpenAIProvider{}, CompletionRequest{Model: "llama3"}, true)
+	if _, ok := fields["stream_options"]; ok {
+		t.Errorf("stream_options = %v, want it omitted", fields["stream_options"])
+	}
+}
+
+func TestStreamUsage(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  map[string]string
+		want bool
+	}{
+		{"openai", map[string]string{}, true},
+		{"compatible backend", map[string]string{"OPENAI_BASE_URL": "http://localhost:8000/v1"}, false},
+		{"compatible backend forced", map[string]string{"OPENAI_BASE_URL": "http://localhost:8000/v1", "OPENAI_STREAM_USAGE": "true"}, true},
+		{"openai turned off", map[string]string{"OPENAI_STREAM_USAGE": "false"}, false},
+		{"azure default version", map[string]string{"LLM_PROVIDER": "azure"}, true},
+		{"azure preview", map[string]string{"LLM_PROVIDER": "azure", "AZURE_API_VERSION": "2024-09-01-preview"}, true},
+		{"azure old version", map[string]string{"LLM_PROVIDER": "azure", "AZURE_API_VERSION": "2024-06-01"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.cfg["OPENAI_API_KEY"] = "sk-test"
+			tt.cfg["AZURE_API_KEY"] = "az-test"
+			tt.cfg["AZURE_ENDPOINT"] = "https://example.openai.azure.com"
+			tt.cfg["AZURE_DEPLOYMENT"] = "gpt-4o-mini"
+			tt.cfg["DEFAULT_MODEL"] = "gpt-4o-mini"
+			cfg, problems := configProblems(t, tt.cfg)
+			if len(problems) > 0 {
+				t.Fatalf("problems: %v", problems)
+			}
+			// newProvider sets the model globals, which the other tests rely on.
+			savedDefault, savedAllowed := defaultModel, allowedModels
+			defer func() { defaultModel, allowedModels = savedDefault, savedAllowed }()
+			provider, err := newProvider(cfg)
+			if err != nil {
+				t.Fatalf("newProvider: %v", err)
+			}
+			var p *OpenAIProvider
+			switch provider := provider.(type) {
+			case *OpenAIProvider:
+				p = provider
+			case *AzureProvider:
+				p = provider.openai
+			default:
+				t.Fatalf("provider is %T", provider)
+			}
+			if p.StreamUsage != tt.want {
+				t.Errorf("StreamUsage = %v, want %v", p.StreamUsage, tt.want)
+			}
+		})
+	}
+}
+
+func TestOpenAIRequestMaxCompletionTokens(t *testing.T) {
+	maxTokens := 256
+	tests := []struct {
+		model       string
+		sent, other string
+	}{
+		{"gpt-4o-mini", "max_tokens", "max_completion_tokens"},
+		{"o1", "max_completion_tokens", "max_tokens"},
+		{"o3-mini", "max_completion_tokens", "max_tokens"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.model, func(t *testing.T) {
+			req := CompletionRequest{Model: tt.model, Params: GenerationParams{MaxTokens: &maxTokens}}
+			fields := marshalRequest(t, &OpenAIProvider{}, req, true)
+			if fields[tt.sent] != float64(256) {
+				t.Errorf("%s = %v, want 256", tt.sent, fields[tt.sent])
+			}
+			if _, ok := fields[tt.other]; ok {
+				t.Errorf("%s was sent too: %v", tt.other, fields[tt.other])
+			}
+		})
+	}
+}
+
+// startModelsAPI runs a models endpoint that rejects the key "sk-revoked"
+// and answers the first failures requests with 503, and returns a provider
+// calling it with keys.
+func startModelsAPI(t *testing.T, failures int32, keys ...string) *OpenAIProvider {
+	t.Helper()
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" || r.URL.Path != "/v1/models" {
+			http.Error(w, `{"error":{"message":"unexpected request"}}`, http.StatusBadRequest)
+			return
+		}
+		if r.Header.Get("Authorization") == "Bearer sk-revoked" {
+			http.Error(w, `{"error":{"message":"invalid api key"}}`, http.StatusUnauthorized)
+			return
+		}
+		if requests.Add(1) <= failures {
+			w.Header().Set("Retry-After", "0")
+			http.Error(w, `{"error":{"message":"overloaded"}}`, http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"data":[{"id":"gpt-4o-mini"}]}`))
+	}))
+	t.Cleanup(srv.Close)
+	p := newOpenAIProvider(keys[0], srv.URL+"/v1", "Authorization", "Bearer")
+	p.Keys = newKeyPool(keys)
+	p.Client = srv.Client()
+	return p
+}
+
+func TestOpenAIModelsKeyFailover(t *testing.T) {
+	// Whichever key the pool hands out first, the revoked one is skipped.
+	for _, keys := range [][]string{{"sk-revoked", "sk-test"}, {"sk-test", "sk-revoked"}} {
+		p := startModelsAPI(t, 0, keys...)
+		if err := p.Ping(context.Background()); err != nil {
+			t.Errorf("keys %v: Ping: %v", keys, err)
+		}
+		models, err := p.ListModels(context.Background())
+		if err != nil || len(models) != 1 || models[0] != "gpt-4o-mini" {
+			t.Errorf("keys %v: ListModels = %v, %v; want gpt-4o-mini", keys, models, err)
+		}
+	}
+}
+
+func TestOpenAIModelsRetry(t *testing.T) {
+	p := startModelsAPI(t, 1, "sk-test")
+	if err := p.Ping(context.Background()); err != nil {
+		t.Errorf("Ping after a transient failure: %v", err)
+	}
+	p = startModelsAPI(t, 1, "sk-test")
+	if models, err := p.ListModels(context.Background()); err != nil || len(models) != 1 {
+		t.Errorf("ListModels after a transient failure = %v, %v; want gpt-4o-mini", models, err)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// OutputFilter transforms the assistant's text on its way to the client.
+// Process gets each streamed chunk and returns the text to pass on, which may
+// be less than it got: a filter that needs more context holds text back until
+// a later chunk, or until Finalize, which is called when the model stops
+// writing (at the end of the reply, and before any tool calls) and returns
+// whatever the filter still holds. After Finalize the filter starts afresh.
+type OutputFilter interface {
+	Process(chunk string) string
+	Finalize() string
+}
+
+// outputFilterFactories are the filters OUTPUT_FILTERS can name. Filters keep
+// state while a reply streams, so every reply gets new ones.
+var outputFilterFactories = map[string]func() OutputFilter{
+	"profanity": func() OutputFilter { return &profanityFilter{words: profanityWords} },
+}
+
+// outputFilterNames lists the filters OUTPUT_FILTERS can name, for error messages.
+func outputFilterNames() []string {
+	names := make([]string, 0, len(outputFilterFactories))
+	for name := range outputFilterFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// outputFilters are the filters every reply goes through, in order (OUTPUT_FILTERS).
+var outputFilters []string
+
+// filterChain runs text through several filters, each getting what the one
+// before it passed on.
+type filterChain []OutputFilter
+
+// newOutputFilters returns a fresh chain of the configured filters.
+func newOutputFilters() filterChain {
+	chain := make(filterChain, 0, len(outputFilters))
+	for _, name := range outputFilters {
+		chain = append(chain, outputFilterFactories[name]())
+	}
+	return chain
+}
+
+// Process implements OutputFilter.
+func (c filterChain) Process(chunk string) string {
+	for _, f := range c {
+		chunk = f.Process(chunk)
+	}
+	return chunk
+}
+
+// Finalize implements OutputFilter. What one filter still holds goes through
+// the filters after it before they are finalized in turn.
+func (c filterChain) Finalize() string {
+	var text string
+	for _, f := range c {
+		text = f.Process(text) + f.Finalize()
+	}
+	return text
+}
+
+// profanityWords are redacted by the "profanity" filter. PROFANITY_WORDS
+// replaces them.
+var profanityWords = map[string]bool{
+	"damn":    true,
+	"shit":    true,
+	"fuck":    true,
+	"bitch":   true,
+	"bastard": true,
+	"asshole": true,
+	"crap":    true,
+}
+
+// profanityFilter replaces whole words in words (case-insensitively) with
+// asterisks. A word can be split across chunks, so the text after the last
+// word boundary is held back until the next chunk shows where the word ends.
+type profanityFilter struct {
+	words   map[string]bool
+	pending string
+}
+
+// Process implements OutputFilter.
+func (f *profanityFilter) Process(chunk string) string {
+	text := f.pending + chunk
+	end := strings.LastIndexFunc(text, func(r rune) bool { return !isWordRune(r) })
+	if end < 0 {
+		f.pending = text
+		return ""
+	}
+	_, size := utf8.DecodeRuneInString(text[end:])
+	f.pending = text[end+size:]
+	return f.redact(text[:end+size])
+}
+
+// Finalize implements OutputFilter.
+func (f *profanityFilter) Finalize() string {
+	text := f.redact(f.pending)
+	f.pending = ""
+	return text
+}
+
+// redact replaces the listed words in text.
+func (f *profanityFilter) redact(text string) string {
+	var out strings.Builder
+	for text != "" {
+		i := strings.IndexFunc(text, isWordRune)
+		if i < 0 {
+			out.WriteString(text)
+			break
+		}
+		out.WriteString(text[:i])
+		text = text[i:]
+		j := strings.IndexFunc(text, func(r rune) bool { return !isWordRune(r) })
+		if j < 0 {
+			j = len(text)
+		}
+		word := text[:j]
+		if f.words[strings.ToLower(word)] {
+			word = strings.Repeat("*", utf8.RuneCountInString(word))
+		}
+		out.WriteString(word)
+		text = text[j:]
+	}
+	return out.String()
+}
+
+// isWordRune reports whether r can be part of a word.
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
@@ -0,0 +1,132 @@
+package main
+
+import "fmt"
+
+// maxStopSequences is the most stop sequences OpenAI accepts in one request.
+const maxStopSequences = 4
+
+// maxChoices is the most replies a client may ask for at once with n. Every
+// one of them is paid for.
+const maxChoices = 5
+
+// GenerationParams are optional sampling settings a client can set per conversation.
+// Nil fields are left out of upstream requests so the provider's defaults apply.
+// Stop lists sequences that end the reply when the model produces them; an
+// empty (but not null) list clears the conversation's stop sequences.
+type GenerationParams struct {
+	Temperature *float64 `json:"temperature,omitempty"`
+	TopP        *float64 `json:"top_p,omitempty"`
+	MaxTokens   *int     `json:"max_tokens,omitempty"`
+	Stop        []string `json:"stop,omitempty"`
+	// The penalties discourage repeating tokens that already appeared at all
+	// (presence) or often (frequency).
+	PresencePenalty  *float64 `json:"presence_penalty,omitempty"`
+	FrequencyPenalty *float64 `json:"frequency_penalty,omitempty"`
+	// Seed makes sampling repeatable, as far as the provider supports it.
+	Seed *int `json:"seed,omitempty"`
+	// ResponseFormat turns on JSON mode for models that support it.
+	ResponseFormat *ResponseFormat `json:"response_format,omitempty"`
+	// N asks for several alternative replies, streamed side by side.
+	N *int `json:"n,omitempty"`
+	// Logprobs streams the log probability of every token with the reply,
+	// and TopLogprobs that of up to 20 likely alternatives.
+	Logprobs    *bool `json:"logprobs,omitempty"`
+	TopLogprobs *int  `json:"top_logprobs,omitempty"`
+}
+
+// Choices returns how many replies p asks for.
+func (p GenerationParams) Choices() int {
+	if p.N == nil {
+		return 1
+	}
+	return *p.N
+}
+
+// WantsLogprobs reports whether p asks for token log probabilities.
+func (p GenerationParams) WantsLogprobs() bool {
+	return p.Logprobs != nil && *p.Logprobs
+}
+
+// Validate checks that every set parameter is within the range OpenAI accepts.
+func (p GenerationParams) Validate() error {
+	if p.Temperature != nil && (*p.Temperature < 0 || *p.Temperature > 2) {
+		return fmt.Errorf("temperature must be between 0 and 2, got %g", *p.Temperature)
+	}
+	if p.TopP != nil && (*p.TopP < 0 || *p.TopP > 1) {
+		return fmt.Errorf("top_p must be between 0 and 1, got %g", *p.TopP)
+	}
+	if p.MaxTokens != nil && *p.MaxTokens < 1 {
+		return fmt.Errorf("max_tokens must be at least 1, got %d", *p.MaxTokens)
+	}
+	if p.PresencePenalty != nil && (*p.PresencePenalty < -2 || *p.PresencePenalty > 2) {
+		return fmt.Errorf("presence_penalty must be between -2 and 2, got %g", *p.PresencePenalty)
+	}
+	if p.FrequencyPenalty != nil && (*p.FrequencyPenalty < -2 || *p.FrequencyPenalty > 2) {
+		return fmt.Errorf("frequency_penalty must be between -2 and 2, got %g", *p.FrequencyPenalty)
+	}
+	if p.N != nil && (*p.N < 1 || *p.N > maxChoices) {
+		return fmt.Errorf("n must be between 1 and %d, got %d", maxChoices, *p.N)
+	}
+	if p.TopLogprobs != nil && (*p.TopLogprobs < 0 || *p.TopLogprobs > maxTopLogprobs) {
+		return fmt.Errorf("top_logprobs must be between 0 and %d, got %d", maxTopLogprobs, *p.TopLogprobs)
+	}
+	if p.ResponseFormat != nil {
+		if err := p.ResponseFormat.Validate(); err != nil {
+			return err
+		}
+	}
+	if len(p.Stop) > maxStopSequences {
+		return fmt.Errorf("at most %d stop sequences are allowed, got %d", maxStopSequences, len(p.Stop))
+	}
+	for _, stop := range p.Stop {
+		if stop == "" {
+			return fmt.Errorf("stop sequences must not be empty")
+		}
+	}
+	return nil
+}
+
+// IsZero reports whether no parameter is set.
+func (p GenerationParams) IsZero() bool {
+	return p.Temperature == nil && p.TopP == nil && p.MaxTokens == nil && len(p.Stop) == 0 &&
+		p.PresencePenalty == nil && p.FrequencyPenalty == nil && p.Seed == nil && p.ResponseFormat == nil &&
+		p.N == nil && p.Logprobs == nil && p.TopLogprobs == nil
+}
+
+// Merge returns p with every parameter that is set in update overriding p's value.
+func (p GenerationParams) Merge(update GenerationParams) GenerationParams {
+	if update.Temperature != nil {
+		p.Temperature = update.Temperature
+	}
+	if update.TopP != nil {
+		p.TopP = update.TopP
+	}
+	if update.MaxTokens != nil {
+		p.MaxTokens = update.MaxTokens
+	}
+	if update.Stop != nil {
+		p.Stop = update.Stop
+	}
+	if update.PresencePenalty != nil {
+		p.PresencePenalty = update.PresencePenalty
+	}
+	if update.FrequencyPenalty != nil {
+		p.FrequencyPenalty = update.FrequencyPenalty
+	}
+	if update.Seed != nil {
+		p.Seed = update.Seed
+	}
+	if update.ResponseFormat != nil {
+		p.ResponseFormat = update.ResponseFormat
+	}
+	if update.N != nil {
+		p.N = update.N
+	}
+	if update.Logprobs != nil {
+		p.Logprobs = update.Logprobs
+	}
+	if update.TopLogprobs != nil {
+		p.TopLogprobs = update.TopLogprobs
+	}
+	return p
+}
@@ -0,0 +1,46 @@
+package main
+
+// prefillSticky (PREFILL_STICKY) keeps a conversation's prefill for every
+// reply instead of only the next one.
+var prefillSticky bool
+
+// Prefiller is implemented by providers that accept a trailing assistant
+// message and continue it, which is how a reply is prefilled.
+type Prefiller interface {
+	SupportsPrefill() bool
+}
+
+// supportsPrefill reports whether p continues a prefilled reply. Other
+// providers only get the prefill shown in front of their reply.
+func supportsPrefill(p Provider) bool {
+	prefiller, ok := p.(Prefiller)
+	return ok && prefiller.SupportsPrefill()
+}
+
+// SupportsPrefill implements Prefiller.
+func (p *AnthropicProvider) SupportsPrefill() bool { return true }
+
+// SupportsPrefill implements Prefiller.
+func (p *OllamaProvider) SupportsPrefill() bool { return true }
+
+// SupportsPrefill implements Prefiller.
+func (p *MockProvider) SupportsPrefill() bool { return true }
+
+// SetPrefill sets the text the next reply starts with; empty clears it.
+func (c *Conversation) SetPrefill(text string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.prefill = text
+}
+
+// TakePrefill returns the text the reply being started begins with. Unless
+// PREFILL_STICKY is set, it is cleared so only this reply gets it.
+func (c *Conversation) TakePrefill() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	prefill := c.prefill
+	if !prefillSticky {
+		c.prefill = ""
+	}
+	return prefill
+}
@@ -0,0 +1,23 @@
+package main
+
+// protocolVersion is the version of the WebSocket message protocol. It goes up
+// whenever frames change in a way older frontends would misread.
+const protocolVersion = 1
+
+// subprotocols are the WebSocket subprotocols the server speaks, newest first.
+// Clients name the versions they understand when connecting, e.g.
+// new WebSocket(url, ["llmchat.v1"]), and the server picks one of them.
+var subprotocols = []string{"llmchat.v1"}
+
+// requireSubprotocol closes connections that didn't agree on a subprotocol.
+// With WS_REQUIRE_SUBPROTOCOL=false, clients that don't ask for one are still
+// served, with the current protocol.
+var requireSubprotocol = true
+
+// HelloFrame is the first frame of every connection. It tells the client which
+// protocol version the server will speak.
+type HelloFrame struct {
+	Type     string `json:"type"`
+	Protocol string `json:"protocol"`
+	Version  int    `json:"version"`
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Provider is an LLM backend that can stream a chat completion.
+// StreamCompletion sends the conversation upstream and returns a channel that
+// yields the reply's events as they arrive. The channel is closed when
+// the reply is complete, the stream fails, or ctx is cancelled.
+// An error is returned only if the request could not be started at all.
+type Provider interface {
+	StreamCompletion(ctx context.Context, req CompletionRequest) (<-chan StreamEvent, error)
+}
+
+// StreamEvent is one piece of a streamed reply.
+// Content holds the next chunk of text. Usage is set, usually on the last
+// event, by providers that report token counts. ToolCalls is set once the
+// model has finished asking for tools to be called instead of answering.
+// Reasoning holds the next chunk of the model's thinking, for models that
+// stream it separately from the answer. SystemFingerprint is set by OpenAI
+// when it reports which backend configuration is answering.
+type StreamEvent struct {
+	Content           string
+	Reasoning         string
+	Usage             *Usage
+	ToolCalls         []ToolCall
+	SystemFingerprint string
+	// Choice is the index of the reply Content belongs to when several were
+	// asked for (n > 1); it is 0 otherwise.
+	Choice int
+	// Logprobs has the log probabilities of Content's tokens, if they were asked for.
+	Logprobs []TokenLogprob
+	// FinishReason says why the model stopped, on the event that ends the
+	// reply: "stop", "length" (it hit max_tokens), "tool_calls" or
+	// "content_filter", in OpenAI's terms whatever the provider.
+	FinishReason string
+	// Err is set on the last event of a stream that broke off before the
+	// reply was complete: the connection failed or the provider reported an
+	// error mid-stream.
+	Err error
+}
+
+// Usage is the number of tokens a completion consumed.
+type Usage struct {
+	PromptTokens     int `json:"prompt"`
+	CompletionTokens int `json:"completion"`
+}
+
+// sendEvent delivers an event unless ctx is cancelled first.
+// It reports false if the reader should stop.
+func sendEvent(ctx context.Context, events chan<- StreamEvent, event StreamEvent) bool {
+	select {
+	case events <- event:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// sendStreamError logs err and ends the stream with an event carrying it. A
+// stream ended by ctx has nobody waiting for it, so nothing is sent.
+func sendStreamError(ctx context.Context, events chan<- StreamEvent, provider string, err error) {
+	if ctx.Err() != nil {
+		return
+	}
+	loggerFrom(ctx).Error("stream failed", "provider", provider, "err", err)
+	sendEvent(ctx, events, StreamEvent{Err: err})
+}
+
+// closeOnCancel closes body, if it can be closed, as soon as ctx is done. A
+// stalled upstream sends nothing, so a reader blocked in Read would never see
+// the cancellation otherwise; once the body is closed the Read fails and the
+// reader returns. The returned function stops watching ctx.
+func closeOnCancel(ctx context.Context, body io.Reader) (stop func() bool) {
+	closer, ok := body.(io.Closer)
+	if !ok {
+		return func() bool { return false }
+	}
+	return context.AfterFunc(ctx, func() { closer.Close() })
+}
+
+// Completer is implemented by providers with a dedicated non-streaming endpoint.
+type Completer interface {
+	Complete(ctx context.Context, req CompletionRequest) (string, error)
+}
+
+// complete returns the whole reply at once. Providers without a non-streaming
+// endpoint are streamed and the chunks joined together. Like streamCompletion,
+// it counts against MAX_CONCURRENT_UPSTREAM and goes through the circuit breaker.
+func complete(ctx context.Context, p Provider, req CompletionRequest) (string, error) {
+	if c, ok := p.(Completer); ok {
+		done, err := upstreamBreaker.Allow()
+		if err != nil {
+			return "", err
+		}
+		release, err := acquireUpstream(ctx)
+		if err != nil {
+			done(ctx, nil)
+			return "", err
+		}
+		defer release()
+		reply, err := c.Complete(ctx, req)
+		done(ctx, err)
+		return reply, err
+	}
+	events, err := streamCompletion(ctx, p, req)
+	if err != nil {
+		return "", err
+	}
+	var reply strings.Builder
+	for event := range events {
+		if event.Err != nil {
+			return "", event.Err
+		}
+		reply.WriteString(event.Content)
+	}
+	return reply.String(), nil
+}
+
+// Pinger is implemented by providers that can cheaply check they are reachable.
+// It is used by the readiness probe.
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// ModelLister is implemented by providers that can list the models their
+// backend offers. It is used by GET /api/models.
+type ModelLister interface {
+	ListModels(ctx context.Context) ([]string, error)
+}
+
+// Errors about talking to a provider, to tell failures apart with errors.Is.
+var (
+	// ErrUpstream matches every error a provider reported: non-2xx responses
+	// (which are *UpstreamError) and errors in the middle of a stream.
+	ErrUpstream = errors.New("upstream error")
+	// ErrMarshal means a request couldn't be encoded, so it was never sent.
+	ErrMarshal = errors.New("error encoding upstream request")
+	// ErrDecode means a provider's response couldn't be decoded.
+	ErrDecode = errors.New("error decoding upstream response")
+)
+
+// ErrNotConfigured is returned when a provider is missing a setting it needs to
+// make any request, such as its API key.
+var ErrNotConfigured = errors.New("server not configured")
+
+// ConfigChecker is implemented by providers that need settings, such as an API
+// key, before they can make requests.
+type ConfigChecker interface {
+	CheckConfig() error
+}
+
+// checkConfig returns an error wrapping ErrNotConfigured if p can't make
+// requests. Providers that need no settings are always configured.
+func checkConfig(p Provider) error {
+	if checker, ok := p.(ConfigChecker); ok {
+		return checker.CheckConfig()
+	}
+	return nil
+}
+
+// CompletionRequest is the provider-independent description of a completion.
+// Tools are offered to the model by providers that support tool calling
+// (currently OpenAI); the others ignore them.
+type CompletionRequest struct {
+	Model    string
+	Messages []Message
+	Params   GenerationParams
+	Tools    []ToolDefinition
+	// User identifies the end user to OpenAI (see endUserID); empty for none.
+	User string
+}
+
+// UpstreamError describes a non-2xx response from a provider.
+type UpstreamError struct {
+	Provider   string
+	StatusCode int
+	Message    string
+}
+
+// Is makes every UpstreamError match ErrUpstream.
+func (e *UpstreamError) Is(target error) bool {
+	return target == ErrUpstream
+}
+
+func (e *UpstreamError) Error() string {
+	// Upstream messages sometimes echo the key that was rejected.
+	return fmt.Sprintf("%s API error (%d): %s", e.Provider, e.StatusCode, redact(e.Message))
+}
+
+// apiErrorResponse matches the error body used by both OpenAI and Anthropic:
+// {"error": {"type": "...", "message": "..."}}.
+type apiErrorResponse struct {
+	Error struct {
+		Message string `json:"message"`
+		Type    string `json:"type"`
+	} `json:"error"`
+}
+
+// readUpstreamError turns a failed response into an UpstreamError with a readable message.
+func readUpstreamError(provider string, resp *http.Response) *UpstreamError {
+	// Error bodies are small; the limit protects against unexpected huge responses.
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	message := strings.TrimSpace(string(body))
+	var apiErr apiErrorResponse
+	if err := json.Unmarshal(body, &apiErr); err == nil && apiErr.Error.Message != "" {
+		message = apiErr.Error.Message
+	}
+	if message == "" {
+		message = http.StatusText(resp.StatusCode)
+	}
+	return &UpstreamError{Provider: provider, StatusCode: resp.StatusCode, Message: message}
+}
+
+// newProvider builds the provider selected in the configuration.
+// Providers other than OpenAI also replace the default model and the model allowlist,
+// since OpenAI model names mean nothing to them. The same goes for
+// OpenAI-compatible backends at another OPENAI_BASE_URL, which only get DEFAULT_MODEL.
+func newProvider(cfg Config) (Provider, error) {
+	// Canned replies work with any model, so the allowlist stays as it is.
+	if cfg.MockLLM {
+		defaultModel = cfg.DefaultModel
+		return &MockProvider{Text: cfg.MockResponse, Delay: cfg.MockDelay}, nil
+	}
+	switch cfg.Provider {
+	case "openai":
+		if cfg.OpenAIBaseURL == defaultOpenAIBaseURL {
+			defaultModel = cfg.DefaultModel
+		} else {
+			setProviderModels(cfg.DefaultModel, defaultModel, nil)
+		}
+		p := newOpenAIProvider(cfg.OpenAIKey, cfg.OpenAIBaseURL, cfg.OpenAIAuthHeader, cfg.OpenAIAuthScheme)
+		p.Keys = openAIKeys
+		p.StreamUsage = streamUsage(cfg.OpenAIStreamUsage, cfg.OpenAIBaseURL == defaultOpenAIBaseURL)
+		return p, nil
+	case "azure":
+		// The deployment decides the model, so its name is the only model there is.
+		setProviderModels(cfg.AzureDeployment, "", nil)
+		p := newAzureProvider(cfg.AzureKey, cfg.AzureEndpoint, cfg.AzureDeployment, cfg.AzureAPIVersion)
+		p.openai.StreamUsage = streamUsage(cfg.OpenAIStreamUsage, azureSupportsStreamUsage(cfg.AzureAPIVersion))
+		return p, nil
+	case "anthropic":
+		setProviderModels(cfg.AnthropicModel, defaultAnthropicModel, anthropicModels)
+		return &AnthropicProvider{APIKey: cfg.AnthropicKey, URL: anthropicURL, Client: httpClient}, nil
+	case "ollama":
+		// Ollama runs locally and needs no API key.
+		setProviderModels(cfg.OllamaModel, defaultOllamaModel, nil)
+		return &OllamaProvider{URL: cfg.OllamaHost + "/api/chat", Client: httpClient}, nil
+	}
+	return nil, fmt.Errorf("unknown LLM_PROVIDER %q", cfg.Provider)
+}
+
+// streamUsage resolves OPENAI_STREAM_USAGE: auto asks for usage only where
+// the API is known to support it.
+func streamUsage(setting string, supported bool) bool {
+	if setting == "auto" {
+		return supported
+	}
+	return setting == "true"
+}
+
+// setProviderModels replaces the default model and the model allowlist for a
+// non-OpenAI provider. The configured model (or the fallback) is always allowed.
+func setProviderModels(configured, fallback string, models []string) {
+	defaultModel = configured
+	if defaultModel == "" {
+		defaultModel = fallback
+	}
+	allowedModels = map[string]bool{defaultModel: true}
+	for _, model := range models {
+		allowedModels[model] = true
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestStreamReadersReturnOnCancel(t *testing.T) {
+	tests := []struct {
+		name  string
+		read  func(ctx context.Context, body io.Reader, events chan<- StreamEvent)
+		first string
+	}{
+		{"openai", readOpenAIStream, "data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":\"Hi\"}}]}\n\n"},
+		{"anthropic", readAnthropicStream, "event: content_block_delta\ndata: {\"type\":\"content_block_delta\",\"delta\":{\"type\":\"text_delta\",\"text\":\"Hi\"}}\n\n"},
+		{"ollama", readOllamaStream, "{\"message\":{\"content\":\"Hi\"},\"done\":false}\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The pipe stands in for an upstream that sends one chunk and then stalls.
+			body, upstream := io.Pipe()
+			defer upstream.Close()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			events := make(chan StreamEvent)
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				tt.read(ctx, body, events)
+			}()
+			go upstream.Write([]byte(tt.first))
+
+			select {
+			case event := <-events:
+				if event.Content != "Hi" {
+					t.Fatalf("first event = %+v, want content Hi", event)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("no event from the first chunk")
+			}
+
+			cancel()
+			select {
+			case <-done:
+			case event := <-events:
+				t.Fatalf("reader sent %+v after the cancel", event)
+			case <-time.After(time.Second):
+				t.Fatal("reader still blocked in Read a second after the cancel")
+			}
+		})
+	}
+}
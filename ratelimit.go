@@ -0,0 +1,103 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Default limits; a limit of 0 disables that check.
+// They can be overridden with MAX_CONNS_PER_IP and MSGS_PER_MINUTE.
+const (
+	defaultMaxConnsPerIP = 10
+	defaultMsgsPerMinute = 20
+)
+
+// tokenBucket allows bursts of up to `capacity` messages and refills steadily.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter limits WebSocket usage per client IP address.
+// It caps the number of simultaneous connections and, with a token bucket,
+// the number of chat messages each IP can send per minute. Every message
+// fires an upstream API call, so this is what keeps one client from running up costs.
+type RateLimiter struct {
+	maxConns      int
+	msgsPerMinute int
+
+	mu      sync.Mutex
+	conns   map[string]int
+	buckets map[string]*tokenBucket
+}
+
+// NewRateLimiter creates a limiter. A limit of 0 disables it.
+func NewRateLimiter(maxConns, msgsPerMinute int) *RateLimiter {
+	return &RateLimiter{
+		maxConns:      maxConns,
+		msgsPerMinute: msgsPerMinute,
+		conns:         make(map[string]int),
+		buckets:       make(map[string]*tokenBucket),
+	}
+}
+
+// AcquireConn reserves a connection slot for ip.
+// It reports false if the IP already has the maximum number of open connections.
+// Every successful AcquireConn must be paired with ReleaseConn.
+func (l *RateLimiter) AcquireConn(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.maxConns > 0 && l.conns[ip] >= l.maxConns {
+		return false
+	}
+	l.conns[ip]++
+	l.pruneBuckets()
+	return true
+}
+
+// ReleaseConn frees a connection slot reserved with AcquireConn.
+func (l *RateLimiter) ReleaseConn(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conns[ip] <= 1 {
+		delete(l.conns, ip)
+		return
+	}
+	l.conns[ip]--
+}
+
+// AllowMessage takes a token from ip's bucket.
+// It reports false if the IP has used up its messages for now.
+func (l *RateLimiter) AllowMessage(ip string) bool {
+	if l.msgsPerMinute <= 0 {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	bucket, ok := l.buckets[ip]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(l.msgsPerMinute), last: now}
+		l.buckets[ip] = bucket
+	}
+	// Refill in proportion to the time since the last message, up to a full bucket.
+	refill := now.Sub(bucket.last).Minutes() * float64(l.msgsPerMinute)
+	bucket.tokens = math.Min(bucket.tokens+refill, float64(l.msgsPerMinute))
+	bucket.last = now
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// pruneBuckets forgets IPs without connections whose buckets would be full by now,
+// since a fresh bucket is the same as a full one. The caller must hold l.mu.
+func (l *RateLimiter) pruneBuckets() {
+	for ip, bucket := range l.buckets {
+		if l.conns[ip] == 0 && time.Since(bucket.last) > time.Minute {
+			delete(l.buckets, ip)
+		}
+	}
+}
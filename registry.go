@@ -0,0 +1,481 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/gofiber/websocket/v2"
+	"github.com/google/uuid"
+)
+
+// defaultMessageQueueSize is how many chat messages may wait for a reply on
+// one connection (or in the room). It can be overridden with MESSAGE_QUEUE_SIZE;
+// with 0, messages are rejected while a reply is streaming.
+const defaultMessageQueueSize = 4
+
+var messageQueueSize = defaultMessageQueueSize
+
+// latestMessageWins makes a new chat message cancel the reply still streaming
+// on its connection instead of waiting behind it (LATEST_MESSAGE_WINS).
+var latestMessageWins bool
+
+// connectionWait is how long a connection beyond MAX_CONNECTIONS waits for a
+// free slot before it is turned away (MAX_CONNECTIONS_WAIT). With 0 it is
+// rejected right away, before the upgrade.
+var connectionWait time.Duration
+
+// maxConversationsPerConn is how many conversations one connection may have
+// attached at once, e.g. one per tab of a multi-tab UI.
+const maxConversationsPerConn = 16
+
+// Client holds the per-connection state of one WebSocket client.
+// The conversations it is attached to are tracked separately (see Conversation),
+// so the same conversation can outlive the connection.
+type Client struct {
+	conn *websocket.Conn
+	// id is the connection's correlation ID, attached to every log line about it.
+	id string
+	// connectedAt is when the connection was registered.
+	connectedAt time.Time
+	// writeMu serializes writes, since a WebSocket connection supports only one
+	// concurrent writer and frames come from both the handler and the worker.
+	writeMu sync.Mutex
+	// closed is set, under writeMu, once the connection's handler has returned.
+	// The connection object is then reused for other clients, so a response
+	// still streaming for this client must not write to it.
+	closed bool
+	// send queues frames for writeLoop, so a slow client doesn't hold up the
+	// goroutines producing its frames; nil with SEND_QUEUE_SIZE=0. stopWriter
+	// is closed along with the client, and writerDone once writeLoop has returned.
+	send       chan outgoing
+	stopWriter chan struct{}
+	writerDone chan struct{}
+	// htmx renders frames as HTML fragments when FRAME_FORMAT=htmx; nil sends JSON.
+	htmx *htmxEncoder
+	// jobs queues chat messages waiting for a reply; see ProcessQueue.
+	jobs chan func()
+
+	mu sync.Mutex
+	// conversations holds the attached conversations, least recently used first.
+	// The last one is the current conversation, which untagged messages go to.
+	conversations []*Conversation
+	// generations holds every response still streaming, so a "stop" message can abort them.
+	generations map[uint64]generation
+	nextGenID   uint64
+	// toolResults holds a channel for every tool call waiting for the client's result.
+	toolResults map[string]chan string
+	// room is the shared room the client joined, if any. It is kept after the
+	// client leaves, for the replies it asked for.
+	room *Room
+	// memory holds the facts the connection asked to be remembered.
+	memory Memory
+	// user is the connection's end-user ID for OpenAI (see endUserID).
+	user string
+}
+
+// Memory returns the client's memory.
+func (cl *Client) Memory() *Memory {
+	return &cl.memory
+}
+
+// Conn returns the client's WebSocket connection.
+func (cl *Client) Conn() *websocket.Conn {
+	return cl.conn
+}
+
+// ID returns the client's correlation ID.
+func (cl *Client) ID() string {
+	return cl.id
+}
+
+// WriteJSON sends v as a JSON frame, or as an HTML fragment with
+// FRAME_FORMAT=htmx. It is safe to call from multiple goroutines.
+// The frame is queued for the connection's writer unless SEND_QUEUE_SIZE is 0.
+// After the connection has closed it returns errClientClosed.
+func (cl *Client) WriteJSON(v interface{}) error {
+	cl.writeMu.Lock()
+	defer cl.writeMu.Unlock()
+	if cl.closed {
+		return errClientClosed
+	}
+	var data []byte
+	if cl.htmx != nil {
+		fragment, ok := cl.htmx.Encode(v)
+		if !ok {
+			return nil
+		}
+		data = []byte(fragment)
+	} else {
+		var err error
+		if data, err = json.Marshal(v); err != nil {
+			return err
+		}
+	}
+	if cl.send == nil {
+		return cl.conn.WriteMessage(websocket.TextMessage, data)
+	}
+	return cl.enqueue(outgoing{data: data})
+}
+
+// errClientClosed is returned for writes to a client whose connection has closed.
+var errClientClosed = errors.New("connection closed")
+
+// Room returns the shared room the client joined, or nil.
+func (cl *Client) Room() *Room {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	return cl.room
+}
+
+// Publish sends a frame about the client's conversation: to every member of
+// its room if it is in one, otherwise just to the client.
+func (cl *Client) Publish(v interface{}) error {
+	if room := cl.Room(); room != nil {
+		room.Broadcast(v, nil)
+		return nil
+	}
+	return cl.WriteJSON(v)
+}
+
+// Enqueue adds a reply job to the connection's queue without blocking, or to
+// its room's queue if it is in one. It reports false if the queue is full.
+func (cl *Client) Enqueue(job func()) bool {
+	if room := cl.Room(); room != nil {
+		return room.Enqueue(job)
+	}
+	select {
+	case cl.jobs <- job:
+		return true
+	default:
+		return false
+	}
+}
+
+// ProcessQueue runs queued jobs one after another until ctx is cancelled.
+// Running them sequentially keeps replies in order and stops two responses
+// from interleaving their tokens on the same connection.
+func (cl *Client) ProcessQueue(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case job := <-cl.jobs:
+			job()
+		}
+	}
+}
+
+// generation is a response still streaming for one of the client's conversations.
+type generation struct {
+	conversationID string
+	cancel         context.CancelFunc
+}
+
+// Conversation returns the client's current conversation: the one it used last.
+func (cl *Client) Conversation() *Conversation {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	if len(cl.conversations) == 0 {
+		return nil
+	}
+	return cl.conversations[len(cl.conversations)-1]
+}
+
+// UseConversation makes the attached conversation with the given ID the
+// current one and returns it. It returns nil if no such conversation is attached.
+func (cl *Client) UseConversation(id string) *Conversation {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	for i, conv := range cl.conversations {
+		if conv.ID() == id {
+			cl.conversations = append(append(cl.conversations[:i:i], cl.conversations[i+1:]...), conv)
+			return conv
+		}
+	}
+	return nil
+}
+
+// AttachConversation adds a conversation to the client and makes it the current one.
+// Once maxConversationsPerConn are attached, the least recently used one is
+// detached and returned so the caller can release it.
+func (cl *Client) AttachConversation(conv *Conversation) (detached *Conversation) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	cl.conversations = append(cl.conversations, conv)
+	if len(cl.conversations) > maxConversationsPerConn {
+		detached = cl.conversations[0]
+		cl.conversations = cl.conversations[1:]
+	}
+	return detached
+}
+
+// Conversations returns every conversation attached to the client.
+func (cl *Client) Conversations() []*Conversation {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	return append([]*Conversation(nil), cl.conversations...)
+}
+
+// StartGeneration derives a cancellable context for a new response in the
+// given conversation from ctx.
+// The returned finish func must be called when the response is done.
+func (cl *Client) StartGeneration(ctx context.Context, conversationID string) (genCtx context.Context, finish func()) {
+	genCtx, cancel := context.WithCancel(ctx)
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	if cl.generations == nil {
+		cl.generations = make(map[uint64]generation)
+	}
+	id := cl.nextGenID
+	cl.nextGenID++
+	cl.generations[id] = generation{conversationID: conversationID, cancel: cancel}
+	return genCtx, func() {
+		cancel()
+		cl.mu.Lock()
+		defer cl.mu.Unlock()
+		delete(cl.generations, id)
+	}
+}
+
+// Generating reports whether a response is still streaming on the
+// connection, or in its room.
+func (cl *Client) Generating() bool {
+	if room := cl.Room(); room != nil && room.Generating() {
+		return true
+	}
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	return len(cl.generations) > 0
+}
+
+// StartReply returns the context for a response in conv, which ctx, the
+// connection's context, asked for. The returned finish func must be called
+// when the response is done. In a room the response belongs to the room
+// (see Room.StartGeneration); otherwise it keeps streaming for a while after
+// the connection drops, in case the client resumes it.
+func (cl *Client) StartReply(ctx context.Context, conv *Conversation) (genCtx context.Context, finish func()) {
+	if room := cl.Room(); room != nil {
+		return room.StartGeneration(ctx)
+	}
+	respCtx, cancel := outliveConnection(ctx, conv.Reply())
+	genCtx, finishGen := cl.StartGeneration(respCtx, conv.ID())
+	return genCtx, func() {
+		finishGen()
+		cancel()
+	}
+}
+
+// StopReplies cancels the responses streaming in the given conversation, or
+// on the whole connection if conversationID is empty; in a room, it cancels
+// the room's reply. It returns the conversations whose responses were stopped.
+func (cl *Client) StopReplies(conversationID string) []string {
+	if room := cl.Room(); room != nil {
+		if room.Stop() {
+			return []string{room.Conversation().ID()}
+		}
+		return nil
+	}
+	return cl.StopGenerations(conversationID)
+}
+
+// StopGenerations cancels the responses still streaming in the given
+// conversation, or on the whole connection if conversationID is empty.
+// It returns the conversations whose responses were stopped.
+func (cl *Client) StopGenerations(conversationID string) []string {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	var stopped []string
+	for id, gen := range cl.generations {
+		if conversationID != "" && gen.conversationID != conversationID {
+			continue
+		}
+		gen.cancel()
+		delete(cl.generations, id)
+		stopped = append(stopped, gen.conversationID)
+	}
+	return stopped
+}
+
+// WaitForToolResult blocks until the client returns the result of the tool
+// call with the given ID (see DeliverToolResult) or ctx is done.
+func (cl *Client) WaitForToolResult(ctx context.Context, id string) (string, error) {
+	results := make(chan string, 1)
+	cl.mu.Lock()
+	if cl.toolResults == nil {
+		cl.toolResults = make(map[string]chan string)
+	}
+	cl.toolResults[id] = results
+	cl.mu.Unlock()
+	defer func() {
+		cl.mu.Lock()
+		defer cl.mu.Unlock()
+		delete(cl.toolResults, id)
+	}()
+
+	select {
+	case result := <-results:
+		return result, nil
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// DeliverToolResult hands a tool result from the client to the response waiting for it.
+// It reports false if no tool call with that ID is waiting.
+func (cl *Client) DeliverToolResult(id, result string) bool {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	results, ok := cl.toolResults[id]
+	if !ok {
+		return false
+	}
+	delete(cl.toolResults, id)
+	results <- result
+	return true
+}
+
+// ClientRegistry keeps track of all active WebSocket connections and their state.
+// Connections are added and removed from many goroutines at once (one per
+// handleWebSocket call), so every access to the underlying map is guarded
+// by a sync.RWMutex. Plain Go maps are not safe for concurrent use.
+//
+// slots caps the number of connections being served at once (MAX_CONNECTIONS).
+// A slot is held for the whole of a connection's handler, which can outlast
+// the client's entry in the map (see Deregister).
+type ClientRegistry struct {
+	mu      sync.RWMutex
+	clients map[*websocket.Conn]*Client
+	slots   chan struct{}
+}
+
+// NewClientRegistry creates an empty registry ready for use. It serves at
+// most maxConns connections at once; 0 means no limit.
+func NewClientRegistry(maxConns int) *ClientRegistry {
+	r := &ClientRegistry{
+		clients: make(map[*websocket.Conn]*Client),
+	}
+	if maxConns > 0 {
+		r.slots = make(chan struct{}, maxConns)
+	}
+	return r
+}
+
+// Acquire takes a connection slot, waiting up to wait for one to free up.
+// It reports false if there was none. Every successful Acquire must be paired
+// with Release.
+func (r *ClientRegistry) Acquire(wait time.Duration) bool {
+	if r.slots == nil {
+		return true
+	}
+	select {
+	case r.slots <- struct{}{}:
+		return true
+	default:
+	}
+	if wait <= 0 {
+		return false
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case r.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// Release frees a slot taken with Acquire.
+func (r *ClientRegistry) Release() {
+	if r.slots != nil {
+		<-r.slots
+	}
+}
+
+// Full reports whether every connection slot is taken.
+func (r *ClientRegistry) Full() bool {
+	return r.slots != nil && len(r.slots) == cap(r.slots)
+}
+
+// Add registers a connection with the registry and returns its fresh state.
+func (r *ClientRegistry) Add(c *websocket.Conn) *Client {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	client := &Client{
+		conn:        c,
+		id:          uuid.NewString(),
+		connectedAt: time.Now(),
+		jobs:        make(chan func(), messageQueueSize),
+	}
+	if frameFormat == frameFormatHTMX {
+		client.htmx = newHTMXEncoder()
+	}
+	if sendQueueSize > 0 {
+		client.send = make(chan outgoing, sendQueueSize)
+		client.stopWriter = make(chan struct{})
+		client.writerDone = make(chan struct{})
+		go client.writeLoop()
+	}
+	r.clients[c] = client
+	return client
+}
+
+// Get returns the state for a registered connection.
+func (r *ClientRegistry) Get(c *websocket.Conn) (*Client, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	client, ok := r.clients[c]
+	return client, ok
+}
+
+// Remove deletes a connection and its state from the registry.
+// Removing a connection that is not registered is a no-op.
+// The client is marked closed, so nothing is written to the connection any more.
+func (r *ClientRegistry) Remove(c *websocket.Conn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if client, ok := r.clients[c]; ok {
+		client.writeMu.Lock()
+		client.markClosed()
+		client.writeMu.Unlock()
+	}
+	delete(r.clients, c)
+}
+
+// Deregister removes a client whose connection has failed and closes the
+// connection, so its handler stops reading from it. It is a no-op if the
+// connection's handler has already returned, since the connection may then
+// belong to another client. The client is marked closed either way.
+func (r *ClientRegistry) Deregister(client *Client) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	client.writeMu.Lock()
+	defer client.writeMu.Unlock()
+	client.markClosed()
+	if r.clients[client.conn] != client {
+		return
+	}
+	delete(r.clients, client.conn)
+	client.conn.Close()
+}
+
+// Range calls fn for every registered client.
+// It iterates over a snapshot taken under the read lock, so fn is free to
+// call Add or Remove without deadlocking. Returning false stops the iteration.
+func (r *ClientRegistry) Range(fn func(client *Client) bool) {
+	r.mu.RLock()
+	clients := make([]*Client, 0, len(r.clients))
+	for _, client := range r.clients {
+		clients = append(clients, client)
+	}
+	r.mu.RUnlock()
+
+	for _, client := range clients {
+		if !fn(client) {
+			return
+		}
+	}
+}
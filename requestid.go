@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"unicode"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// requestIDKey is the Locals key holding the request's ID.
+const requestIDKey = "request_id"
+
+// maxRequestIDLength bounds incoming request IDs, which end up in every log line.
+const maxRequestIDLength = 128
+
+// handleRequestID gives every request an ID: the caller's X-Request-ID if it
+// sent a usable one, a new UUID otherwise. The ID is echoed in the response
+// and stored in Locals for requestLogger. WebSocket connections keep the ID of
+// their upgrade request.
+func handleRequestID(c *fiber.Ctx) error {
+	id := c.Get(fiber.HeaderXRequestID)
+	if !validRequestID(id) {
+		id = uuid.NewString()
+	}
+	c.Locals(requestIDKey, id)
+	c.Set(fiber.HeaderXRequestID, id)
+	return c.Next()
+}
+
+// validRequestID reports whether id is short and printable.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, r := range id {
+		if r > unicode.MaxASCII || !unicode.IsPrint(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// requestIDCtxKey is the context key for the request ID.
+type requestIDCtxKey struct{}
+
+// withRequestID returns a copy of ctx that carries the request ID, for code
+// that records it outside log lines, such as the audit log.
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDCtxKey{}, id)
+}
+
+// requestIDFrom returns the request ID stored in ctx, or "".
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDCtxKey{}).(string)
+	return id
+}
+
+// requestLogger returns the default logger with the request's ID attached.
+func requestLogger(c *fiber.Ctx) *slog.Logger {
+	id, _ := c.Locals(requestIDKey).(string)
+	return slog.With("request_id", id)
+}
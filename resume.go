@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// defaultResumeWindow is how long a response keeps streaming after its
+// connection drops, waiting for the client to reconnect and resume it.
+// It can be overridden with RESUME_WINDOW; 0 stops responses as soon as the
+// connection drops, as before.
+const defaultResumeWindow = 15 * time.Second
+
+var resumeWindow = defaultResumeWindow
+
+// replyBuffer holds the text of a conversation's latest reply, so a client
+// that lost its connection can fetch what it missed (see Follow). The text is
+// kept after the reply is done, until the next reply starts.
+//
+// Frames are written to followers with the buffer's lock held, so a follower
+// never sees a frame twice or out of order.
+type replyBuffer struct {
+	mu        sync.Mutex
+	text      strings.Builder
+	started   bool
+	streaming bool
+	followers map[*Client]struct{}
+}
+
+// Start empties the buffer for a new reply.
+func (b *replyBuffer) Start() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.text.Reset()
+	b.started = true
+	b.streaming = true
+	b.followers = nil
+}
+
+// Continue starts a reply that continues text, the reply cut off before it,
+// so offsets keep counting from where that one ended.
+func (b *replyBuffer) Continue(text string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.text.Reset()
+	b.text.WriteString(text)
+	b.started = true
+	b.streaming = true
+	b.followers = nil
+}
+
+// Append adds streamed text to the buffer and sends the frame built by
+// frameFor to every follower. frameFor gets the reply's length in bytes
+// including text, which clients resume from.
+func (b *replyBuffer) Append(text string, frameFor func(offset int) interface{}) interface{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.text.WriteString(text)
+	frame := frameFor(b.text.Len())
+	for cl := range b.followers {
+		cl.WriteJSON(frame)
+	}
+	return frame
+}
+
+// Finish marks the reply as done and sends the final frame to the followers,
+// who stop following.
+func (b *replyBuffer) Finish(frame interface{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.streaming = false
+	for cl := range b.followers {
+		cl.WriteJSON(frame)
+	}
+	b.followers = nil
+}
+
+// Follow sends cl the part of the reply after offset, using frameFor as in
+// Append. If the reply is still streaming, cl also gets the rest of it as it
+// arrives, and the final frame. It reports false if there is no reply to
+// resume.
+//
+// The offset comes from the client, so it is clamped to the reply and moved
+// back to the start of the character it falls in; the client gets that whole
+// character again rather than invalid UTF-8.
+func (b *replyBuffer) Follow(cl *Client, offset int, frameFor func(text string, offset int) interface{}) (streaming, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.started {
+		return false, false
+	}
+	text := b.text.String()
+	offset = max(0, min(offset, len(text)))
+	for offset > 0 && offset < len(text) && !utf8.RuneStart(text[offset]) {
+		offset--
+	}
+	if tail := text[offset:]; tail != "" {
+		cl.WriteJSON(frameFor(tail, len(text)))
+	}
+	if b.streaming {
+		if b.followers == nil {
+			b.followers = make(map[*Client]struct{})
+		}
+		b.followers[cl] = struct{}{}
+	}
+	return b.streaming, true
+}
+
+// Unfollow stops sending frames to cl, e.g. because its connection closed.
+func (b *replyBuffer) Unfollow(cl *Client) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.followers, cl)
+}
+
+// followed reports whether any client is following the reply.
+func (b *replyBuffer) followed() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.followers) > 0
+}
+
+// outliveConnection returns the context for a response streamed for a
+// connection whose context is ctx. When the connection closes, the response
+// keeps going for resumeWindow; it is cancelled then unless a reconnected
+// client has started following it. The returned cancel func must be called
+// once the response is done.
+func outliveConnection(ctx context.Context, buf *replyBuffer) (context.Context, context.CancelFunc) {
+	if resumeWindow <= 0 {
+		return context.WithCancel(ctx)
+	}
+	genCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	go func() {
+		select {
+		case <-genCtx.Done():
+			return
+		case <-ctx.Done():
+		}
+		timer := time.NewTimer(resumeWindow)
+		defer timer.Stop()
+		select {
+		case <-genCtx.Done():
+		case <-timer.C:
+			if !buf.followed() {
+				loggerFrom(ctx).Info("nobody resumed the response, stopping it")
+				cancel()
+			}
+		}
+	}()
+	return genCtx, cancel
+}
+
+// resumeReply answers a "resume" message: the client gets the part of the
+// conversation's latest reply after offset and, if it is still streaming, the
+// rest as it arrives. If there is nothing to resume, the client is told to
+// send its message again with a "restart" frame.
+func resumeReply(client *Client, conv *Conversation, offset int) {
+	streaming, ok := conv.Reply().Follow(client, offset, func(text string, end int) interface{} {
+		return WebSocketMessage{Role: "assistant", Text: text, Offset: end, ConversationID: conv.ID()}
+	})
+	if !ok {
+		client.WriteJSON(WebSocketMessage{
+			Type:           "restart",
+			Text:           "the response can't be resumed, please send your message again",
+			ConversationID: conv.ID(),
+		})
+		return
+	}
+	if !streaming {
+		client.WriteJSON(WebSocketMessage{Type: "done", ConversationID: conv.ID()})
+	}
+}
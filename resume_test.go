@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"unicode/utf8"
+)
+
+// followFrom follows buf from offset and returns the text of the frame it got,
+// if any.
+func followFrom(t *testing.T, buf *replyBuffer, offset int) (string, bool) {
+	t.Helper()
+	cl := &Client{send: make(chan outgoing, 1)}
+	_, ok := buf.Follow(cl, offset, func(text string, end int) interface{} {
+		return WebSocketMessage{Role: "assistant", Text: text, Offset: end}
+	})
+	if !ok {
+		t.Fatalf("Follow(%d) found no reply", offset)
+	}
+	select {
+	case frame := <-cl.send:
+		if !utf8.Valid(frame.data) {
+			t.Fatalf("frame is not valid UTF-8: %q", frame.data)
+		}
+		var msg WebSocketMessage
+		if err := json.Unmarshal(frame.data, &msg); err != nil {
+			t.Fatalf("unmarshal frame: %v", err)
+		}
+		return msg.Text, true
+	default:
+		return "", false
+	}
+}
+
+func TestReplyBufferFollowOffset(t *testing.T) {
+	const reply = "héllo wörld" // é and ö are two bytes each
+	tests := []struct {
+		name   string
+		offset int
+		want   string
+	}{
+		{"start", 0, reply},
+		{"middle", 7, "wörld"},
+		{"negative", -5, reply},
+		{"inside é", 2, "éllo wörld"},
+		{"inside ö", 9, "örld"},
+		{"end", len(reply), ""},
+		{"beyond the end", len(reply) + 100, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf replyBuffer
+			buf.Start()
+			buf.Append(reply, func(int) interface{} { return nil })
+			got, sent := followFrom(t, &buf, tt.offset)
+			if got != tt.want || sent != (tt.want != "") {
+				t.Errorf("Follow(%d) sent %q (sent %v), want %q", tt.offset, got, sent, tt.want)
+			}
+		})
+	}
+}
+
+func TestReplyBufferFollowNothingStarted(t *testing.T) {
+	var buf replyBuffer
+	if _, ok := buf.Follow(&Client{send: make(chan outgoing, 1)}, 0, nil); ok {
+		t.Error("Follow found a reply in an empty buffer")
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// defaultMaxRetries is how many times a failed OpenAI request is retried.
+// It can be overridden with the OPENAI_MAX_RETRIES environment variable.
+const defaultMaxRetries = 3
+
+// Backoff starts at retryBaseDelay and doubles on every attempt, up to retryMaxDelay.
+const (
+	retryBaseDelay = 500 * time.Millisecond
+	retryMaxDelay  = 10 * time.Second
+)
+
+// maxRetries is the configured number of retries for transient OpenAI failures.
+var maxRetries = defaultMaxRetries
+
+// isRetryableStatus reports whether an HTTP status code is worth retrying.
+// Rate limits and server-side hiccups usually go away on their own.
+func isRetryableStatus(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests,
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable:
+		return true
+	}
+	return false
+}
+
+// doWithRetry sends a request with the given method and body (nil for none),
+// retrying transient failures.
+// Network errors and retryable status codes are retried up to `retries` times
+// with exponential backoff and jitter, honoring a Retry-After header when present.
+//
+// Retrying only ever happens here, before the response body is handed back, so a
+// stream that has already started sending tokens to the client is never repeated.
+func doWithRetry(ctx context.Context, client *http.Client, method, url string, body []byte, header http.Header, retries int) (*http.Response, error) {
+	debugRequest(ctx, url, header, body)
+	for attempt := 0; ; attempt++ {
+		// The request is rebuilt every attempt because its body can only be read once.
+		req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header = header.Clone()
+
+		resp, err := client.Do(req)
+		if attempt >= retries || ctx.Err() != nil {
+			return resp, err
+		}
+		if err == nil && !isRetryableStatus(resp.StatusCode) {
+			return resp, nil
+		}
+
+		delay := backoffDelay(attempt)
+		if err == nil {
+			if retryAfter, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+				delay = retryAfter
+			}
+			// Drain and close the failed response so the connection can be reused.
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+			resp.Body.Close()
+		}
+
+		// Wait before the next attempt, giving up early if the client goes away.
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// backoffDelay returns the wait before retry number `attempt` (starting at 0).
+// Random jitter of up to half the delay keeps many clients from retrying in lockstep.
+func backoffDelay(attempt int) time.Duration {
+	delay := retryBaseDelay << attempt
+	if delay <= 0 || delay > retryMaxDelay {
+		delay = retryMaxDelay
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// parseRetryAfter parses a Retry-After header, which is either a number of
+// seconds or an HTTP date. Waits longer than retryMaxDelay are capped.
+func parseRetryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	var d time.Duration
+	if seconds, err := strconv.Atoi(value); err == nil {
+		d = time.Duration(seconds) * time.Second
+	} else if t, err := http.ParseTime(value); err == nil {
+		d = time.Until(t)
+	} else {
+		return 0, false
+	}
+	if d < 0 {
+		d = 0
+	}
+	if d > retryMaxDelay {
+		d = retryMaxDelay
+	}
+	return d, true
+}
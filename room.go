@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// room is the shared room when ROOM_MODE is on, and nil otherwise.
+var room *Room
+
+// Room is a conversation shared by several connections. Every member sees each
+// reply as it streams, and messages from any member go to the shared history.
+// Replies are generated one at a time for the whole room, in the order the
+// messages arrived, so two members can't make the model answer concurrently.
+//
+// A reply belongs to the room rather than the member who asked for it: it is
+// published to every member, keeps going if that member leaves, and any
+// member can stop it.
+type Room struct {
+	conv *Conversation
+	jobs chan func()
+
+	mu      sync.Mutex
+	members map[*Client]struct{}
+	// ctx is the context ProcessQueue runs with; replies end with it.
+	ctx context.Context
+	// stop cancels the reply streaming in the room, if any.
+	stop context.CancelFunc
+}
+
+// NewRoom returns an empty room around conv. Its queue is worked off by
+// ProcessQueue, which must be started separately.
+func NewRoom(conv *Conversation) *Room {
+	return &Room{
+		conv:    conv,
+		jobs:    make(chan func(), messageQueueSize),
+		members: make(map[*Client]struct{}),
+		ctx:     context.Background(),
+	}
+}
+
+// Conversation returns the room's shared conversation.
+func (r *Room) Conversation() *Conversation {
+	return r.conv
+}
+
+// Join adds a connection to the room. From now on, frames the client
+// publishes go to every member.
+func (r *Room) Join(cl *Client) {
+	r.mu.Lock()
+	r.members[cl] = struct{}{}
+	r.mu.Unlock()
+	cl.mu.Lock()
+	cl.room = r
+	cl.mu.Unlock()
+}
+
+// Leave removes a connection from the room, e.g. when it closes. The client
+// keeps its room, so a reply it asked for still reaches the other members.
+func (r *Room) Leave(cl *Client) {
+	r.mu.Lock()
+	delete(r.members, cl)
+	r.mu.Unlock()
+}
+
+// Broadcast sends v to every member except the given one (which may be nil).
+// Each member's WriteJSON takes that connection's write lock, so frames never
+// interleave on a connection; a member whose write fails is about to leave
+// and is skipped.
+func (r *Room) Broadcast(v interface{}, except *Client) {
+	r.mu.Lock()
+	members := make([]*Client, 0, len(r.members))
+	for cl := range r.members {
+		if cl != except {
+			members = append(members, cl)
+		}
+	}
+	r.mu.Unlock()
+
+	for _, cl := range members {
+		cl.WriteJSON(v)
+	}
+}
+
+// Enqueue adds a reply job to the room's queue without blocking.
+// It reports false if the queue is full.
+func (r *Room) Enqueue(job func()) bool {
+	select {
+	case r.jobs <- job:
+		return true
+	default:
+		return false
+	}
+}
+
+// StartGeneration returns the context for the room's next reply. It keeps the
+// values of ctx, the asking member's, but not its cancellation: the reply is
+// cancelled by Stop, or when ProcessQueue's context ends. The returned finish
+// func must be called when the reply is done.
+func (r *Room) StartGeneration(ctx context.Context) (genCtx context.Context, finish func()) {
+	genCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stopAfter := context.AfterFunc(r.ctx, cancel)
+	r.stop = cancel
+	return genCtx, func() {
+		stopAfter()
+		cancel()
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.stop = nil
+	}
+}
+
+// Generating reports whether a reply is streaming in the room.
+func (r *Room) Generating() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stop != nil
+}
+
+// Stop cancels the reply streaming in the room, whichever member asked for
+// it. It reports false if there is none.
+func (r *Room) Stop() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.stop == nil {
+		return false
+	}
+	r.stop()
+	r.stop = nil
+	return true
+}
+
+// ProcessQueue runs queued jobs one after another until ctx is cancelled.
+func (r *Room) ProcessQueue(ctx context.Context) {
+	r.mu.Lock()
+	r.ctx = ctx
+	r.mu.Unlock()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case job := <-r.jobs:
+			job()
+		}
+	}
+}
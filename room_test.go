@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	fastws "github.com/fasthttp/websocket"
+)
+
+// gatedProvider streams first, then waits for release before streaming rest.
+// cancelled is closed if the reply's context ends while it waits.
+type gatedProvider struct {
+	first, rest        string
+	release, cancelled chan struct{}
+}
+
+func newGatedProvider(first, rest string) *gatedProvider {
+	return &gatedProvider{first: first, rest: rest, release: make(chan struct{}), cancelled: make(chan struct{})}
+}
+
+// StreamCompletion implements Provider.
+func (p *gatedProvider) StreamCompletion(ctx context.Context, req CompletionRequest) (<-chan StreamEvent, error) {
+	events := make(chan StreamEvent)
+	go func() {
+		defer close(events)
+		if !sendEvent(ctx, events, StreamEvent{Content: p.first}) {
+			return
+		}
+		select {
+		case <-p.release:
+		case <-ctx.Done():
+			close(p.cancelled)
+			return
+		}
+		if sendEvent(ctx, events, StreamEvent{Content: p.rest}) {
+			sendEvent(ctx, events, StreamEvent{FinishReason: "stop"})
+		}
+	}()
+	return events, nil
+}
+
+// startTestRoom runs the app in room mode, answering with p, and returns its
+// WebSocket URL.
+func startTestRoom(t *testing.T, p Provider) string {
+	t.Helper()
+	// The room is put back only after the server's connections are done.
+	setForTest(t, &room, nil)
+	// Titles would be asked of p as well.
+	setForTest(t, &generateTitles, false)
+	url := startTestServer(t, p)
+	conv, _, err := conversations.Open(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	room = NewRoom(conv)
+	go room.ProcessQueue(ctx)
+	return url
+}
+
+// readUntilReply reads frames up to and including the first assistant frame.
+func readUntilReply(t *testing.T, conn *fastws.Conn) []testFrame {
+	t.Helper()
+	var frames []testFrame
+	for {
+		frame := readFrame(t, conn)
+		frames = append(frames, frame)
+		if frame.Role == "assistant" && frame.Type == "" {
+			return frames
+		}
+	}
+}
+
+func TestRoomReplyOutlivesSender(t *testing.T) {
+	p := newGatedProvider("Hel", "lo")
+	url := startTestRoom(t, p)
+	alice, _ := connect(t, url)
+	bob, _ := connect(t, url)
+	if err := alice.WriteJSON(WebSocketMessage{Text: "Hi"}); err != nil {
+		t.Fatal(err)
+	}
+	frames := readUntilReply(t, bob)
+
+	// Once the sender has left the room, the rest of the reply still reaches bob.
+	alice.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for connectedClients() > 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(p.release)
+	frames = append(frames, readUntil(t, bob, "done")...)
+
+	if got := replyText(frames); got != "Hello" {
+		t.Errorf("bob got the reply %q, want Hello", got)
+	}
+	if done := frames[len(frames)-1]; done.Reason != "stop" {
+		t.Errorf("done reason = %q, want stop", done.Reason)
+	}
+}
+
+func TestRoomMemberStopsReply(t *testing.T) {
+	p := newGatedProvider("Hel", "lo")
+	url := startTestRoom(t, p)
+	alice, _ := connect(t, url)
+	bob, _ := connect(t, url)
+	if err := alice.WriteJSON(WebSocketMessage{Text: "Hi"}); err != nil {
+		t.Fatal(err)
+	}
+	readUntilReply(t, bob)
+
+	// Bob stops the reply alice asked for.
+	if err := bob.WriteJSON(WebSocketMessage{Type: "stop", ID: "s1"}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-p.cancelled:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the reply was not cancelled")
+	}
+	frames := readUntil(t, bob, "done")
+	if acks := framesOfType(frames, "ack"); len(acks) != 1 || acks[0].ID != "s1" {
+		t.Errorf("bob's frames = %+v, want the stop message acknowledged", frames)
+	}
+	if done := readUntil(t, alice, "done"); done[len(done)-1].Reason != "" {
+		t.Errorf("alice's done reason = %q, want none for a stopped reply", done[len(done)-1].Reason)
+	}
+}
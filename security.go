@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// defaultCSP is the Content-Security-Policy sent with the frontend. It allows
+// the CDNs the bundled index.html loads its libraries from, its inline script
+// and the styles Tailwind injects; connect-src is filled in by buildCSP.
+const defaultCSP = "default-src 'self'; " +
+	"script-src 'self' 'unsafe-inline' https://unpkg.com https://cdn.jsdelivr.net https://cdn.tailwindcss.com https://cdnjs.cloudflare.com; " +
+	"style-src 'self' 'unsafe-inline' https://cdnjs.cloudflare.com; " +
+	"img-src 'self' data: https:; " +
+	"connect-src %s; " +
+	"frame-ancestors 'none'; base-uri 'self'; form-action 'self'"
+
+// buildCSP returns the policy to send: csp if it is set, otherwise defaultCSP
+// allowing connections to the page's own origin (which includes its WebSocket
+// in current browsers) and to connectSrc.
+func buildCSP(csp string, connectSrc []string) string {
+	if csp != "" {
+		return csp
+	}
+	return fmt.Sprintf(defaultCSP, strings.Join(append([]string{"'self'"}, connectSrc...), " "))
+}
+
+// newSecurityHeaders returns middleware that adds hardening headers to the
+// frontend's responses: index.html and the static files. API and WebSocket
+// paths are left alone.
+func newSecurityHeaders(csp string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if !isServerPath(c.Path()) {
+			c.Set(fiber.HeaderContentSecurityPolicy, csp)
+			c.Set(fiber.HeaderXContentTypeOptions, "nosniff")
+			c.Set(fiber.HeaderXFrameOptions, "DENY")
+			c.Set(fiber.HeaderReferrerPolicy, "strict-origin-when-cross-origin")
+		}
+		return c.Next()
+	}
+}
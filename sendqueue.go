@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/gofiber/websocket/v2"
+)
+
+// defaultSendQueueSize is how many frames may wait to be written to one
+// connection. It can be overridden with SEND_QUEUE_SIZE; with 0 every frame
+// is written by the goroutine that produced it, which then waits for the client.
+const defaultSendQueueSize = 256
+
+// Policies for a full send queue (SEND_QUEUE_OVERFLOW).
+const (
+	// sendOverflowClose drops a client that can't keep up with a 1008 close frame.
+	sendOverflowClose = "close"
+	// sendOverflowBlock makes the producer wait until there is room again.
+	sendOverflowBlock = "block"
+)
+
+var (
+	sendQueueSize = defaultSendQueueSize
+	sendOverflow  = sendOverflowClose
+)
+
+// sendWriteTimeout bounds writing one queued frame, so a client that stopped
+// reading can't hold its writer forever.
+const sendWriteTimeout = 10 * time.Second
+
+// errSlowClient is returned for frames to a client that was dropped because
+// its send queue overflowed.
+var errSlowClient = errors.New("client is reading too slowly")
+
+// outgoing is a frame waiting in a client's send queue. One without data is
+// a close frame, which ends the queue.
+type outgoing struct {
+	data        []byte
+	closeCode   int
+	closeReason string
+}
+
+// writeLoop writes the client's queued frames in order until the client is
+// closed. A failed write drops the client, the same as a failed direct write.
+func (cl *Client) writeLoop() {
+	defer close(cl.writerDone)
+	for {
+		select {
+		case <-cl.stopWriter:
+			return
+		case frame := <-cl.send:
+			if frame.data == nil {
+				closeConnection(cl.conn, frame.closeCode, frame.closeReason)
+				return
+			}
+			cl.conn.SetWriteDeadline(time.Now().Add(sendWriteTimeout))
+			if err := cl.conn.WriteMessage(websocket.TextMessage, frame.data); err != nil {
+				// Deregister needs writeMu, which a blocked producer may hold
+				// until it sees writerDone.
+				go registry.Deregister(cl)
+				return
+			}
+		}
+	}
+}
+
+// enqueue queues a frame for writeLoop. cl.writeMu must be held. When the
+// queue is full the client is dropped, or with SEND_QUEUE_OVERFLOW=block the
+// caller waits for room.
+func (cl *Client) enqueue(frame outgoing) error {
+	select {
+	case cl.send <- frame:
+		return nil
+	default:
+	}
+	if sendOverflow == sendOverflowBlock {
+		select {
+		case cl.send <- frame:
+			return nil
+		case <-cl.writerDone:
+			return errClientClosed
+		}
+	}
+	// The client hasn't been removed (closed is false under writeMu), so the
+	// connection is still its own.
+	slog.Warn("dropping a client that reads too slowly", "conn_id", cl.id, "send_queue_size", cap(cl.send))
+	cl.markClosed()
+	closeConnection(cl.conn, websocket.ClosePolicyViolation, "reading too slowly")
+	return errSlowClient
+}
+
+// markClosed marks the client closed and stops its writer. cl.writeMu must be held.
+func (cl *Client) markClosed() {
+	if cl.closed {
+		return
+	}
+	cl.closed = true
+	if cl.stopWriter != nil {
+		close(cl.stopWriter)
+	}
+}
+
+// waitWriter waits for the client's writer to stop. The connection handler
+// calls it after removing the client, before the connection can be reused.
+func (cl *Client) waitWriter() {
+	if cl.writerDone != nil {
+		<-cl.writerDone
+	}
+}
+
+// Close sends a close frame with the given code and reason (see
+// closeConnection) once the frames already queued are written, and closes
+// the connection. If they aren't written within closeWriteTimeout, the
+// connection is closed without them.
+func (cl *Client) Close(code int, reason string) {
+	cl.writeMu.Lock()
+	if cl.closed {
+		cl.writeMu.Unlock()
+		return
+	}
+	if cl.send != nil {
+		select {
+		case cl.send <- outgoing{closeCode: code, closeReason: reason}:
+			cl.writeMu.Unlock()
+			select {
+			case <-cl.writerDone:
+				return
+			case <-time.After(closeWriteTimeout):
+			}
+			cl.writeMu.Lock()
+			if cl.closed {
+				cl.writeMu.Unlock()
+				return
+			}
+		default:
+		}
+	}
+	defer cl.writeMu.Unlock()
+	closeConnection(cl.conn, code, reason)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	fastws "github.com/fasthttp/websocket"
+)
+
+// setForTest sets *p to v until the test ends.
+func setForTest[T any](t *testing.T, p *T, v T) {
+	t.Helper()
+	old := *p
+	*p = v
+	t.Cleanup(func() { *p = old })
+}
+
+// startTestServer runs the app on a local port, answering with p and keeping
+// conversations in memory, and returns its WebSocket URL. Settings the test
+// changes before connecting apply to the server.
+func startTestServer(t *testing.T, p Provider) string {
+	t.Helper()
+	setForTest(t, &llm, p)
+	setForTest[ConversationStore](t, &store, newMemoryStore())
+	setForTest(t, &registry, NewClientRegistry(0))
+	setForTest(t, &conversations, NewConversationRegistry())
+	setForTest(t, &limiter, NewRateLimiter(defaultMaxConnsPerIP, defaultMsgsPerMinute))
+	setForTest(t, &upstreamBreaker, newBreaker(defaultBreakerFailures, defaultBreakerCooldown))
+	// Cleanup waits for the streams the test started, which starts shutdown.
+	endShutdownAfter(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := newApp(Config{})
+	go app.Listener(ln)
+	t.Cleanup(func() {
+		// The connections' handlers and the responses they started use the
+		// settings above, so they must be done before the settings are put back.
+		deadline := time.Now().Add(2 * time.Second)
+		for connectedClients() > 0 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		waitForStreams(time.Until(deadline))
+		app.ShutdownWithTimeout(time.Second)
+	})
+	return "ws://" + ln.Addr().String() + "/ws"
+}
+
+// testFrame decodes the frames the tests look at, tool calls included.
+type testFrame struct {
+	WebSocketMessage
+	Arguments string `json:"arguments"`
+	Result    string `json:"result"`
+}
+
+// connectedClients counts the registered connections.
+func connectedClients() int {
+	n := 0
+	registry.Range(func(*Client) bool { n++; return true })
+	return n
+}
+
+// dialTestServer connects to url with the given subprotocols; the connection
+// is closed when the test ends.
+func dialTestServer(t *testing.T, url string, subprotocols ...string) *fastws.Conn {
+	t.Helper()
+	dialer := fastws.Dialer{Subprotocols: subprotocols, HandshakeTimeout: 2 * time.Second}
+	conn, _, err := dialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("dial %s: %v", url, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// connect dials url with the current protocol and reads frames up to the
+// conversation frame, returning its ID.
+func connect(t *testing.T, url string) (*fastws.Conn, string) {
+	t.Helper()
+	conn := dialTestServer(t, url, subprotocols[0])
+	frames := readUntil(t, conn, "conversation")
+	return conn, frames[len(frames)-1].ConversationID
+}
+
+// readFrame reads the next frame, failing the test if none comes in time.
+func readFrame(t *testing.T, conn *fastws.Conn) testFrame {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("reading a frame: %v", err)
+	}
+	var frame testFrame
+	if err := json.Unmarshal(data, &frame); err != nil {
+		t.Fatalf("frame %s: %v", data, err)
+	}
+	return frame
+}
+
+// readUntil reads frames up to and including the first of type frameType.
+func readUntil(t *testing.T, conn *fastws.Conn, frameType string) []testFrame {
+	t.Helper()
+	var frames []testFrame
+	for {
+		frame := readFrame(t, conn)
+		frames = append(frames, frame)
+		if frame.Type == frameType {
+			return frames
+		}
+	}
+}
+
+// readClose reads frames until the server closes the connection and returns
+// them with the close frame's code and reason.
+func readClose(t *testing.T, conn *fastws.Conn) ([]testFrame, int, string) {
+	t.Helper()
+	var frames []testFrame
+	for {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			closeErr, ok := err.(*fastws.CloseError)
+			if !ok {
+				t.Fatalf("connection ended with %v, want a close frame", err)
+			}
+			return frames, closeErr.Code, closeErr.Text
+		}
+		var frame testFrame
+		if err := json.Unmarshal(data, &frame); err != nil {
+			t.Fatalf("frame %s: %v", data, err)
+		}
+		frames = append(frames, frame)
+	}
+}
+
+// replyText joins the text of the assistant frames.
+func replyText(frames []testFrame) string {
+	var text strings.Builder
+	for _, frame := range frames {
+		if frame.Role == "assistant" && frame.Type == "" {
+			text.WriteString(frame.Text)
+		}
+	}
+	return text.String()
+}
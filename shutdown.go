@@ -0,0 +1,76 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gofiber/websocket/v2"
+)
+
+// defaultShutdownTimeout bounds how long shutdown waits for in-flight responses.
+// It can be overridden with the SHUTDOWN_TIMEOUT environment variable.
+const defaultShutdownTimeout = 10 * time.Second
+
+// Streams are counted under streamsMu, which also guards the start of
+// shutdown, so no stream starts once shutdown is waiting for the others.
+var (
+	streamsMu sync.Mutex
+	// activeStreams counts responses being streamed so shutdown can wait for them.
+	activeStreams int
+	// shuttingDown is set once shutdown starts; no new responses are started after that.
+	shuttingDown bool
+	// streamsDone is closed once shutdown has started and no stream is left.
+	streamsDone = make(chan struct{})
+)
+
+// trackStream runs fn, a response being streamed, so that shutdown can wait
+// for it: WebSocket replies, /api/stream streams and title generation. It
+// reports false, without running fn, once shutdown has started.
+func trackStream(fn func()) bool {
+	streamsMu.Lock()
+	if shuttingDown {
+		streamsMu.Unlock()
+		return false
+	}
+	activeStreams++
+	streamsMu.Unlock()
+	defer func() {
+		streamsMu.Lock()
+		defer streamsMu.Unlock()
+		if activeStreams--; activeStreams == 0 && shuttingDown {
+			close(streamsDone)
+		}
+	}()
+	fn()
+	return true
+}
+
+// waitForStreams starts shutdown and blocks until every active stream has
+// finished or the timeout expires. It reports whether all streams finished in time.
+func waitForStreams(timeout time.Duration) bool {
+	streamsMu.Lock()
+	if !shuttingDown {
+		shuttingDown = true
+		if activeStreams == 0 {
+			close(streamsDone)
+		}
+	}
+	done := streamsDone
+	streamsMu.Unlock()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// closeAllClients tells every connected client the server is going away and
+// sends a clean WebSocket close frame so browsers don't see an abrupt drop.
+func closeAllClients(reason string) {
+	registry.Range(func(client *Client) bool {
+		client.WriteJSON(WebSocketMessage{Type: "info", Text: reason})
+		client.Close(websocket.CloseGoingAway, reason)
+		return true
+	})
+}
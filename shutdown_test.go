@@ -0,0 +1,68 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// endShutdownAfter undoes, when the test ends, the shutdown that waiting for
+// streams starts.
+func endShutdownAfter(t *testing.T) {
+	t.Cleanup(func() {
+		streamsMu.Lock()
+		defer streamsMu.Unlock()
+		shuttingDown, streamsDone = false, make(chan struct{})
+	})
+}
+
+func TestWaitForStreams(t *testing.T) {
+	endShutdownAfter(t)
+	release, running := make(chan struct{}), make(chan struct{})
+	go trackStream(func() {
+		close(running)
+		<-release
+	})
+	<-running
+	if waitForStreams(20 * time.Millisecond) {
+		t.Fatal("waitForStreams = true while a stream is running")
+	}
+	close(release)
+	if !waitForStreams(time.Second) {
+		t.Fatal("waitForStreams = false after the stream finished")
+	}
+}
+
+func TestTrackStreamAfterShutdown(t *testing.T) {
+	endShutdownAfter(t)
+	waitForStreams(time.Second)
+	ran := false
+	if trackStream(func() { ran = true }) || ran {
+		t.Errorf("trackStream ran a stream after shutdown started")
+	}
+}
+
+func TestShutdownRejectsNewReplies(t *testing.T) {
+	url := startTestServer(t, &MockProvider{Text: "hello"})
+	conn, _ := connect(t, url)
+	waitForStreams(time.Second)
+	if err := conn.WriteJSON(WebSocketMessage{Text: "Hi", ID: "m1"}); err != nil {
+		t.Fatal(err)
+	}
+	frames := readUntil(t, conn, "error")
+	if last := frames[len(frames)-1]; last.ID != "m1" || last.Text != "server is shutting down" {
+		t.Errorf("error frame = %+v, want m1 rejected because the server is shutting down", last)
+	}
+	if len(framesOfType(frames, "start")) > 0 {
+		t.Errorf("frames = %+v, want no reply started", frames)
+	}
+}
+
+func TestShutdownRejectsNewStreams(t *testing.T) {
+	endShutdownAfter(t)
+	waitForStreams(time.Second)
+	body := getStream(t, &MockProvider{Text: "hello"}, time.Second)
+	if !strings.HasSuffix(body, "event: error\ndata: server is shutting down\n\n") || strings.Contains(body, "hello") {
+		t.Errorf("body = %q, want only the shutting down error", body)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// defaultStaticDir is where the frontend is served from unless STATIC_DIR says otherwise.
+const defaultStaticDir = "./static"
+
+// defaultStaticAssetsPrefix is where the frontend keeps its scripts, styles and images.
+const defaultStaticAssetsPrefix = "/assets"
+
+// staticDir is the directory the frontend is served from.
+var staticDir = defaultStaticDir
+
+// staticAssetsPrefix is the path under which missing files are reported as
+// 404 instead of getting index.html.
+var staticAssetsPrefix = defaultStaticAssetsPrefix
+
+// serverPaths are handled by the server itself, never by the frontend.
+var serverPaths = []string{"/api", "/ws", "/healthz", "/readyz", "/metrics", "/debug"}
+
+// isServerPath reports whether path belongs to one of the server's own routes.
+func isServerPath(path string) bool {
+	for _, prefix := range serverPaths {
+		if hasPathPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasPathPrefix reports whether path is prefix or lies below it.
+func hasPathPrefix(path, prefix string) bool {
+	return path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+// handleSPAFallback serves index.html for paths no route or static file
+// matched, so the frontend's client-side router can handle them. Unknown
+// server paths, missing assets and requests other than GET stay 404s.
+func handleSPAFallback(c *fiber.Ctx) error {
+	path := c.Path()
+	if c.Method() != fiber.MethodGet && c.Method() != fiber.MethodHead {
+		return fiber.ErrNotFound
+	}
+	if isServerPath(path) || hasPathPrefix(path, staticAssetsPrefix) {
+		return fiber.ErrNotFound
+	}
+	return c.SendFile(filepath.Join(staticDir, "index.html"))
+}
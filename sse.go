@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/valyala/fasthttp"
+)
+
+// handleStreamAPI streams a reply as Server-Sent Events, for proxies and clients
+// that handle SSE better than WebSockets (including HTMX's SSE extension).
+//
+// GET /api/stream?message=...&model=... sends a single user message.
+// POST /api/stream accepts the same JSON body as POST /api/chat.
+//
+// Each chunk is sent as a "message" event, followed by a final "done" event.
+// If the reply can't be generated, or isn't finished within API_TIMEOUT, an
+// "error" event is sent instead.
+func handleStreamAPI(c *fiber.Ctx) error {
+	var req ChatAPIRequest
+	if c.Method() == fiber.MethodPost {
+		if err := parseChatAPIRequest(c, &req); err != nil {
+			return apiError(c, err.Code, err.Message)
+		}
+	} else {
+		req.Model = c.Query("model")
+		if message := c.Query("message"); message != "" {
+			req.Messages = []Message{{Role: "user", Content: message}}
+		}
+	}
+	completionReq, err := req.toCompletionRequest()
+	if err != nil {
+		return apiError(c, fiber.StatusBadRequest, err.Error())
+	}
+	completionReq.User = endUserID(c)
+	// Once the stream has started the status can't change, so configuration is checked first.
+	if err := checkConfig(llm); err != nil {
+		return apiError(c, fiber.StatusServiceUnavailable, err.Error())
+	}
+	// As with /api/chat, moderation and the whole stream must finish within
+	// API_TIMEOUT. The stream writer cancels ctx once it is done.
+	logger := requestLogger(c)
+	requestID, _ := c.Locals(requestIDKey).(string)
+	ctx, cancel := withAPITimeout(withRequestID(withLogger(context.Background(), logger), requestID))
+	if err := moderate(ctx, lastUserMessage(completionReq.Messages)); err != nil {
+		cancel()
+		countModerationError(err)
+		return apiError(c, httpStatusForError(err), err.Error())
+	}
+
+	c.Set("Content-Type", "text/event-stream")
+	c.Set("Cache-Control", "no-cache")
+	c.Set("Connection", "keep-alive")
+	// Ask reverse proxies such as nginx not to buffer the stream.
+	c.Set("X-Accel-Buffering", "no")
+
+	// The stream writer runs after the handler returns. Its context is cancelled as
+	// soon as a write fails, which means the client went away.
+	c.Context().SetBodyStreamWriter(fasthttp.StreamWriter(func(w *bufio.Writer) {
+		defer cancel()
+		// trackStream lets shutdown wait for the stream to finish.
+		if !trackStream(func() { writeStream(ctx, cancel, w, logger, completionReq) }) {
+			writeSSE(w, "error", "server is shutting down")
+		}
+	}))
+	return nil
+}
+
+// writeStream streams the reply to completionReq to w as events. cancel is
+// called once a write fails, which means the client went away.
+func writeStream(ctx context.Context, cancel context.CancelFunc, w *bufio.Writer, logger *slog.Logger, completionReq CompletionRequest) {
+	events, err := streamCompletion(ctx, llm, completionReq)
+	if err != nil {
+		logger.Error("completion failed", "path", "/api/stream", "model", completionReq.Model, "err", err)
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			writeSSE(w, "error", errAPITimeout)
+		} else {
+			writeSSE(w, "error", err.Error())
+		}
+		return
+	}
+	var reply strings.Builder
+	var usage *Usage
+	// The exchange is audited however the stream ends.
+	defer func() {
+		entry := AuditEntry{
+			Source:   "stream",
+			Model:    completionReq.Model,
+			Prompt:   lastUserMessage(completionReq.Messages),
+			Response: reply.String(),
+		}
+		if usage != nil {
+			entry.PromptTokens, entry.CompletionTokens = usage.PromptTokens, usage.CompletionTokens
+		} else {
+			entry.PromptTokens = estimateMessageTokens(completionReq.Messages)
+			entry.CompletionTokens = estimateTokens(reply.String())
+			entry.UsageEstimated = true
+		}
+		auditLog.Record(ctx, entry)
+	}()
+	for event := range events {
+		if event.Err != nil {
+			writeSSE(w, "error", "the reply was interrupted by an upstream error, please try again")
+			return
+		}
+		if event.Usage != nil {
+			usage = event.Usage
+		}
+		if event.Content == "" {
+			continue
+		}
+		reply.WriteString(event.Content)
+		if writeSSE(w, "", event.Content) != nil {
+			cancel()
+			return
+		}
+	}
+	// A stream cut off by the deadline is reported with an "error" event rather than "done".
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		logger.Warn("stream timed out", "path", "/api/stream", "model", completionReq.Model, "timeout", apiTimeout)
+		writeSSE(w, "error", errAPITimeout)
+		return
+	}
+	writeSSE(w, "done", "")
+}
+
+// withAPITimeout returns a context cancelled after API_TIMEOUT, if it is set.
+func withAPITimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if apiTimeout > 0 {
+		return context.WithTimeout(ctx, apiTimeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// errAPITimeout is the error event of a stream that ran past API_TIMEOUT.
+const errAPITimeout = "the reply took longer than API_TIMEOUT"
+
+// writeSSE writes one event and flushes it to the client.
+// Multi-line data is split over several "data:" lines, as the SSE format requires;
+// clients join them back together with newlines.
+func writeSSE(w *bufio.Writer, event, data string) error {
+	if event != "" {
+		fmt.Fprintf(w, "event: %s\n", event)
+	}
+	for _, line := range strings.Split(data, "\n") {
+		fmt.Fprintf(w, "data: %s\n", line)
+	}
+	fmt.Fprint(w, "\n")
+	return w.Flush()
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// getStream requests /api/stream from a server that answers with p and
+// returns the stream's body.
+func getStream(t *testing.T, p Provider, timeout time.Duration) string {
+	t.Helper()
+	savedLLM, savedTimeout := llm, apiTimeout
+	defer func() { llm, apiTimeout = savedLLM, savedTimeout }()
+	llm, apiTimeout = p, timeout
+
+	app := fiber.New()
+	app.Get("/api/stream", handleStreamAPI)
+	resp, err := app.Test(httptest.NewRequest("GET", "/api/stream?message=hi", nil), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestStreamAPIDone(t *testing.T) {
+	body := getStream(t, &MockProvider{Text: "one two"}, time.Second)
+	if !strings.Contains(body, "data: one") || !strings.HasSuffix(body, "event: done\ndata: \n\n") {
+		t.Errorf("body = %q, want the chunks and a done event", body)
+	}
+}
+
+func TestStreamAPITimeout(t *testing.T) {
+	start := time.Now()
+	body := getStream(t, &MockProvider{Text: "one two three four five six", Delay: 50 * time.Millisecond}, 120*time.Millisecond)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("stream took %v, want it cut off after API_TIMEOUT", elapsed)
+	}
+	if !strings.HasSuffix(body, "event: error\ndata: "+errAPITimeout+"\n\n") {
+		t.Errorf("body = %q, want it to end with the timeout error", body)
+	}
+	if strings.Contains(body, "event: done") || strings.Contains(body, "six") {
+		t.Errorf("body = %q, want no done event and not the whole reply", body)
+	}
+}
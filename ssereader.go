@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"strings"
+)
+
+// sseReader splits a server-sent events stream into events.
+// An event is only complete once the blank line that terminates it has been
+// read, so a payload split across network reads is never parsed in pieces.
+type sseReader struct {
+	r *bufio.Reader
+}
+
+// newSSEReader returns an sseReader reading from r.
+func newSSEReader(r io.Reader) *sseReader {
+	return &sseReader{r: bufio.NewReader(r)}
+}
+
+// Next returns the data of the next event. An event with several data lines
+// has them joined with newlines; comments and other fields are ignored.
+// The end of the stream ends the last event even without the blank line,
+// as some compatible backends close the stream right after it; after that
+// Next returns io.EOF.
+func (s *sseReader) Next() (string, error) {
+	var data []string
+	for {
+		line, err := s.r.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if value, ok := strings.CutPrefix(line, "data:"); ok {
+			data = append(data, strings.TrimPrefix(value, " "))
+		}
+		// A blank line dispatches the event; blank lines between events are skipped.
+		if line == "" || err == io.EOF {
+			if len(data) > 0 {
+				return strings.Join(data, "\n"), nil
+			}
+			if err == io.EOF {
+				return "", io.EOF
+			}
+		}
+	}
+}
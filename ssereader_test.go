@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// trickleReader returns at most 1, 2 or 3 bytes per Read, in turn, the way a
+// slow network splits a stream at arbitrary points.
+type trickleReader struct {
+	data string
+	n    int
+}
+
+func (r *trickleReader) Read(p []byte) (int, error) {
+	if r.data == "" {
+		return 0, io.EOF
+	}
+	size := r.n%3 + 1
+	r.n++
+	if size > len(r.data) {
+		size = len(r.data)
+	}
+	if size > len(p) {
+		size = len(p)
+	}
+	n := copy(p, r.data[:size])
+	r.data = r.data[n:]
+	return n, nil
+}
+
+// readEvents returns the data of every event in stream, read a few bytes at a time.
+func readEvents(t *testing.T, stream string) []string {
+	t.Helper()
+	reader := newSSEReader(&trickleReader{data: stream})
+	var events []string
+	for {
+		data, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			return events
+		}
+		if err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+		events = append(events, data)
+	}
+}
+
+func TestSSEReaderNext(t *testing.T) {
+	tests := []struct {
+		name   string
+		stream string
+		want   []string
+	}{
+		{"single events", "data: one\n\ndata: two\n\n", []string{"one", "two"}},
+		{"no space after colon", "data:one\n\n", []string{"one"}},
+		{"multi-line data", "data: first\ndata: second\ndata:third\n\n", []string{"first\nsecond\nthird"}},
+		{"comments", ": keep-alive\ndata: one\n: in between\n\n: alone\n\n", []string{"one"}},
+		{"other fields", "event: message\nid: 7\nretry: 100\ndata: one\n\n", []string{"one"}},
+		{"CRLF line endings", "data: one\r\n\r\ndata: a\r\ndata: b\r\n\r\n", []string{"one", "a\nb"}},
+		{"blank lines between events", "\n\ndata: one\n\n\n\ndata: two\n\n", []string{"one", "two"}},
+		{"final event without blank line", "data: one\n\ndata: last\n", []string{"one", "last"}},
+		{"final line without newline", "data: one\n\ndata: last", []string{"one", "last"}},
+		{"JSON split anywhere", "data: {\"choices\":[{\"delta\":{\"content\":\"Hello\"}}]}\n\ndata: [DONE]\n\n",
+			[]string{`{"choices":[{"delta":{"content":"Hello"}}]}`, "[DONE]"}},
+		{"empty stream", "", nil},
+		{"only comments", ": ping\n\n", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := readEvents(t, tt.stream); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("events = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadOpenAIStreamSplitReads(t *testing.T) {
+	stream := "data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":\"Hel\"}}]}\n\n" +
+		": keep-alive\n\n" +
+		"data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":\"lo, wör\"}}]}\r\n\r\n" +
+		"data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":\"ld\"},\"finish_reason\":\"stop\"}]}\n\n" +
+		"data: [DONE]\n\n"
+	events := make(chan StreamEvent)
+	go func() {
+		defer close(events)
+		readOpenAIStream(context.Background(), &trickleReader{data: stream}, events)
+	}()
+	var text strings.Builder
+	var finish string
+	for event := range events {
+		if event.Err != nil {
+			t.Fatalf("stream error: %v", event.Err)
+		}
+		text.WriteString(event.Content)
+		if event.FinishReason != "" {
+			finish = event.FinishReason
+		}
+	}
+	if text.String() != "Hello, wörld" || finish != "stop" {
+		t.Errorf("text, finish reason = %q, %q; want %q, stop", text.String(), finish, "Hello, wörld")
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+)
+
+// ErrConversationNotFound is returned when a conversation ID is not in the store.
+var ErrConversationNotFound = errors.New("conversation not found")
+
+// ConversationStore persists conversations so chat history survives restarts.
+// Each WebSocket connection maps to one conversation; a client that reconnects
+// with a known conversation ID gets its history back.
+type ConversationStore interface {
+	// CreateConversation starts a new, empty conversation and returns its ID.
+	CreateConversation(ctx context.Context) (string, error)
+	// AppendMessage adds a message to the end of a conversation.
+	AppendMessage(ctx context.Context, conversationID string, m Message) error
+	// LoadMessages returns a conversation's messages in order.
+	// It returns ErrConversationNotFound for unknown IDs.
+	LoadMessages(ctx context.Context, conversationID string) ([]Message, error)
+	// TruncateMessages deletes all but the first keep messages of a conversation.
+	TruncateMessages(ctx context.Context, conversationID string, keep int) error
+}
+
+// defaultSQLitePath is where conversations are stored unless SQLITE_PATH says otherwise.
+const defaultSQLitePath = "chat.db"
+
+// store is the configured conversation store, selected by the STORE environment variable.
+var store ConversationStore
+
+// newStore opens the store selected by STORE: "sqlite" (the default) or "memory".
+func newStore(kind, sqlitePath string) (ConversationStore, error) {
+	switch strings.ToLower(kind) {
+	case "", "sqlite":
+		if sqlitePath == "" {
+			sqlitePath = defaultSQLitePath
+		}
+		return openSQLiteStore(sqlitePath)
+	case "memory":
+		return newMemoryStore(), nil
+	}
+	return nil, fmt.Errorf("unknown STORE %q", kind)
+}
+
+// memoryStore keeps conversations in memory only.
+// History survives reconnects but is lost when the server restarts.
+type memoryStore struct {
+	mu            sync.Mutex
+	conversations map[string][]Message
+	spent         map[string]memorySpend
+}
+
+// memorySpend is what one conversation has spent.
+type memorySpend struct {
+	usage Usage
+	cost  float64
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{conversations: make(map[string][]Message), spent: make(map[string]memorySpend)}
+}
+
+func (s *memoryStore) CreateConversation(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := uuid.NewString()
+	s.conversations[id] = nil
+	return id, nil
+}
+
+func (s *memoryStore) AppendMessage(ctx context.Context, conversationID string, m Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	msgs, ok := s.conversations[conversationID]
+	if !ok {
+		return ErrConversationNotFound
+	}
+	s.conversations[conversationID] = append(msgs, m)
+	return nil
+}
+
+func (s *memoryStore) LoadMessages(ctx context.Context, conversationID string) ([]Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	msgs, ok := s.conversations[conversationID]
+	if !ok {
+		return nil, ErrConversationNotFound
+	}
+	return append([]Message(nil), msgs...), nil
+}
+
+func (s *memoryStore) TruncateMessages(ctx context.Context, conversationID string, keep int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	msgs, ok := s.conversations[conversationID]
+	if !ok {
+		return ErrConversationNotFound
+	}
+	if keep < len(msgs) {
+		s.conversations[conversationID] = msgs[:keep:keep]
+	}
+	return nil
+}
+
+func (s *memoryStore) AddUsage(ctx context.Context, id string, usage Usage, cost float64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	spent := s.spent[id]
+	spent.usage.PromptTokens += usage.PromptTokens
+	spent.usage.CompletionTokens += usage.CompletionTokens
+	spent.cost += cost
+	s.spent[id] = spent
+	return nil
+}
+
+func (s *memoryStore) LoadUsage(ctx context.Context, id string) (Usage, float64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	spent := s.spent[id]
+	return spent.usage, spent.cost, nil
+}
+
+// ConversationSummary describes a stored conversation for listings.
+// Title is the generated title, or taken from the first user message until there is one.
+type ConversationSummary struct {
+	ID           string    `json:"id"`
+	Title        string    `json:"title"`
+	MessageCount int       `json:"messageCount"`
+	CreatedAt    time.Time `json:"createdAt"`
+	UpdatedAt    time.Time `json:"updatedAt"`
+}
+
+// ConversationLister is implemented by stores that keep conversations
+// persistently and can enumerate them.
+type ConversationLister interface {
+	// ListConversations returns every conversation, most recently updated first.
+	ListConversations(ctx context.Context) ([]ConversationSummary, error)
+	// GetConversation returns the summary of one conversation.
+	// It returns ErrConversationNotFound for unknown IDs.
+	GetConversation(ctx context.Context, id string) (ConversationSummary, error)
+	// SetTitle stores a conversation's generated title.
+	SetTitle(ctx context.Context, id, title string) error
+}
+
+// UsageRecorder is implemented by stores that keep what each conversation
+// has spent, so its budget still holds when it is opened again after leaving
+// memory or a restart.
+type UsageRecorder interface {
+	// AddUsage adds usage, and what it cost, to a conversation's totals.
+	AddUsage(ctx context.Context, id string, usage Usage, cost float64) error
+	// LoadUsage returns a conversation's totals; an unknown ID has spent nothing.
+	LoadUsage(ctx context.Context, id string) (Usage, float64, error)
+}
+
+// maxTitleRunes is how much of the first user message becomes a conversation's title.
+const maxTitleRunes = 60
+
+// titleFromMessage derives a conversation title from its first user message.
+func titleFromMessage(text string) string {
+	title := strings.Join(strings.Fields(text), " ")
+	if utf8.RuneCountInString(title) <= maxTitleRunes {
+		return title
+	}
+	runes := []rune(title)
+	return strings.TrimSpace(string(runes[:maxTitleRunes])) + "…"
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	// The pure-Go SQLite driver registers itself as "sqlite" and needs no cgo.
+	_ "modernc.org/sqlite"
+)
+
+// sqliteSchema creates the tables on first start. It is safe to run on every start.
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS conversations (
+	id                TEXT PRIMARY KEY,
+	created_at        TIMESTAMP NOT NULL,
+	title             TEXT,
+	prompt_tokens     INTEGER NOT NULL DEFAULT 0,
+	completion_tokens INTEGER NOT NULL DEFAULT 0,
+	cost              REAL NOT NULL DEFAULT 0
+);
+CREATE TABLE IF NOT EXISTS messages (
+	id              INTEGER PRIMARY KEY AUTOINCREMENT,
+	conversation_id TEXT NOT NULL REFERENCES conversations(id),
+	role            TEXT NOT NULL,
+	content         TEXT NOT NULL,
+	created_at      TIMESTAMP NOT NULL
+);
+CREATE INDEX IF NOT EXISTS messages_conversation_id ON messages(conversation_id, id);
+`
+
+// sqliteStore persists conversations in a SQLite database file.
+type sqliteStore struct {
+	db *sql.DB
+}
+
+// openSQLiteStore opens (or creates) the database at path and makes sure the schema exists.
+func openSQLiteStore(path string) (*sqliteStore, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows a single writer; one connection avoids "database is locked" errors.
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := migrateSQLite(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &sqliteStore{db: db}, nil
+}
+
+// sqliteAddedColumns are the conversation columns added after the first
+// version, in the order they were added, with their definitions.
+var sqliteAddedColumns = []struct{ name, definition string }{
+	{"title", "TEXT"},
+	{"prompt_tokens", "INTEGER NOT NULL DEFAULT 0"},
+	{"completion_tokens", "INTEGER NOT NULL DEFAULT 0"},
+	{"cost", "REAL NOT NULL DEFAULT 0"},
+}
+
+// migrateSQLite brings databases created by older versions up to date with sqliteSchema.
+func migrateSQLite(db *sql.DB) error {
+	for _, column := range sqliteAddedColumns {
+		var exists int
+		err := db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('conversations') WHERE name = ?`, column.name).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if exists > 0 {
+			continue
+		}
+		if _, err := db.Exec(`ALTER TABLE conversations ADD COLUMN ` + column.name + ` ` + column.definition); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sqliteStore) CreateConversation(ctx context.Context) (string, error) {
+	id := uuid.NewString()
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO conversations (id, created_at) VALUES (?, ?)`,
+		id, time.Now().UTC())
+	if err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+func (s *sqliteStore) AppendMessage(ctx context.Context, conversationID string, m Message) error {
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO messages (conversation_id, role, content, created_at) VALUES (?, ?, ?, ?)`,
+		conversationID, m.Role, m.Content, time.Now().UTC())
+	return err
+}
+
+func (s *sqliteStore) LoadMessages(ctx context.Context, conversationID string) ([]Message, error) {
+	var exists int
+	err := s.db.QueryRowContext(ctx,
+		`SELECT COUNT(*) FROM conversations WHERE id = ?`, conversationID).Scan(&exists)
+	if err != nil {
+		return nil, err
+	}
+	if exists == 0 {
+		return nil, ErrConversationNotFound
+	}
+
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT role, content FROM messages WHERE conversation_id = ? ORDER BY id`, conversationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var msgs []Message
+	for rows.Next() {
+		var m Message
+		if err := rows.Scan(&m.Role, &m.Content); err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, m)
+	}
+	return msgs, rows.Err()
+}
+
+func (s *sqliteStore) TruncateMessages(ctx context.Context, conversationID string, keep int) error {
+	_, err := s.db.ExecContext(ctx,
+		`DELETE FROM messages WHERE conversation_id = ? AND id NOT IN (
+			SELECT id FROM messages WHERE conversation_id = ? ORDER BY id LIMIT ?)`,
+		conversationID, conversationID, keep)
+	return err
+}
+
+// sqliteTimeLayout is how the driver writes time.Time values. Columns read
+// through aggregates come back as text in this layout.
+const sqliteTimeLayout = "2006-01-02 15:04:05.999999999 -0700 MST"
+
+// sqliteSummaryQuery selects the columns scanned by scanSummary.
+const sqliteSummaryQuery = `
+SELECT c.id, c.created_at, COUNT(m.id), COALESCE(MAX(m.created_at), ''), COALESCE(c.title, ''),
+	COALESCE((SELECT content FROM messages WHERE conversation_id = c.id AND role = 'user' ORDER BY id LIMIT 1), '')
+FROM conversations c LEFT JOIN messages m ON m.conversation_id = c.id`
+
+// scanSummary reads one row of sqliteSummaryQuery.
+func scanSummary(row interface{ Scan(...any) error }) (ConversationSummary, error) {
+	var sum ConversationSummary
+	var updated, firstMessage string
+	if err := row.Scan(&sum.ID, &sum.CreatedAt, &sum.MessageCount, &updated, &sum.Title, &firstMessage); err != nil {
+		return ConversationSummary{}, err
+	}
+	sum.UpdatedAt = sum.CreatedAt
+	if t, err := time.Parse(sqliteTimeLayout, updated); err == nil {
+		sum.UpdatedAt = t
+	}
+	if sum.Title == "" {
+		sum.Title = titleFromMessage(firstMessage)
+	}
+	return sum, nil
+}
+
+func (s *sqliteStore) ListConversations(ctx context.Context) ([]ConversationSummary, error) {
+	rows, err := s.db.QueryContext(ctx, sqliteSummaryQuery+`
+		GROUP BY c.id ORDER BY COALESCE(MAX(m.id), 0) DESC, c.created_at DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []ConversationSummary
+	for rows.Next() {
+		sum, err := scanSummary(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, sum)
+	}
+	return list, rows.Err()
+}
+
+func (s *sqliteStore) GetConversation(ctx context.Context, id string) (ConversationSummary, error) {
+	sum, err := scanSummary(s.db.QueryRowContext(ctx, sqliteSummaryQuery+`
+		WHERE c.id = ? GROUP BY c.id`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return ConversationSummary{}, ErrConversationNotFound
+	}
+	return sum, err
+}
+
+func (s *sqliteStore) SetTitle(ctx context.Context, id, title string) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE conversations SET title = ? WHERE id = ?`, title, id)
+	return err
+}
+
+func (s *sqliteStore) AddUsage(ctx context.Context, id string, usage Usage, cost float64) error {
+	_, err := s.db.ExecContext(ctx,
+		`UPDATE conversations SET prompt_tokens = prompt_tokens + ?, completion_tokens = completion_tokens + ?, cost = cost + ? WHERE id = ?`,
+		usage.PromptTokens, usage.CompletionTokens, cost, id)
+	return err
+}
+
+func (s *sqliteStore) LoadUsage(ctx context.Context, id string) (Usage, float64, error) {
+	var usage Usage
+	var cost float64
+	err := s.db.QueryRowContext(ctx,
+		`SELECT prompt_tokens, completion_tokens, cost FROM conversations WHERE id = ?`, id).
+		Scan(&usage.PromptTokens, &usage.CompletionTokens, &cost)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Usage{}, 0, nil
+	}
+	return usage, cost, err
+}
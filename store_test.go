@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStoreUsage(t *testing.T) {
+	sqlite, err := openSQLiteStore(filepath.Join(t.TempDir(), "chat.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqlite.db.Close()
+	stores := map[string]ConversationStore{"memory": newMemoryStore(), "sqlite": sqlite}
+	for name, s := range stores {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			recorder := s.(UsageRecorder)
+			id, err := s.CreateConversation(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if usage, cost, err := recorder.LoadUsage(ctx, id); err != nil || usage != (Usage{}) || cost != 0 {
+				t.Fatalf("new conversation spent %+v, $%g (err %v); want nothing", usage, cost, err)
+			}
+			recorder.AddUsage(ctx, id, Usage{PromptTokens: 100, CompletionTokens: 20}, 0.5)
+			recorder.AddUsage(ctx, id, Usage{PromptTokens: 10, CompletionTokens: 2}, 0.25)
+			usage, cost, err := recorder.LoadUsage(ctx, id)
+			if err != nil || usage != (Usage{PromptTokens: 110, CompletionTokens: 22}) || cost != 0.75 {
+				t.Errorf("spent %+v, $%g (err %v); want 110/22 tokens, $0.75", usage, cost, err)
+			}
+		})
+	}
+}
+
+func TestSQLiteStoreUsageSurvivesReopen(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "chat.db")
+	s, err := openSQLiteStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := s.CreateConversation(ctx)
+	s.AddUsage(ctx, id, Usage{PromptTokens: 7, CompletionTokens: 3}, 0.01)
+	s.db.Close()
+
+	s, err = openSQLiteStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.db.Close()
+	if usage, cost, err := s.LoadUsage(ctx, id); err != nil || usage.PromptTokens != 7 || usage.CompletionTokens != 3 || cost != 0.01 {
+		t.Errorf("after reopening: spent %+v, $%g (err %v)", usage, cost, err)
+	}
+}
+
+func TestSQLiteMigratesOldSchema(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chat.db")
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The first version's conversations had neither titles nor usage.
+	_, err = db.Exec(`CREATE TABLE conversations (id TEXT PRIMARY KEY, created_at TIMESTAMP NOT NULL);
+		INSERT INTO conversations VALUES ('old', '2024-01-01 00:00:00')`)
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := openSQLiteStore(path)
+	if err != nil {
+		t.Fatalf("opening an old database: %v", err)
+	}
+	defer s.db.Close()
+	ctx := context.Background()
+	if err := s.AddUsage(ctx, "old", Usage{PromptTokens: 1}, 0.1); err != nil {
+		t.Fatal(err)
+	}
+	if usage, cost, err := s.LoadUsage(ctx, "old"); err != nil || usage.PromptTokens != 1 || cost != 0.1 {
+		t.Errorf("spent %+v, $%g (err %v)", usage, cost, err)
+	}
+}
+
+func TestBudgetSurvivesRestart(t *testing.T) {
+	savedStore, savedBudget := store, tokenBudget
+	defer func() { store, tokenBudget = savedStore, savedBudget }()
+	sqlite, err := openSQLiteStore(filepath.Join(t.TempDir(), "chat.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqlite.db.Close()
+	store, tokenBudget = sqlite, 100
+
+	ctx := context.Background()
+	conv, _, err := NewConversationRegistry().Open(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chargeConversation(ctx, conv, "gpt-4o", Usage{PromptTokens: 80, CompletionTokens: 30})
+	if err := checkBudget(conv); err == nil {
+		t.Fatal("budget not exceeded after 110 of 100 tokens")
+	}
+
+	// A new registry has nothing in memory, as after a restart or eviction.
+	reopened, resumed, err := NewConversationRegistry().Open(ctx, conv.ID())
+	if err != nil || !resumed {
+		t.Fatalf("reopen: resumed %v, err %v", resumed, err)
+	}
+	usage, cost := reopened.Spent()
+	if usage.PromptTokens != 80 || usage.CompletionTokens != 30 || cost != usageCost("gpt-4o", usage) {
+		t.Errorf("reopened conversation spent %+v, $%g", usage, cost)
+	}
+	if err := checkBudget(reopened); err == nil || !strings.Contains(err.Error(), "100 tokens") {
+		t.Errorf("checkBudget after reopening = %v, want the budget exceeded", err)
+	}
+}
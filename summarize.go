@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Context strategies decide what happens to a conversation that outgrows the
+// model's context budget (CONTEXT_STRATEGY). Either way, turns that still don't
+// fit are dropped.
+const (
+	contextStrategyDrop      = "drop"
+	contextStrategySummarize = "summarize"
+)
+
+const (
+	// defaultSummarizeThreshold is the share of the context budget, in percent,
+	// the prompt may fill before the oldest turns are summarized.
+	defaultSummarizeThreshold = 80
+	// defaultSummarizeTurns is how many of the oldest turns are summarized at once.
+	defaultSummarizeTurns = 10
+	// summarizeTimeout bounds the summarization request, which delays the reply.
+	summarizeTimeout = 30 * time.Second
+	// summaryMaxTokens caps the length of a summary.
+	summaryMaxTokens = 512
+)
+
+var (
+	contextStrategy    = contextStrategyDrop
+	summarizeThreshold = defaultSummarizeThreshold
+	summarizeTurns     = defaultSummarizeTurns
+)
+
+const summarizePrompt = "Summarize the conversation below so it can be continued without it. " +
+	"Keep names, facts, decisions, code and open questions; leave out small talk. " +
+	"Write in the third person and be concise."
+
+// summaryContext returns the system message carrying a conversation's summary
+// of its earlier turns, if it has one.
+func summaryContext(summary string) []Message {
+	if summary == "" {
+		return nil
+	}
+	return []Message{{Role: "system", Content: "Summary of the earlier conversation:\n" + summary}}
+}
+
+// summarizeOldest condenses the conversation's oldest turns into its summary
+// once the prompt fills more than summarizeThreshold percent of the context
+// budget. The turns are replaced by the summary in memory; stored history is
+// unaffected. It reports whether the history changed. If the summary can't be
+// generated, the history is left alone and the usual dropping applies.
+func summarizeOldest(ctx context.Context, conv *Conversation, client *Client, system, history []Message) bool {
+	prompt := append(append(append([]Message(nil), system...), summaryContext(conv.Summary())...), history...)
+	if tokenizer.CountTokens(prompt) <= contextBudget(conv.Model())*summarizeThreshold/100 {
+		return false
+	}
+	n := turnsEnd(history, summarizeTurns)
+	if n == 0 {
+		return false
+	}
+
+	logger := loggerFrom(ctx).With("conversation_id", conv.ID())
+	var transcript strings.Builder
+	if summary := conv.Summary(); summary != "" {
+		transcript.WriteString("Summary of what came before:\n" + summary + "\n\n")
+	}
+	for _, m := range history[:n] {
+		transcript.WriteString(m.Role + ": " + m.Content + "\n\n")
+	}
+	ctx, cancel := context.WithTimeout(ctx, summarizeTimeout)
+	defer cancel()
+	maxTokens := summaryMaxTokens
+	req := CompletionRequest{
+		Model: conv.Model(),
+		Messages: []Message{
+			{Role: "system", Content: summarizePrompt},
+			{Role: "user", Content: transcript.String()},
+		},
+		Params: GenerationParams{MaxTokens: &maxTokens},
+		User:   client.user,
+	}
+	summary, err := complete(ctx, llm, req)
+	if err == nil {
+		chargeConversation(ctx, conv, req.Model, completionUsage(req, summary))
+	}
+	summary = strings.TrimSpace(summary)
+	if err != nil || summary == "" {
+		logger.Warn("summarizing the conversation failed", "err", err)
+		return false
+	}
+	conv.Summarize(n, summary)
+	logger.Info("conversation summarized", "messages", n)
+	client.Publish(WebSocketMessage{
+		Type:           "info",
+		Text:           fmt.Sprintf("summarized the %d oldest messages to fit the model's context window", n),
+		ConversationID: conv.ID(),
+	})
+	return true
+}
+
+// turnsEnd returns the number of messages making up the oldest turns of
+// history, a turn being a user message and everything up to the next one.
+// The latest turn is never included, so it may return fewer turns, or 0.
+func turnsEnd(history []Message, turns int) int {
+	last := 0
+	for i := len(history) - 1; i > 0; i-- {
+		if history[i].Role == "user" {
+			last = i
+			break
+		}
+	}
+	seen := 0
+	for i, m := range history[:last] {
+		if m.Role != "user" {
+			continue
+		}
+		if seen == turns {
+			return i
+		}
+		seen++
+	}
+	return last
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+	"text/template/parse"
+)
+
+// defaultTemplatesDir holds the prompt templates clients can fill in with a
+// "template" message. It can be overridden with PROMPT_TEMPLATES_DIR.
+const defaultTemplatesDir = "./templates"
+
+// templateExt is the extension of prompt template files; the rest of the file
+// name is the template's name.
+const templateExt = ".tmpl"
+
+// promptTemplates holds the templates loaded at startup, by name.
+var promptTemplates = map[string]*promptTemplate{}
+
+// promptTemplate is a text/template that renders a user message.
+type promptTemplate struct {
+	tmpl *template.Template
+	// vars are the variables the template uses, which must all be provided.
+	vars []string
+}
+
+// loadTemplates parses every template in dir. A missing directory just means
+// there are no templates.
+func loadTemplates(dir string) (map[string]*promptTemplate, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return map[string]*promptTemplate{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading prompt templates: %w", err)
+	}
+	templates := make(map[string]*promptTemplate)
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != templateExt {
+			continue
+		}
+		name := strings.TrimSuffix(entry.Name(), templateExt)
+		text, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("error reading prompt template %q: %w", name, err)
+		}
+		tmpl, err := template.New(name).Option("missingkey=error").Parse(string(text))
+		if err != nil {
+			return nil, fmt.Errorf("error parsing prompt template %q: %w", name, err)
+		}
+		templates[name] = &promptTemplate{tmpl: tmpl, vars: templateVars(tmpl.Tree.Root)}
+	}
+	return templates, nil
+}
+
+// templateVars returns the sorted names of the variables a template reads,
+// i.e. the fields of its top-level dot. Inside range and with blocks dot is
+// something else, so only their pipelines count.
+func templateVars(root *parse.ListNode) []string {
+	seen := make(map[string]bool)
+	var walkPipe func(pipe *parse.PipeNode)
+	var walkList func(list *parse.ListNode)
+	walkPipe = func(pipe *parse.PipeNode) {
+		if pipe == nil {
+			return
+		}
+		for _, cmd := range pipe.Cmds {
+			for _, arg := range cmd.Args {
+				switch arg := arg.(type) {
+				case *parse.FieldNode:
+					seen[arg.Ident[0]] = true
+				case *parse.PipeNode:
+					walkPipe(arg)
+				}
+			}
+		}
+	}
+	walkList = func(list *parse.ListNode) {
+		if list == nil {
+			return
+		}
+		for _, node := range list.Nodes {
+			switch node := node.(type) {
+			case *parse.ActionNode:
+				walkPipe(node.Pipe)
+			case *parse.IfNode:
+				walkPipe(node.Pipe)
+				walkList(node.List)
+				walkList(node.ElseList)
+			case *parse.RangeNode:
+				walkPipe(node.Pipe)
+			case *parse.WithNode:
+				walkPipe(node.Pipe)
+			}
+		}
+	}
+	walkList(root)
+	vars := make([]string, 0, len(seen))
+	for name := range seen {
+		vars = append(vars, name)
+	}
+	sort.Strings(vars)
+	return vars
+}
+
+// renderTemplate fills in the named template with vars. Unknown templates and
+// missing variables are reported in the error, which is meant for the client.
+func renderTemplate(name string, vars map[string]string) (string, error) {
+	t, ok := promptTemplates[name]
+	if !ok {
+		return "", fmt.Errorf("there is no prompt template %q", name)
+	}
+	var missing []string
+	for _, v := range t.vars {
+		if _, ok := vars[v]; !ok {
+			missing = append(missing, v)
+		}
+	}
+	if len(missing) > 0 {
+		return "", fmt.Errorf("prompt template %q needs %s", name, strings.Join(missing, ", "))
+	}
+	var out strings.Builder
+	if err := t.tmpl.Execute(&out, vars); err != nil {
+		return "", fmt.Errorf("prompt template %q could not be rendered", name)
+	}
+	return out.String(), nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// generateTitles turns title generation on (GENERATE_TITLES).
+var generateTitles = true
+
+// titleTimeout bounds the title completion, which runs after the reply is done.
+const titleTimeout = 30 * time.Second
+
+// titleMaxTokens caps the title completion; titleReasoningMaxTokens is the cap
+// for models whose limit includes their reasoning tokens.
+const (
+	titleMaxTokens          = 20
+	titleReasoningMaxTokens = 1024
+)
+
+// maxTitleWords is the longest title kept from the model's answer.
+const maxTitleWords = 6
+
+// titlePrompt asks the model for a title instead of a reply.
+const titlePrompt = "Summarize the following conversation as a title of at most 6 words. " +
+	"Reply with the title only, without quotes or punctuation at the end."
+
+// startTitleGeneration generates a title for the conversation in the
+// background once its first exchange is complete, stores it and sends it to
+// the client in a "title" frame.
+func startTitleGeneration(ctx context.Context, conv *Conversation, client *Client) {
+	if !generateTitles || !conv.NeedsTitle() {
+		return
+	}
+	// The reply's context ends with the reply, so the title gets its own.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), titleTimeout)
+	go func() {
+		defer cancel()
+		// Shutdown waits for the title, unless it has already started.
+		trackStream(func() { generateTitle(ctx, conv, client) })
+	}()
+}
+
+// generateTitle asks the model for the conversation's title, stores it and
+// sends it to the client.
+func generateTitle(ctx context.Context, conv *Conversation, client *Client) {
+	logger := loggerFrom(ctx).With("conversation_id", conv.ID())
+	var transcript strings.Builder
+	for _, m := range conv.Messages() {
+		transcript.WriteString(m.Role + ": " + m.Content + "\n\n")
+	}
+	// Reasoning models count their thinking against max_completion_tokens, so
+	// a budget fit for a title would end before they wrote any of it.
+	maxTokens := titleMaxTokens
+	if modelParams[conv.Model()].MaxCompletionTokens {
+		maxTokens = titleReasoningMaxTokens
+	}
+	req := CompletionRequest{
+		Model: conv.Model(),
+		Messages: []Message{
+			{Role: "system", Content: titlePrompt},
+			{Role: "user", Content: transcript.String()},
+		},
+		Params: GenerationParams{MaxTokens: &maxTokens},
+		User:   client.user,
+	}
+	text, err := complete(ctx, llm, req)
+	if err != nil {
+		logger.Warn("title generation failed", "err", err)
+		return
+	}
+	// The title is paid for by the conversation it names.
+	chargeConversation(ctx, conv, req.Model, completionUsage(req, text))
+	title := cleanTitle(text)
+	if title == "" {
+		return
+	}
+	if lister := conversationLister(); lister != nil {
+		if err := lister.SetTitle(ctx, conv.ID(), title); err != nil {
+			logger.Error("error saving title", "err", err)
+		}
+	}
+	client.Publish(WebSocketMessage{Type: "title", Text: title, ConversationID: conv.ID()})
+}
+
+// cleanTitle strips the quotes and trailing punctuation models tend to add and
+// keeps at most maxTitleWords words.
+func cleanTitle(text string) string {
+	words := strings.Fields(strings.Trim(strings.TrimSpace(text), `"'`))
+	if len(words) > maxTitleWords {
+		words = words[:maxTitleWords]
+	}
+	return strings.TrimRight(strings.Join(words, " "), ".!?:;,")
+}
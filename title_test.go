@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+)
+
+// titleProvider answers completions with reply and keeps the last request.
+type titleProvider struct {
+	reply string
+	req   CompletionRequest
+}
+
+// StreamCompletion implements Provider.
+func (p *titleProvider) StreamCompletion(ctx context.Context, req CompletionRequest) (<-chan StreamEvent, error) {
+	return (&MockProvider{Text: p.reply}).StreamCompletion(ctx, req)
+}
+
+// Complete implements Completer.
+func (p *titleProvider) Complete(ctx context.Context, req CompletionRequest) (string, error) {
+	p.req = req
+	return p.reply, nil
+}
+
+// titleFor generates the title of a stored conversation with model, answered
+// with reply. It returns the request, the title stored and the frames sent.
+func titleFor(t *testing.T, model, reply string) (CompletionRequest, string, []WebSocketMessage) {
+	t.Helper()
+	ctx := context.Background()
+	p := &titleProvider{reply: reply}
+	setForTest(t, &llm, Provider(p))
+	// Titles are only stored by stores that list conversations.
+	sqlite, err := openSQLiteStore(filepath.Join(t.TempDir(), "chat.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqlite.db.Close() })
+	setForTest[ConversationStore](t, &store, sqlite)
+	setForTest(t, &upstreamBreaker, newBreaker(defaultBreakerFailures, defaultBreakerCooldown))
+
+	id, err := sqlite.CreateConversation(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conv := &Conversation{id: id, history: []Message{{Role: "user", Content: "Hi"}, {Role: "assistant", Content: "Hello"}}}
+	conv.SetModel(model)
+	client := &Client{send: make(chan outgoing, 4)}
+	generateTitle(ctx, conv, client)
+
+	summary, err := sqlite.GetConversation(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var frames []WebSocketMessage
+	for len(client.send) > 0 {
+		var frame WebSocketMessage
+		if err := json.Unmarshal((<-client.send).data, &frame); err != nil {
+			t.Fatal(err)
+		}
+		frames = append(frames, frame)
+	}
+	return p.req, summary.Title, frames
+}
+
+func TestGenerateTitleBudget(t *testing.T) {
+	tests := []struct {
+		model string
+		want  int
+	}{
+		{"gpt-4o-mini", titleMaxTokens},
+		// Reasoning tokens count against the limit of the o-series.
+		{"o1-mini", titleReasoningMaxTokens},
+		{"o3-mini", titleReasoningMaxTokens},
+	}
+	for _, tt := range tests {
+		t.Run(tt.model, func(t *testing.T) {
+			req, title, frames := titleFor(t, tt.model, `"Greeting the assistant."`)
+			if req.Params.MaxTokens == nil || *req.Params.MaxTokens != tt.want {
+				t.Errorf("max tokens = %v, want %d", req.Params.MaxTokens, tt.want)
+			}
+			if title != "Greeting the assistant" {
+				t.Errorf("stored title = %q, want Greeting the assistant", title)
+			}
+			if len(frames) != 1 || frames[0].Type != "title" || frames[0].Text != title {
+				t.Errorf("frames = %+v, want one title frame", frames)
+			}
+		})
+	}
+}
+
+func TestGenerateTitleEmpty(t *testing.T) {
+	// Nothing is left once the quotes and punctuation are gone.
+	for _, reply := range []string{"", "  \n", `"..."`} {
+		_, title, frames := titleFor(t, "o1-mini", reply)
+		if title != "" || len(frames) > 0 {
+			t.Errorf("reply %q stored title %q and sent %+v, want neither", reply, title, frames)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import "unicode/utf8"
+
+// perMessageTokens approximates the tokens OpenAI adds around each message
+// for the role and separators.
+const perMessageTokens = 4
+
+// estimateTokens roughly counts the tokens in text.
+// English text averages about four characters per token with OpenAI's
+// tokenizers, which is close enough for usage reporting when a provider
+// doesn't report real counts.
+func estimateTokens(text string) int {
+	n := utf8.RuneCountInString(text)
+	return (n + 3) / 4
+}
+
+// estimateMessageTokens roughly counts the tokens a list of messages uses as a prompt.
+func estimateMessageTokens(messages []Message) int {
+	total := 0
+	for _, m := range messages {
+		total += perMessageTokens + estimateTokens(m.Content)
+	}
+	return total
+}
+
+// Tokenizer counts the tokens a list of messages takes up in a model's context window.
+type Tokenizer interface {
+	CountTokens(messages []Message) int
+}
+
+// approxTokenizer is a Tokenizer based on estimateMessageTokens.
+// It needs no model-specific vocabulary, so it works for every provider.
+type approxTokenizer struct{}
+
+func (approxTokenizer) CountTokens(messages []Message) int {
+	return estimateMessageTokens(messages)
+}
+
+// tokenizer is used to keep prompts within each model's context budget.
+var tokenizer Tokenizer = approxTokenizer{}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// maxToolRounds caps how many times one response may call tools before the
+// model has to answer, so a model stuck calling tools can't loop forever.
+const maxToolRounds = 5
+
+// toolResultTimeout is how long to wait for the client to answer a tool call
+// the server can't run itself.
+const toolResultTimeout = 30 * time.Second
+
+// toolsEnabled controls whether the built-in tools are offered to the model.
+// It is set from the ENABLE_TOOLS environment variable.
+var toolsEnabled = true
+
+// ToolCall is a function call requested by the model, in OpenAI's format.
+// Arguments is a JSON object encoded as a string.
+type ToolCall struct {
+	ID       string           `json:"id"`
+	Type     string           `json:"type"`
+	Function ToolFunctionCall `json:"function"`
+}
+
+// ToolFunctionCall names the function a ToolCall invokes.
+type ToolFunctionCall struct {
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+}
+
+// ToolDefinition describes a tool the model may call, in OpenAI's format.
+type ToolDefinition struct {
+	Type     string       `json:"type"`
+	Function ToolFunction `json:"function"`
+}
+
+// ToolFunction describes a function's name, purpose and JSON Schema parameters.
+type ToolFunction struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	Parameters  json.RawMessage `json:"parameters"`
+}
+
+// Tool is a tool the server runs itself, for the client whose reply called it.
+type Tool struct {
+	Function ToolFunction
+	Run      func(ctx context.Context, client *Client, arguments string) (string, error)
+}
+
+// builtinTools are the tools offered to the model, keyed by function name.
+var builtinTools = map[string]Tool{
+	"get_current_time": {
+		Function: ToolFunction{
+			Name:        "get_current_time",
+			Description: "Returns the current date and time, optionally in the given IANA time zone.",
+			Parameters:  json.RawMessage(`{"type":"object","properties":{"timezone":{"type":"string","description":"IANA time zone, e.g. Europe/Paris. Defaults to UTC."}}}`),
+		},
+		Run: currentTime,
+	},
+	"remember": {
+		Function: ToolFunction{
+			Name:        "remember",
+			Description: "Remembers a fact about the user for the rest of the session, such as their name. An empty value forgets the key.",
+			Parameters:  json.RawMessage(`{"type":"object","properties":{"key":{"type":"string","description":"Short name of the fact, e.g. name."},"value":{"type":"string","description":"The fact to remember."}},"required":["key","value"]}`),
+		},
+		Run: rememberTool,
+	},
+	"recall": {
+		Function: ToolFunction{
+			Name:        "recall",
+			Description: "Returns the facts remembered about the user as a JSON object.",
+			Parameters:  json.RawMessage(`{"type":"object","properties":{}}`),
+		},
+		Run: recallTool,
+	},
+}
+
+// toolDefinitions returns the definitions of the built-in tools to send upstream.
+func toolDefinitions() []ToolDefinition {
+	if !toolsEnabled {
+		return nil
+	}
+	defs := make([]ToolDefinition, 0, len(builtinTools))
+	for _, tool := range builtinTools {
+		defs = append(defs, ToolDefinition{Type: "function", Function: tool.Function})
+	}
+	return defs
+}
+
+// currentTime implements the get_current_time tool.
+func currentTime(ctx context.Context, client *Client, arguments string) (string, error) {
+	var args struct {
+		Timezone string `json:"timezone"`
+	}
+	if arguments != "" {
+		if err := json.Unmarshal([]byte(arguments), &args); err != nil {
+			return "", fmt.Errorf("invalid arguments: %w", err)
+		}
+	}
+	loc := time.UTC
+	if args.Timezone != "" {
+		var err error
+		if loc, err = time.LoadLocation(args.Timezone); err != nil {
+			return "", fmt.Errorf("unknown time zone %q", args.Timezone)
+		}
+	}
+	return time.Now().In(loc).Format(time.RFC1123Z), nil
+}
+
+// runToolCall tells the client about a tool call and returns its result.
+// Built-in tools run on the server; any other tool is left to the client,
+// which answers with a "tool_result" message. Failures are returned as the
+// result so the model can see what went wrong. Frames are tagged with the
+// ID of the conversation the call belongs to.
+func runToolCall(ctx context.Context, client *Client, conversationID string, call ToolCall) string {
+	client.Publish(ToolCallFrame{
+		Type:           "tool_call",
+		ID:             call.ID,
+		Name:           call.Function.Name,
+		Arguments:      call.Function.Arguments,
+		ConversationID: conversationID,
+	})
+	logger := loggerFrom(ctx).With("tool", call.Function.Name, "tool_call_id", call.ID)
+
+	tool, ok := builtinTools[call.Function.Name]
+	if !ok {
+		waitCtx, cancel := context.WithTimeout(ctx, toolResultTimeout)
+		defer cancel()
+		result, err := client.WaitForToolResult(waitCtx, call.ID)
+		if err != nil {
+			logger.Warn("no tool result from client", "err", err)
+			return "error: the client did not return a result"
+		}
+		return result
+	}
+
+	result, err := tool.Run(ctx, client, call.Function.Arguments)
+	if err != nil {
+		logger.Warn("tool call failed", "err", err)
+		result = "error: " + err.Error()
+	}
+	client.Publish(ToolResultFrame{
+		Type:           "tool_result",
+		ID:             call.ID,
+		Name:           call.Function.Name,
+		Result:         result,
+		ConversationID: conversationID,
+	})
+	return result
+}
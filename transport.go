@@ -0,0 +1,63 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+)
+
+// newHTTPTransport builds the transport used for every upstream call.
+// Requests go through proxy when it is set, otherwise through whatever
+// HTTPS_PROXY/HTTP_PROXY/NO_PROXY name. caFile adds PEM certificates to the
+// system pool, for proxies that intercept TLS with their own CA.
+// insecureSkipVerify turns certificate checks off entirely; it is meant for
+// testing against self-signed endpoints only.
+func newHTTPTransport(proxy, caFile string, insecureSkipVerify bool) (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if proxy != "" {
+		proxyURL, err := url.Parse(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid LLM_PROXY: %w", err)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	if caFile == "" && !insecureSkipVerify {
+		return transport, nil
+	}
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pool, err := loadCACerts(caFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if insecureSkipVerify {
+		slog.Warn("TLS certificate verification is disabled for upstream requests (LLM_INSECURE_SKIP_VERIFY); never use this in production")
+		tlsConfig.InsecureSkipVerify = true
+	}
+	transport.TLSClientConfig = tlsConfig
+	return transport, nil
+}
+
+// loadCACerts returns the system certificate pool with the PEM certificates
+// in caFile (LLM_CA_CERTS) added.
+func loadCACerts(caFile string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading LLM_CA_CERTS: %w", err)
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("LLM_CA_CERTS %q contains no PEM certificates", caFile)
+	}
+	return pool, nil
+}
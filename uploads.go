@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// defaultMaxUploadBytes is the largest file POST /api/upload accepts.
+const defaultMaxUploadBytes = 256 << 10
+
+// maxUploadBytes is the configured upload size limit.
+var maxUploadBytes = defaultMaxUploadBytes
+
+// maxStoredUploads bounds how many uploads are kept in memory; the oldest are
+// forgotten first.
+const maxStoredUploads = 1000
+
+// Upload is a text file a client uploaded to talk about in a conversation.
+type Upload struct {
+	ID             string
+	ConversationID string
+	Name           string
+	Content        string
+}
+
+// UploadStore keeps uploaded files in memory until a message references them.
+type UploadStore struct {
+	mu      sync.Mutex
+	uploads map[string]*Upload
+	order   []string
+}
+
+// NewUploadStore returns an empty UploadStore.
+func NewUploadStore() *UploadStore {
+	return &UploadStore{uploads: make(map[string]*Upload)}
+}
+
+// Add stores an upload under a new ID and returns it.
+func (s *UploadStore) Add(u Upload) *Upload {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u.ID = uuid.NewString()
+	s.uploads[u.ID] = &u
+	s.order = append(s.order, u.ID)
+	if len(s.order) > maxStoredUploads {
+		delete(s.uploads, s.order[0])
+		s.order = s.order[1:]
+	}
+	return &u
+}
+
+// Get returns the upload with the given ID if it belongs to the conversation.
+func (s *UploadStore) Get(id, conversationID string) (*Upload, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.uploads[id]
+	if !ok || u.ConversationID != conversationID {
+		return nil, false
+	}
+	return u, true
+}
+
+// uploads holds the files uploaded through POST /api/upload.
+var uploads = NewUploadStore()
+
+// UploadResponse is the body returned by POST /api/upload.
+type UploadResponse struct {
+	UploadID string `json:"uploadId"`
+	Name     string `json:"name"`
+	Bytes    int    `json:"bytes"`
+}
+
+// handleUpload accepts a text file for a conversation as the multipart field
+// "file", with the conversation in the "conversationId" field. The returned
+// upload ID can then be referenced in a chat message to add the file to the
+// conversation's context.
+func handleUpload(c *fiber.Ctx) error {
+	conversationID := c.FormValue("conversationId")
+	if conversationID == "" {
+		return apiError(c, fiber.StatusBadRequest, "conversationId is required")
+	}
+	if _, err := store.LoadMessages(c.Context(), conversationID); err != nil {
+		if errors.Is(err, ErrConversationNotFound) {
+			return apiError(c, fiber.StatusNotFound, "unknown conversation")
+		}
+		requestLogger(c).Error("error loading conversation", "conversation_id", conversationID, "err", err)
+		return apiError(c, fiber.StatusInternalServerError, "error loading conversation")
+	}
+
+	header, err := c.FormFile("file")
+	if err != nil {
+		return apiError(c, fiber.StatusBadRequest, "a file is required in the \"file\" field")
+	}
+	if header.Size > int64(maxUploadBytes) {
+		return apiError(c, fiber.StatusRequestEntityTooLarge, fmt.Sprintf("file is too large (%d bytes, the limit is %d)", header.Size, maxUploadBytes))
+	}
+	file, err := header.Open()
+	if err != nil {
+		return apiError(c, fiber.StatusBadRequest, "error reading file")
+	}
+	defer file.Close()
+	content, err := io.ReadAll(io.LimitReader(file, int64(maxUploadBytes)+1))
+	if err != nil {
+		return apiError(c, fiber.StatusBadRequest, "error reading file")
+	}
+	if len(content) > maxUploadBytes {
+		return apiError(c, fiber.StatusRequestEntityTooLarge, fmt.Sprintf("file is too large (the limit is %d bytes)", maxUploadBytes))
+	}
+	// Only text can go into a prompt.
+	if !utf8.Valid(content) || bytes.IndexByte(content, 0) >= 0 {
+		return apiError(c, fiber.StatusUnsupportedMediaType, "only text files can be uploaded")
+	}
+
+	u := uploads.Add(Upload{ConversationID: conversationID, Name: header.Filename, Content: string(content)})
+	return c.Status(fiber.StatusCreated).JSON(UploadResponse{UploadID: u.ID, Name: u.Name, Bytes: len(content)})
+}
+
+// attachUploads adds the referenced uploads to the conversation's context.
+func attachUploads(conv *Conversation, ids []string) error {
+	for _, id := range ids {
+		u, ok := uploads.Get(id, conv.ID())
+		if !ok {
+			return fmt.Errorf("unknown upload %q", id)
+		}
+		conv.AttachFile(u)
+	}
+	return nil
+}
+
+// fileContext returns a system message with the contents of the files attached
+// to a conversation, or nil if there are none.
+func fileContext(files []*Upload) []Message {
+	if len(files) == 0 {
+		return nil
+	}
+	var b strings.Builder
+	b.WriteString("The user uploaded these files for this conversation:")
+	for _, f := range files {
+		fmt.Fprintf(&b, "\n\n--- %s ---\n%s", f.Name, f.Content)
+	}
+	return []Message{{Role: "system", Content: b.String()}}
+}
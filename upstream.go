@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// defaultUpstreamWaitTimeout is how long a request waits for a free upstream
+// slot before giving up. It can be overridden with UPSTREAM_WAIT_TIMEOUT.
+const defaultUpstreamWaitTimeout = 10 * time.Second
+
+var (
+	// upstreamSlots holds one token per upstream request in flight. It is nil,
+	// and requests are unlimited, unless MAX_CONCURRENT_UPSTREAM is set.
+	upstreamSlots       chan struct{}
+	upstreamWaitTimeout = defaultUpstreamWaitTimeout
+)
+
+// ErrUpstreamBusy is returned when no upstream slot became free in time.
+var ErrUpstreamBusy = errors.New("server busy, please try again in a moment")
+
+// setMaxConcurrentUpstream limits the number of upstream requests in flight at
+// once across all clients; 0 removes the limit.
+func setMaxConcurrentUpstream(n int) {
+	upstreamSlots = nil
+	if n > 0 {
+		upstreamSlots = make(chan struct{}, n)
+	}
+}
+
+// acquireUpstream waits up to upstreamWaitTimeout for a free upstream slot.
+// The returned release function must be called exactly once when the request
+// is finished.
+func acquireUpstream(ctx context.Context) (release func(), err error) {
+	if upstreamSlots == nil {
+		return func() {}, nil
+	}
+	timer := time.NewTimer(upstreamWaitTimeout)
+	defer timer.Stop()
+	select {
+	case upstreamSlots <- struct{}{}:
+		return func() { <-upstreamSlots }, nil
+	case <-timer.C:
+		return nil, ErrUpstreamBusy
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// streamCompletion is p.StreamCompletion within the upstream limit and behind
+// the circuit breaker. The slot is held until the provider closes the stream,
+// which it does however the reply ends, including when ctx is cancelled.
+func streamCompletion(ctx context.Context, p Provider, req CompletionRequest) (<-chan StreamEvent, error) {
+	// While the provider is down, requests fail at once instead of waiting for it.
+	done, err := upstreamBreaker.Allow()
+	if err != nil {
+		return nil, err
+	}
+	release, err := acquireUpstream(ctx)
+	if err != nil {
+		done(ctx, nil)
+		return nil, err
+	}
+	events, err := p.StreamCompletion(ctx, req)
+	done(ctx, err)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	if upstreamSlots == nil {
+		return events, nil
+	}
+	limited := make(chan StreamEvent)
+	go func() {
+		defer close(limited)
+		defer release()
+		for event := range events {
+			if !sendEvent(ctx, limited, event) {
+				// Drain the stream so the provider's goroutine can finish.
+				for range events {
+				}
+				return
+			}
+		}
+	}()
+	return limited, nil
+}
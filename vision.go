@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// defaultMaxImageBytes caps the combined size of the images attached to one
+// message. Images are usually sent as base64 data URIs, so this is also roughly
+// how much a single WebSocket message may grow.
+const defaultMaxImageBytes = 4 << 20
+
+// maxImageBytes is the configured limit for the images of one message.
+var maxImageBytes = defaultMaxImageBytes
+
+// visionModels lists the models that accept images.
+var visionModels = map[string]bool{
+	"gpt-4o-mini": true,
+	"gpt-4o":      true,
+	"gpt-4-turbo": true,
+}
+
+// ContentPart is one element of OpenAI's multimodal content array: either
+// text or an image.
+type ContentPart struct {
+	Type     string    `json:"type"`
+	Text     string    `json:"text,omitempty"`
+	ImageURL *ImageURL `json:"image_url,omitempty"`
+}
+
+// ImageURL points at an image, either on the web or inline as a data URI.
+type ImageURL struct {
+	URL    string `json:"url"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// contentParts builds the content array for a message with text and images.
+func contentParts(text string, images []string) []ContentPart {
+	if len(images) == 0 {
+		return nil
+	}
+	parts := []ContentPart{{Type: "text", Text: text}}
+	for _, url := range images {
+		parts = append(parts, ContentPart{Type: "image_url", ImageURL: &ImageURL{URL: url}})
+	}
+	return parts
+}
+
+// validateImages checks the images a client attached to a message for model.
+func validateImages(model string, images []string) error {
+	if len(images) == 0 {
+		return nil
+	}
+	if !visionModels[model] {
+		return fmt.Errorf("model %q does not accept images", model)
+	}
+	size := 0
+	for _, url := range images {
+		if !strings.HasPrefix(url, "https://") && !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "data:image/") {
+			return fmt.Errorf("images must be http(s) URLs or data:image/ URIs")
+		}
+		size += len(url)
+	}
+	if size > maxImageBytes {
+		return fmt.Errorf("images are too large (%d bytes, the limit is %d)", size, maxImageBytes)
+	}
+	return nil
+}
+
+// hasImages reports whether any of the messages carries an image.
+func hasImages(messages []Message) bool {
+	for _, m := range messages {
+		for _, part := range m.Parts {
+			if part.ImageURL != nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// textOnly returns the messages with their content arrays removed, for
+// providers that only take text.
+func textOnly(messages []Message) []Message {
+	if !hasImages(messages) {
+		return messages
+	}
+	out := make([]Message, len(messages))
+	for i, m := range messages {
+		m.Parts = nil
+		out[i] = m
+	}
+	return out
+}
+
+// MarshalJSON sends the content array in place of the plain text content when
+// the message has one.
+func (m Message) MarshalJSON() ([]byte, error) {
+	type plain Message
+	if len(m.Parts) == 0 {
+		return json.Marshal(plain(m))
+	}
+	return json.Marshal(struct {
+		plain
+		Content []ContentPart `json:"content"`
+	}{plain(m), m.Parts})
+}
+
+// UnmarshalJSON accepts the content either as a string or as a content array.
+// For an array, Content is set to the text of its text parts.
+func (m *Message) UnmarshalJSON(data []byte) error {
+	type plain Message
+	var aux struct {
+		plain
+		Content json.RawMessage `json:"content"`
+	}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	*m = Message(aux.plain)
+	if len(aux.Content) == 0 || string(aux.Content) == "null" {
+		return nil
+	}
+	if aux.Content[0] != '[' {
+		return json.Unmarshal(aux.Content, &m.Content)
+	}
+	if err := json.Unmarshal(aux.Content, &m.Parts); err != nil {
+		return err
+	}
+	var text []string
+	for _, part := range m.Parts {
+		if part.Type == "text" {
+			text = append(text, part.Text)
+		}
+	}
+	m.Content = strings.Join(text, "\n")
+	return nil
+}